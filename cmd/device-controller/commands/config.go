@@ -0,0 +1,56 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package commands
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+	"os"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Configuration of the Device Controller",
+	Long:  `Configuration of the Device Controller`,
+}
+
+var printConfigCmd = &cobra.Command{
+	Use:   "print",
+	Short: "Print the effective configuration",
+	Long:  `Print the configuration that results from the flags, the environment and the configuration file, with the secrets redacted`,
+	Run: func(cmd *cobra.Command, args []string) {
+		SetupLogging()
+		err := LoadConfig(cmd.Flags())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		output, err := yaml.Marshal(effectiveConfig(cmd.Flags()))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		fmt.Print(string(output))
+	},
+}
+
+func init() {
+	addRunFlags(printConfigCmd.Flags())
+	configCmd.AddCommand(printConfigCmd)
+	rootCmd.AddCommand(configCmd)
+}
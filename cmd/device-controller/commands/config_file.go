@@ -0,0 +1,178 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// redactedFlags with the flags whose values are masked when the configuration is printed.
+var redactedFlags = map[string]bool{
+	"password": true,
+}
+
+// redactedValue replaces the value of the redacted flags that are set, so their length is not disclosed.
+const redactedValue = "********"
+
+// LoadConfig completes the flags that are not set on the command line, first from the environment and then
+// from the configuration file. The precedence is flags > environment > file > defaults.
+func LoadConfig(flags *pflag.FlagSet) error {
+	err := BindEnvironment(flags)
+	if err != nil {
+		return err
+	}
+	if configFile == "" {
+		return nil
+	}
+	values, err := readConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+	return applyConfigFile(flags, values)
+}
+
+// readConfigFile parses a configuration file depending on its extension.
+func readConfigFile(path string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read configuration file: %s", err.Error())
+	}
+	values := make(map[string]interface{}, 0)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &values)
+	case ".toml":
+		_, err = toml.Decode(string(content), &values)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		err = decoder.Decode(&values)
+	default:
+		return nil, fmt.Errorf("unsupported configuration file %s, expecting .yaml, .yml, .toml or .json", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse configuration file %s: %s", path, err.Error())
+	}
+	return values, nil
+}
+
+// configValue returns the text of a scalar value of the configuration file.
+func configValue(value interface{}) (string, error) {
+	switch typed := value.(type) {
+	case string:
+		return typed, nil
+	case bool:
+		return strconv.FormatBool(typed), nil
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64), nil
+	case json.Number:
+		return typed.String(), nil
+	case int, int64, uint64:
+		return fmt.Sprint(typed), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+// applyConfigFile sets the flags that are still unset from the values of the configuration file.
+func applyConfigFile(flags *pflag.FlagSet, values map[string]interface{}) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		flag := flags.Lookup(key)
+		if flag == nil || key == "config" {
+			return fmt.Errorf("unknown configuration key %s", key)
+		}
+		if flag.Changed {
+			continue
+		}
+		list, isList := values[key].([]interface{})
+		sliceValue, isSlice := flag.Value.(pflag.SliceValue)
+		if isList != isSlice {
+			return fmt.Errorf("invalid value of %s, expecting a %s", key, flag.Value.Type())
+		}
+		if isList {
+			items := make([]string, 0, len(list))
+			for _, item := range list {
+				text, err := configValue(item)
+				if err != nil {
+					return fmt.Errorf("invalid value of %s: %s", key, err.Error())
+				}
+				items = append(items, text)
+			}
+			if err := sliceValue.Replace(items); err != nil {
+				return fmt.Errorf("invalid value of %s: %s", key, err.Error())
+			}
+			continue
+		}
+		text, err := configValue(values[key])
+		if err != nil {
+			return fmt.Errorf("invalid value of %s: %s", key, err.Error())
+		}
+		if err := flags.Set(key, text); err != nil {
+			return fmt.Errorf("invalid value of %s: %s", key, err.Error())
+		}
+	}
+	return nil
+}
+
+// effectiveConfig returns the value of each flag, with the secrets masked. The result uses the same keys as
+// the configuration file.
+func effectiveConfig(flags *pflag.FlagSet) map[string]interface{} {
+	values := make(map[string]interface{}, 0)
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if flag.Name == "config" || flag.Name == "help" {
+			return
+		}
+		text := flag.Value.String()
+		if redactedFlags[flag.Name] {
+			if text != "" {
+				values[flag.Name] = redactedValue
+			} else {
+				values[flag.Name] = ""
+			}
+			return
+		}
+		switch flag.Value.Type() {
+		case "bool":
+			values[flag.Name], _ = strconv.ParseBool(text)
+		case "int", "uint32":
+			values[flag.Name], _ = strconv.ParseInt(text, 10, 64)
+		case "float64":
+			values[flag.Name], _ = strconv.ParseFloat(text, 64)
+		default:
+			if sliceValue, ok := flag.Value.(pflag.SliceValue); ok {
+				values[flag.Name] = sliceValue.GetSlice()
+			} else {
+				values[flag.Name] = text
+			}
+		}
+	})
+	return values
+}
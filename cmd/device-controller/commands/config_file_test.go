@@ -0,0 +1,145 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package commands
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"github.com/spf13/pflag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// testFlags returns a set of flags like the ones of the run command.
+func testFlags() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String("config", "", "Configuration file")
+	flags.String("clusterAPIHostname", "localhost", "Cluster API hostname")
+	flags.Int("port", 6020, "Port")
+	flags.Bool("useTLS", true, "Use TLS")
+	flags.Float64("weight", 0.5, "Weight")
+	flags.String("password", "", "Password")
+	flags.StringSlice("webhooks", []string{}, "Webhooks")
+	return flags
+}
+
+var _ = ginkgo.Describe("Configuration", func() {
+
+	var dir string
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config")
+		gomega.Expect(err).To(gomega.Succeed())
+	})
+
+	ginkgo.AfterEach(func() {
+		configFile = ""
+		gomega.Expect(os.Unsetenv(EnvName("port"))).To(gomega.Succeed())
+		gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+	})
+
+	writeConfig := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		gomega.Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(gomega.Succeed())
+		return path
+	}
+
+	table.DescribeTable("environment variable names",
+		func(flagName string, expected string) {
+			gomega.Expect(EnvName(flagName)).To(gomega.Equal(expected))
+		},
+		table.Entry("single word", "port", "DEVICE_CONTROLLER_PORT"),
+		table.Entry("camel case", "clusterAPIHostname", "DEVICE_CONTROLLER_CLUSTER_API_HOSTNAME"),
+		table.Entry("acronym at the end", "useTLS", "DEVICE_CONTROLLER_USE_TLS"),
+		table.Entry("digits", "oauth2Secret", "DEVICE_CONTROLLER_OAUTH2_SECRET"),
+	)
+
+	table.DescribeTable("configuration file formats",
+		func(name string, content string) {
+			configFile = writeConfig(name, content)
+			flags := testFlags()
+			gomega.Expect(LoadConfig(flags)).To(gomega.Succeed())
+			config := effectiveConfig(flags)
+			gomega.Expect(config["clusterAPIHostname"]).To(gomega.Equal("cluster.nalej"))
+			gomega.Expect(config["port"]).To(gomega.Equal(int64(7000)))
+			gomega.Expect(config["useTLS"]).To(gomega.Equal(false))
+			gomega.Expect(config["weight"]).To(gomega.Equal(0.25))
+			gomega.Expect(config["webhooks"]).To(gomega.Equal([]string{"http://a", "http://b"}))
+		},
+		table.Entry("YAML", "config.yaml",
+			"clusterAPIHostname: cluster.nalej\nport: 7000\nuseTLS: false\nweight: 0.25\nwebhooks:\n- http://a\n- http://b\n"),
+		table.Entry("TOML", "config.toml",
+			"clusterAPIHostname = \"cluster.nalej\"\nport = 7000\nuseTLS = false\nweight = 0.25\nwebhooks = [\"http://a\", \"http://b\"]\n"),
+		table.Entry("JSON", "config.json",
+			`{"clusterAPIHostname": "cluster.nalej", "port": 7000, "useTLS": false, "weight": 0.25, "webhooks": ["http://a", "http://b"]}`),
+	)
+
+	table.DescribeTable("precedence",
+		func(args []string, env string, file string, expected int64) {
+			if file != "" {
+				configFile = writeConfig("config.yaml", file)
+			}
+			if env != "" {
+				gomega.Expect(os.Setenv(EnvName("port"), env)).To(gomega.Succeed())
+			}
+			flags := testFlags()
+			gomega.Expect(flags.Parse(args)).To(gomega.Succeed())
+			gomega.Expect(LoadConfig(flags)).To(gomega.Succeed())
+			gomega.Expect(effectiveConfig(flags)["port"]).To(gomega.Equal(expected))
+		},
+		table.Entry("default", []string{}, "", "", int64(6020)),
+		table.Entry("file over default", []string{}, "", "port: 7000\n", int64(7000)),
+		table.Entry("environment over file", []string{}, "8000", "port: 7000\n", int64(8000)),
+		table.Entry("flag over environment", []string{"--port=9000"}, "8000", "port: 7000\n", int64(9000)),
+	)
+
+	table.DescribeTable("invalid configuration",
+		func(name string, content string) {
+			configFile = writeConfig(name, content)
+			gomega.Expect(LoadConfig(testFlags())).NotTo(gomega.Succeed())
+		},
+		table.Entry("unsupported extension", "config.ini", "port=7000"),
+		table.Entry("malformed file", "config.json", "{"),
+		table.Entry("unknown key", "config.yaml", "unknown: 1\n"),
+		table.Entry("config key", "config.yaml", "config: other.yaml\n"),
+		table.Entry("invalid value", "config.yaml", "port: text\n"),
+		table.Entry("list for a scalar flag", "config.yaml", "port: [1, 2]\n"),
+		table.Entry("scalar for a list flag", "config.yaml", "webhooks: http://a\n"),
+	)
+
+	ginkgo.It("should report an invalid environment variable", func() {
+		gomega.Expect(os.Setenv(EnvName("port"), "text")).To(gomega.Succeed())
+		gomega.Expect(LoadConfig(testFlags())).NotTo(gomega.Succeed())
+	})
+
+	table.DescribeTable("redacted values",
+		func(password string, expected string) {
+			flags := testFlags()
+			gomega.Expect(flags.Set("password", password)).To(gomega.Succeed())
+			config := effectiveConfig(flags)
+			gomega.Expect(config["password"]).To(gomega.Equal(expected))
+			gomega.Expect(config).NotTo(gomega.HaveKey("config"))
+		},
+		table.Entry("password set", "secret-password", redactedValue),
+		table.Entry("short password", "a", redactedValue),
+		table.Entry("password not set", "", ""),
+	)
+
+})
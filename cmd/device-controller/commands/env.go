@@ -0,0 +1,65 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package commands
+
+import (
+	"fmt"
+	"github.com/spf13/pflag"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// EnvPrefix with the prefix of the environment variables that set the flags.
+const EnvPrefix = "DEVICE_CONTROLLER_"
+
+// EnvName returns the environment variable of a flag, e.g. DEVICE_CONTROLLER_CLUSTER_API_HOSTNAME for
+// clusterAPIHostname.
+func EnvName(flagName string) string {
+	runes := []rune(flagName)
+	var name strings.Builder
+	name.WriteString(EnvPrefix)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			previous := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(previous) || unicode.IsDigit(previous) || (unicode.IsUpper(previous) && nextIsLower) {
+				name.WriteRune('_')
+			}
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+// BindEnvironment sets the flags that are not set on the command line from their environment variables.
+func BindEnvironment(flags *pflag.FlagSet) error {
+	var result error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if flag.Changed || result != nil {
+			return
+		}
+		value, exists := os.LookupEnv(EnvName(flag.Name))
+		if !exists {
+			return
+		}
+		if err := flags.Set(flag.Name, value); err != nil {
+			result = fmt.Errorf("cannot set %s from %s: %s", flag.Name, EnvName(flag.Name), err.Error())
+		}
+	})
+	return result
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package commands
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"os"
+)
+
+var _ = ginkgo.Describe("Environment", func() {
+
+	var names []string
+
+	setEnv := func(flagName string, value string) {
+		names = append(names, EnvName(flagName))
+		gomega.Expect(os.Setenv(EnvName(flagName), value)).To(gomega.Succeed())
+	}
+
+	ginkgo.AfterEach(func() {
+		for _, name := range names {
+			gomega.Expect(os.Unsetenv(name)).To(gomega.Succeed())
+		}
+		names = nil
+	})
+
+	table.DescribeTable("flag types",
+		func(flagName string, value string, expected string) {
+			setEnv(flagName, value)
+			flags := testFlags()
+			gomega.Expect(BindEnvironment(flags)).To(gomega.Succeed())
+			gomega.Expect(flags.Lookup(flagName).Changed).To(gomega.BeTrue())
+			gomega.Expect(flags.Lookup(flagName).Value.String()).To(gomega.Equal(expected))
+		},
+		table.Entry("string", "clusterAPIHostname", "cluster.nalej", "cluster.nalej"),
+		table.Entry("integer", "port", "7000", "7000"),
+		table.Entry("boolean", "useTLS", "false", "false"),
+		table.Entry("float", "weight", "0.25", "0.25"),
+		table.Entry("list", "webhooks", "http://a,http://b", "[http://a,http://b]"),
+		table.Entry("credential", "password", "secret", "secret"),
+	)
+
+	ginkgo.It("should keep the defaults of the flags without environment variable", func() {
+		flags := testFlags()
+		gomega.Expect(BindEnvironment(flags)).To(gomega.Succeed())
+		gomega.Expect(flags.Lookup("port").Changed).To(gomega.BeFalse())
+		gomega.Expect(flags.Lookup("port").Value.String()).To(gomega.Equal("6020"))
+	})
+
+	ginkgo.It("should not override the flags set on the command line", func() {
+		setEnv("port", "8000")
+		flags := testFlags()
+		gomega.Expect(flags.Parse([]string{"--port=9000"})).To(gomega.Succeed())
+		gomega.Expect(BindEnvironment(flags)).To(gomega.Succeed())
+		gomega.Expect(flags.Lookup("port").Value.String()).To(gomega.Equal("9000"))
+	})
+
+	ginkgo.It("should ignore the variables without the prefix", func() {
+		names = append(names, "PORT")
+		gomega.Expect(os.Setenv("PORT", "8000")).To(gomega.Succeed())
+		flags := testFlags()
+		gomega.Expect(BindEnvironment(flags)).To(gomega.Succeed())
+		gomega.Expect(flags.Lookup("port").Value.String()).To(gomega.Equal("6020"))
+	})
+
+	ginkgo.It("should name the variable with an invalid value", func() {
+		setEnv("useTLS", "maybe")
+		err := BindEnvironment(testFlags())
+		gomega.Expect(err).NotTo(gomega.Succeed())
+		gomega.Expect(err.Error()).To(gomega.ContainSubstring("DEVICE_CONTROLLER_USE_TLS"))
+	})
+
+})
@@ -20,37 +20,105 @@ import (
 	"github.com/nalej/device-controller/pkg/server"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"time"
 )
 
 var config = server.Config{}
 
+// configFile with the path of the configuration file.
+var configFile string
+
 var runCmd = &cobra.Command{
 	Use:   "run",
 	Short: "Run Device Controller",
 	Long:  `Run Device Controller`,
 	Run: func(cmd *cobra.Command, args []string) {
+		cErr := LoadConfig(cmd.Flags())
 		SetupLogging()
+		if cErr != nil {
+			log.Fatal().Err(cErr).Msg("invalid configuration")
+		}
 		log.Info().Msg("Launching API!")
 		server := server.NewService(config)
-		server.Run()
+		if err := server.Run(); err != nil {
+			log.Fatal().Err(err).Msg("device controller failed")
+		}
 	},
 }
 
 func init() {
-	runCmd.Flags().IntVar(&config.Port, "port", 6020, "Port to launch the Device gRPC API")
-	runCmd.Flags().IntVar(&config.HTTPPort, "httpPort", 6021, "Port to launch the Device HTTP API")
-	runCmd.Flags().IntVar(&config.Threshold, "threshold", 100, "Threshold for latency")
-	runCmd.Flags().StringVar(&config.ClusterAPIHostname, "clusterAPIHostname", "", "Hostname of the cluster API on the management cluster")
-	runCmd.Flags().Uint32Var(&config.ClusterAPIPort, "clusterAPIPort", 8000, "Port where the cluster API is listening")
-	runCmd.Flags().StringVar(&config.LoginHostname, "loginHostname", "", "Hostname of the login service")
-	runCmd.Flags().Uint32Var(&config.LoginPort, "loginPort", 31683, "port where the login service is listening")
-	runCmd.Flags().BoolVar(&config.UseTLSForLogin, "useTLSForLogin", true, "Use TLS to connect to the Login API")
-	runCmd.Flags().StringVar(&config.Email, "email", "", "email address")
-	runCmd.Flags().StringVar(&config.Password, "password", "", "password")
-	runCmd.PersistentFlags().StringVar(&config.AuthHeader, "authHeader", "", "Authorization Header")
-	runCmd.PersistentFlags().StringVar(&config.AuthConfigPath, "authConfigPath", "", "Authorization config path")
-	runCmd.Flags().StringVar(&config.CACertPath, "caCertPath", "", "Path for the CA certificate")
-	runCmd.Flags().StringVar(&config.ClientCertPath, "clientCertPath", "", "Path for the client certificate")
-	runCmd.Flags().BoolVar(&config.SkipServerCertValidation, "skipServerCertValidation", true, "Skip CA authentication validation")
+	addRunFlags(runCmd.Flags())
 	rootCmd.AddCommand(runCmd)
 }
+
+// addRunFlags defines the flags of the service configuration.
+func addRunFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&configFile, "config", "", "Path of a YAML, TOML or JSON file with the configuration, using the flag names as keys")
+	flags.IntVar(&config.Port, "port", 6020, "Port to launch the Device gRPC API")
+	flags.IntVar(&config.HTTPPort, "httpPort", 6021, "Port to launch the Device HTTP API")
+	flags.IntVar(&config.HealthPort, "healthPort", 6022, "Port to launch the gRPC health service")
+	flags.IntVar(&config.MetricsPort, "metricsPort", 6023, "Port to serve the metrics, apart from the HTTP port")
+	flags.IntVar(&config.Threshold, "threshold", 100, "Threshold for latency")
+	flags.StringVar(&config.ThresholdPolicyPath, "thresholdPolicyPath", "", "Path of the file with the latency thresholds of organizations, device groups and devices")
+	flags.StringVar(&config.LatencyStatistic, "latencyStatistic", "p95", "Statistic of a latency window compared against the threshold: last, ewma, p50, p95 or p99")
+	flags.IntVar(&config.LatencyWindowSize, "latencyWindowSize", 5, "Number of latency samples of a window")
+	flags.IntVar(&config.LatencyConsecutiveWindows, "latencyConsecutiveWindows", 2, "Number of consecutive windows above the threshold that require a new latency check")
+	flags.Float64Var(&config.LatencyEWMAAlpha, "latencyEWMAAlpha", 0.3, "Weight of a new sample on the moving average of the latency")
+	flags.IntVar(&config.LatencyMaxJitter, "latencyMaxJitter", 0, "Jitter in milliseconds of a latency window that requires a new latency check, 0 to disable it")
+	flags.StringVar(&config.SelectionStrategy, "selectionStrategy", "min_latency", "Default cluster selection strategy: min_latency, weighted_random or hysteresis")
+	flags.Float64Var(&config.SelectionTolerance, "selectionTolerance", 10, "Percentage over the best latency of the clusters considered by the weighted_random strategy")
+	flags.Float64Var(&config.SelectionMargin, "selectionMargin", 20, "Percentage of latency gain required by the hysteresis strategy to move a device")
+	flags.StringVar(&config.SelectionPolicyPath, "selectionPolicyPath", "", "Path of the file with the cluster selection strategy of each organization")
+	flags.Float64Var(&config.RateLimit, "rateLimit", 1, "Requests per second allowed to each device on average, 0 for no limit")
+	flags.IntVar(&config.RateLimitBurst, "rateLimitBurst", 10, "Requests allowed to each device at once")
+	flags.StringVar(&config.RateLimitPolicyPath, "rateLimitPolicyPath", "", "Path of the file with the rate limit of each organization")
+	flags.DurationVar(&config.AssignmentTTL, "assignmentTTL", 24*time.Hour, "Time a device assignment is remembered after its last selection")
+	flags.DurationVar(&config.AssignmentCooldown, "assignmentCooldown", 5*time.Minute, "Minimum time between two moves of a device to a different cluster")
+	flags.IntVar(&config.AssignmentMaxMovesPerHour, "assignmentMaxMovesPerHour", 4, "Maximum number of moves of a device in an hour, 0 for no limit")
+	flags.IntVar(&config.AssignmentHistorySize, "assignmentHistorySize", 20, "Number of cluster selections remembered for each device")
+	flags.DurationVar(&config.LivenessStaleTimeout, "livenessStaleTimeout", 2*time.Minute, "Time after which a device that has not been seen becomes STALE")
+	flags.DurationVar(&config.LivenessOfflineTimeout, "livenessOfflineTimeout", 10*time.Minute, "Time after which a device that has not been seen becomes OFFLINE")
+	flags.DurationVar(&config.LivenessCheckInterval, "livenessCheckInterval", 30*time.Second, "Time between two checks of the state of the devices")
+	flags.DurationVar(&config.LivenessForgetTimeout, "livenessForgetTimeout", 24*time.Hour, "Time after which an OFFLINE device is no longer tracked")
+	flags.StringSliceVar(&config.WebhookURLs, "webhookURL", []string{}, "URL of a webhook notified of device state changes and latency degradations, may be repeated")
+	flags.StringVar(&config.WebhookSecretPath, "webhookSecretPath", "", "Path of the file with the secret used to sign the webhook notifications")
+	flags.IntVar(&config.WebhookMaxAttempts, "webhookMaxAttempts", 5, "Delivery attempts of a webhook notification")
+	flags.DurationVar(&config.WebhookInitialBackoff, "webhookInitialBackoff", time.Second, "Time to wait after the first failed delivery of a webhook notification")
+	flags.DurationVar(&config.WebhookMaxBackoff, "webhookMaxBackoff", time.Minute, "Maximum time to wait between delivery attempts of a webhook notification")
+	flags.DurationVar(&config.WebhookTimeout, "webhookTimeout", 10*time.Second, "Timeout of each webhook request")
+	flags.IntVar(&config.WebhookQueueSize, "webhookQueueSize", 1000, "Number of notifications waiting to be sent to each webhook")
+	flags.StringVar(&config.CredentialStore, "credentialStore", "memory", "Store of the cluster API credentials: memory, file or encrypted")
+	flags.StringVar(&config.CredentialStorePath, "credentialStorePath", "", "Directory where the file and encrypted stores save the cluster API credentials")
+	flags.StringVar(&config.CredentialStoreKeyPath, "credentialStoreKeyPath", "", "Path of the file with the secret that encrypts the cluster API credentials")
+	flags.DurationVar(&config.TokenRenewalMargin, "tokenRenewalMargin", 5*time.Minute, "Time before the expiration of the cluster API token when it is renewed")
+	flags.DurationVar(&config.ShutdownTimeout, "shutdownTimeout", 30*time.Second, "Time given to the servers and the latency queue to finish on shutdown")
+	flags.BoolVar(&config.EnableDebugEndpoints, "enableDebugEndpoints", false, "Expose the debug endpoints on the metrics port")
+	flags.StringVar(&config.ClusterAPIHostname, "clusterAPIHostname", "", "Hostname of the cluster API on the management cluster")
+	flags.Uint32Var(&config.ClusterAPIPort, "clusterAPIPort", 8000, "Port where the cluster API is listening")
+	flags.StringVar(&config.LoginHostname, "loginHostname", "", "Hostname of the login service")
+	flags.Uint32Var(&config.LoginPort, "loginPort", 31683, "port where the login service is listening")
+	flags.BoolVar(&config.UseTLSForLogin, "useTLSForLogin", true, "Use TLS to connect to the Login API")
+	flags.StringVar(&config.Email, "email", "", "email address")
+	flags.StringVar(&config.Password, "password", "", "password")
+	flags.StringVar(&config.EmailFile, "emailFile", "", "Path of the file with the email address")
+	flags.StringVar(&config.PasswordFile, "passwordFile", "", "Path of the file with the password")
+	flags.StringVar(&config.AuthHeader, "authHeader", "", "Authorization Header")
+	flags.StringVar(&config.AuthConfigPath, "authConfigPath", "", "Authorization config path")
+	flags.StringVar(&config.AuditLogPath, "auditLogPath", "", "Path of the file where the rejected device requests are recorded")
+	flags.StringVar(&config.CACertPath, "caCertPath", "", "Path for the CA certificate")
+	flags.StringVar(&config.ClientCertPath, "clientCertPath", "", "Path for the client certificate")
+	flags.BoolVar(&config.SkipServerCertValidation, "skipServerCertValidation", true, "Skip CA authentication validation")
+	flags.StringVar(&config.ServerCertPath, "serverCertPath", "", "Path of the directory with the tls.crt and tls.key served on the gRPC and HTTP ports")
+	flags.StringVar(&config.DeviceCACertPath, "deviceCACertPath", "", "Path of the CA certificate that signs the device client certificates")
+	flags.BoolVar(&config.RequireDeviceCert, "requireDeviceCert", false, "Reject the devices without a valid client certificate")
+	flags.StringVar(&config.QueuePath, "queuePath", "/tmp/device-controller/queue", "Directory where the latency samples pending to be sent are stored")
+	flags.IntVar(&config.QueueMaxSize, "queueMaxSize", 10000, "Maximum number of latency samples pending to be sent")
+	flags.IntVar(&config.QueueMaxAttempts, "queueMaxAttempts", 10, "Delivery attempts before a latency sample is moved to the dead letter directory")
+	flags.DurationVar(&config.QueueInitialBackoff, "queueInitialBackoff", time.Second, "Time to wait after the first failed delivery of a latency sample")
+	flags.DurationVar(&config.QueueMaxBackoff, "queueMaxBackoff", 5*time.Minute, "Maximum time to wait between delivery attempts of a latency sample")
+	flags.DurationVar(&config.BatchFlushInterval, "batchFlushInterval", time.Second, "Maximum time a latency sample waits to be sent in a batch")
+	flags.IntVar(&config.BatchMaxSize, "batchMaxSize", 100, "Maximum number of latency samples handed to a forwarding worker at once")
+	flags.IntVar(&config.ForwardWorkers, "forwardWorkers", 4, "Number of batches sent to the cluster API concurrently")
+	flags.StringVar(&config.LatencyNotReadyPolicy, "latencyNotReadyPolicy", "queue", "Latency samples received before connecting to the management cluster are queued (queue) or rejected (reject)")
+}
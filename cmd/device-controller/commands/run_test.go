@@ -0,0 +1,53 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package commands
+
+import (
+	"github.com/nalej/device-controller/pkg/latency"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Run defaults", func() {
+
+	table.DescribeTable("latency evaluation",
+		func(slow []int, expected bool) {
+			rule := config.GetLatencyRule()
+			gomega.Expect(rule.Validate()).To(gomega.BeNil())
+			evaluator := latency.NewEvaluator(rule)
+			isSlow := make(map[int]bool, len(slow))
+			for _, index := range slow {
+				isSlow[index] = true
+			}
+			required := false
+			for i := 0; i < 10*rule.WindowSize; i++ {
+				sample := config.Threshold / 2
+				if isSlow[i] {
+					sample = config.Threshold * 10
+				}
+				checkRequired, _ := evaluator.Add("org", "group", "device", sample, config.Threshold)
+				required = required || checkRequired
+			}
+			gomega.Expect(required).To(gomega.Equal(expected))
+		},
+		table.Entry("no slow samples", []int{}, false),
+		table.Entry("a single slow sample", []int{7}, false),
+		table.Entry("slow samples far apart", []int{7, 23, 41}, false),
+		table.Entry("slow samples in consecutive windows", []int{7, 12}, true),
+	)
+})
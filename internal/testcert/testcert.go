@@ -0,0 +1,99 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package testcert generates the certificates used by the tests of the TLS connections.
+package testcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Certificate with a certificate and its key.
+type Certificate struct {
+	Certificate *x509.Certificate
+	Key         *ecdsa.PrivateKey
+}
+
+// New creates a certificate for localhost signed by the given CA, or a self-signed CA if it is nil.
+func New(commonName string, ca *Certificate) *Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gomega.Expect(err).To(gomega.Succeed())
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	gomega.Expect(err).To(gomega.Succeed())
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  ca == nil,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, parentKey := template, key
+	if ca != nil {
+		parent, parentKey = ca.Certificate, ca.Key
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	gomega.Expect(err).To(gomega.Succeed())
+	certificate, err := x509.ParseCertificate(raw)
+	gomega.Expect(err).To(gomega.Succeed())
+	return &Certificate{Certificate: certificate, Key: key}
+}
+
+// CertPEM returns the certificate encoded as PEM.
+func (c *Certificate) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate.Raw})
+}
+
+// KeyPEM returns the key encoded as PEM.
+func (c *Certificate) KeyPEM() []byte {
+	raw, err := x509.MarshalECPrivateKey(c.Key)
+	gomega.Expect(err).To(gomega.Succeed())
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: raw})
+}
+
+// TLSCertificate returns the certificate and its key to be served.
+func (c *Certificate) TLSCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.Certificate.Raw}, PrivateKey: c.Key}
+}
+
+// WriteCA writes the certificate as a CA bundle.
+func (c *Certificate) WriteCA(path string) {
+	gomega.Expect(ioutil.WriteFile(path, c.CertPEM(), 0600)).To(gomega.Succeed())
+}
+
+// WriteDir writes the certificate and the key with the given file names, as in a Kubernetes TLS secret.
+func (c *Certificate) WriteDir(dir string, certFileName string, keyFileName string) {
+	gomega.Expect(os.MkdirAll(dir, 0700)).To(gomega.Succeed())
+	gomega.Expect(ioutil.WriteFile(filepath.Join(dir, certFileName), c.CertPEM(), 0600)).To(gomega.Succeed())
+	gomega.Expect(ioutil.WriteFile(filepath.Join(dir, keyFileName), c.KeyPEM(), 0600)).To(gomega.Succeed())
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package assignment
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// DebugPath with the HTTP path that serves the assignments.
+const DebugPath = "/debug/assignments/"
+
+// DeviceAssignments with the current assignment and the history of a device.
+type DeviceAssignments struct {
+	Current *Assignment `json:"current,omitempty"`
+	History []Record    `json:"history"`
+}
+
+// DebugHandler serves the assignment of a device on DebugPath/<organization_id>/<device_group_id>/<device_id>.
+type DebugHandler struct {
+	Store Store
+}
+
+func NewDebugHandler(store Store) *DebugHandler {
+	return &DebugHandler{Store: store}
+}
+
+func (h *DebugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ids := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, DebugPath), "/"), "/")
+	if len(ids) != 3 || ids[0] == "" || ids[1] == "" || ids[2] == "" {
+		http.Error(w, "expecting organization_id/device_group_id/device_id", http.StatusBadRequest)
+		return
+	}
+	result := DeviceAssignments{History: h.Store.History(ids[0], ids[1], ids[2])}
+	if current, exists := h.Store.Get(ids[0], ids[1], ids[2]); exists {
+		result.Current = current
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package assignment
+
+import (
+	"time"
+)
+
+const (
+	// ReasonNew is used when the device had no previous assignment.
+	ReasonNew = "new"
+	// ReasonKept is used when the strategy chose the current cluster.
+	ReasonKept = "kept"
+	// ReasonMoved is used when the device moved to a different cluster.
+	ReasonMoved = "moved"
+	// ReasonCooldown is used when a move was blocked because the last one is too recent.
+	ReasonCooldown = "cooldown"
+	// ReasonMoveLimit is used when a move was blocked because the device reached the moves per hour.
+	ReasonMoveLimit = "move_limit"
+	// ReasonUnavailable is used when the device moved because its cluster is not in the list of clusters.
+	ReasonUnavailable = "unavailable"
+)
+
+// Policy that limits how often a device moves between clusters.
+type Policy struct {
+	// Cooldown with the minimum time between two moves.
+	Cooldown time.Duration
+	// MaxMovesPerHour with the maximum number of moves in an hour. Zero means no limit.
+	MaxMovesPerHour int
+}
+
+// Apply decides the cluster of a device given its previous assignment and the cluster chosen by the selection
+// strategy. It returns the new assignment and the reason of the decision. A device whose cluster is no longer
+// in the list moves regardless of the cooldown and the move limit, and the move counts towards the limit.
+func (p *Policy) Apply(previous *Assignment, candidate int, numClusters int, now time.Time) (Assignment, string) {
+	if previous == nil {
+		return Assignment{ClusterIndex: candidate, AssignedAt: now, LastSelected: now}, ReasonNew
+	}
+	next := *previous
+	next.LastSelected = now
+	moves := make([]time.Time, 0, len(previous.Moves)+1)
+	for _, move := range previous.Moves {
+		if now.Sub(move) < time.Hour {
+			moves = append(moves, move)
+		}
+	}
+	next.Moves = moves
+	if previous.ClusterIndex < 0 || previous.ClusterIndex >= numClusters {
+		next.ClusterIndex = candidate
+		next.AssignedAt = now
+		next.Moves = append(next.Moves, now)
+		return next, ReasonUnavailable
+	}
+	if candidate == previous.ClusterIndex {
+		return next, ReasonKept
+	}
+	if now.Sub(previous.AssignedAt) < p.Cooldown {
+		return next, ReasonCooldown
+	}
+	if p.MaxMovesPerHour > 0 && len(moves) >= p.MaxMovesPerHour {
+		return next, ReasonMoveLimit
+	}
+	next.ClusterIndex = candidate
+	next.AssignedAt = now
+	next.Moves = append(next.Moves, now)
+	return next, ReasonMoved
+}
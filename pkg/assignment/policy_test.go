@@ -0,0 +1,73 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package assignment
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"time"
+)
+
+var _ = ginkgo.Describe("Policy", func() {
+
+	now := time.Now()
+	policy := Policy{Cooldown: 5 * time.Minute, MaxMovesPerHour: 2}
+
+	table.DescribeTable("apply",
+		func(previous *Assignment, candidate int, numClusters int, expectedCluster int, expectedReason string, expectedMoves int) {
+			next, reason := policy.Apply(previous, candidate, numClusters, now)
+			gomega.Expect(reason).To(gomega.Equal(expectedReason))
+			gomega.Expect(next.ClusterIndex).To(gomega.Equal(expectedCluster))
+			gomega.Expect(next.Moves).To(gomega.HaveLen(expectedMoves))
+			gomega.Expect(next.LastSelected).To(gomega.Equal(now))
+		},
+		table.Entry("new device", nil, 1, 3, 1, ReasonNew, 0),
+		table.Entry("same cluster",
+			&Assignment{ClusterIndex: 1, AssignedAt: now.Add(-time.Hour)}, 1, 3, 1, ReasonKept, 0),
+		table.Entry("move after the cooldown",
+			&Assignment{ClusterIndex: 1, AssignedAt: now.Add(-time.Hour)}, 2, 3, 2, ReasonMoved, 1),
+		table.Entry("move within the cooldown",
+			&Assignment{ClusterIndex: 1, AssignedAt: now.Add(-time.Minute)}, 2, 3, 1, ReasonCooldown, 0),
+		table.Entry("move limit reached",
+			&Assignment{ClusterIndex: 1, AssignedAt: now.Add(-10 * time.Minute),
+				Moves: []time.Time{now.Add(-20 * time.Minute), now.Add(-10 * time.Minute)}}, 2, 3, 1, ReasonMoveLimit, 2),
+		table.Entry("moves older than an hour are forgotten",
+			&Assignment{ClusterIndex: 1, AssignedAt: now.Add(-10 * time.Minute),
+				Moves: []time.Time{now.Add(-2 * time.Hour), now.Add(-10 * time.Minute)}}, 2, 3, 2, ReasonMoved, 2),
+		table.Entry("cluster no longer in the list",
+			&Assignment{ClusterIndex: 4, AssignedAt: now.Add(-time.Minute),
+				Moves: []time.Time{now.Add(-2 * time.Hour), now.Add(-time.Minute)}}, 0, 3, 0, ReasonUnavailable, 2),
+	)
+
+	ginkgo.It("should count the moves caused by a shorter cluster list towards the limit", func() {
+		steps := []struct {
+			numClusters int
+			candidate   int
+		}{{3, 2}, {1, 0}, {3, 2}, {3, 1}}
+		var previous *Assignment
+		reasons := make([]string, 0, len(steps))
+		for i, step := range steps {
+			next, reason := policy.Apply(previous, step.candidate, step.numClusters, now.Add(time.Duration(i)*10*time.Minute))
+			previous = &next
+			reasons = append(reasons, reason)
+		}
+		gomega.Expect(reasons).To(gomega.Equal([]string{ReasonNew, ReasonUnavailable, ReasonMoved, ReasonMoveLimit}))
+		gomega.Expect(previous.ClusterIndex).To(gomega.Equal(2))
+	})
+
+})
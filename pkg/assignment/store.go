@@ -0,0 +1,156 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package assignment
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Assignment with the cluster selected for a device.
+type Assignment struct {
+	OrganizationId string `json:"organization_id"`
+	DeviceGroupId  string `json:"device_group_id"`
+	DeviceId       string `json:"device_id"`
+	// ClusterIndex with the position of the selected cluster in the last SelectClusterRequest.
+	ClusterIndex int `json:"cluster_index"`
+	// AssignedAt with the time the device moved to the cluster.
+	AssignedAt time.Time `json:"assigned_at"`
+	// LastSelected with the time of the last selection.
+	LastSelected time.Time `json:"last_selected"`
+	// Moves with the time of the moves of the last hour.
+	Moves []time.Time `json:"moves,omitempty"`
+}
+
+// Record with an entry of the selection history of a device.
+type Record struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Candidate with the cluster chosen by the selection strategy.
+	Candidate int `json:"candidate"`
+	// ClusterIndex with the cluster finally selected.
+	ClusterIndex int `json:"cluster_index"`
+	// Latencies sent by the device.
+	Latencies []int32 `json:"latencies"`
+	// Reason of the decision.
+	Reason string `json:"reason"`
+}
+
+// Store keeps the last assignment and the selection history of each device.
+type Store interface {
+	// Get returns the assignment of a device if it has not expired.
+	Get(organizationID string, deviceGroupID string, deviceID string) (*Assignment, bool)
+	// Update replaces the assignment of a device with the one returned by the update function, and adds the
+	// returned record to its history. The function receives the current assignment, or nil if the device has
+	// none, and runs while the assignment is locked, so concurrent updates of a device are applied one after
+	// the other.
+	Update(organizationID string, deviceGroupID string, deviceID string, update func(previous *Assignment) (Assignment, Record)) Assignment
+	// History returns the selection history of a device, oldest first.
+	History(organizationID string, deviceGroupID string, deviceID string) []Record
+}
+
+func deviceKey(organizationID string, deviceGroupID string, deviceID string) string {
+	return fmt.Sprintf("%s/%s/%s", organizationID, deviceGroupID, deviceID)
+}
+
+type memoryEntry struct {
+	assignment Assignment
+	history    []Record
+}
+
+// MemoryStore keeps the assignments in memory. Assignments that are not selected again within the TTL expire
+// together with their history.
+type MemoryStore struct {
+	ttl         time.Duration
+	historySize int
+	mu          sync.RWMutex
+	entries     map[string]*memoryEntry
+	lastExpire  time.Time
+}
+
+func NewMemoryStore(ttl time.Duration, historySize int) *MemoryStore {
+	return &MemoryStore{
+		ttl:         ttl,
+		historySize: historySize,
+		entries:     make(map[string]*memoryEntry, 0),
+		lastExpire:  time.Now(),
+	}
+}
+
+func (m *MemoryStore) Get(organizationID string, deviceGroupID string, deviceID string) (*Assignment, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.get(deviceKey(organizationID, deviceGroupID, deviceID))
+}
+
+// get returns a copy of the assignment of a device if it has not expired. It must be called with the lock held.
+func (m *MemoryStore) get(key string) (*Assignment, bool) {
+	entry, exists := m.entries[key]
+	if !exists || time.Since(entry.assignment.LastSelected) > m.ttl {
+		return nil, false
+	}
+	assignment := entry.assignment
+	assignment.Moves = append([]time.Time{}, entry.assignment.Moves...)
+	return &assignment, true
+}
+
+func (m *MemoryStore) Update(organizationID string, deviceGroupID string, deviceID string, update func(previous *Assignment) (Assignment, Record)) Assignment {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(time.Now())
+	key := deviceKey(organizationID, deviceGroupID, deviceID)
+	previous, _ := m.get(key)
+	assignment, record := update(previous)
+	assignment.OrganizationId = organizationID
+	assignment.DeviceGroupId = deviceGroupID
+	assignment.DeviceId = deviceID
+
+	entry, exists := m.entries[key]
+	if !exists || previous == nil {
+		entry = &memoryEntry{history: make([]Record, 0, m.historySize)}
+		m.entries[key] = entry
+	}
+	entry.assignment = assignment
+	entry.history = append(entry.history, record)
+	if len(entry.history) > m.historySize {
+		entry.history = entry.history[len(entry.history)-m.historySize:]
+	}
+	return assignment
+}
+
+func (m *MemoryStore) History(organizationID string, deviceGroupID string, deviceID string) []Record {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entry, exists := m.entries[deviceKey(organizationID, deviceGroupID, deviceID)]
+	if !exists {
+		return []Record{}
+	}
+	return append([]Record{}, entry.history...)
+}
+
+// expire removes the expired entries at most once per TTL.
+func (m *MemoryStore) expire(now time.Time) {
+	if now.Sub(m.lastExpire) < m.ttl {
+		return
+	}
+	m.lastExpire = now
+	for key, entry := range m.entries {
+		if now.Sub(entry.assignment.LastSelected) > m.ttl {
+			delete(m.entries, key)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package assignment
+
+import (
+	"encoding/json"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// selectCluster updates the assignment of a device with the policy as the SelectCluster requests do.
+func selectCluster(store Store, policy Policy, candidate int) Assignment {
+	return store.Update("org", "group", "device", func(previous *Assignment) (Assignment, Record) {
+		now := time.Now()
+		next, reason := policy.Apply(previous, candidate, 3, now)
+		return next, Record{Timestamp: now, Candidate: candidate, ClusterIndex: next.ClusterIndex, Reason: reason}
+	})
+}
+
+var _ = ginkgo.Describe("MemoryStore", func() {
+
+	policy := Policy{Cooldown: time.Hour, MaxMovesPerHour: 1}
+
+	ginkgo.It("should store the assignment and the history of a device", func() {
+		store := NewMemoryStore(time.Hour, 2)
+		_, exists := store.Get("org", "group", "device")
+		gomega.Expect(exists).To(gomega.BeFalse())
+
+		for _, candidate := range []int{0, 1, 2} {
+			selectCluster(store, policy, candidate)
+		}
+		current, exists := store.Get("org", "group", "device")
+		gomega.Expect(exists).To(gomega.BeTrue())
+		gomega.Expect(current.ClusterIndex).To(gomega.Equal(0))
+		gomega.Expect(current.DeviceId).To(gomega.Equal("device"))
+
+		history := store.History("org", "group", "device")
+		gomega.Expect(history).To(gomega.HaveLen(2))
+		gomega.Expect(history[0].Candidate).To(gomega.Equal(1))
+		gomega.Expect(history[1].Reason).To(gomega.Equal(ReasonCooldown))
+	})
+
+	ginkgo.It("should expire the assignments that are not selected again", func() {
+		store := NewMemoryStore(50*time.Millisecond, 10)
+		selectCluster(store, policy, 0)
+		gomega.Eventually(func() bool {
+			_, exists := store.Get("org", "group", "device")
+			return exists
+		}).Should(gomega.BeFalse())
+		gomega.Expect(selectCluster(store, policy, 1).ClusterIndex).To(gomega.Equal(1))
+		gomega.Expect(store.History("org", "group", "device")).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should apply the concurrent updates of a device one after the other", func() {
+		store := NewMemoryStore(time.Hour, 100)
+		selectCluster(store, Policy{}, 0)
+		var requests sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			requests.Add(1)
+			go func(candidate int) {
+				defer requests.Done()
+				selectCluster(store, policy, candidate)
+			}(i%2 + 1)
+		}
+		requests.Wait()
+		moved := 0
+		for _, record := range store.History("org", "group", "device") {
+			if record.Reason == ReasonMoved {
+				moved++
+			}
+		}
+		// The device was assigned more than the cooldown ago, so only the first update can move it
+		gomega.Expect(moved).To(gomega.BeNumerically("<=", 1))
+	})
+
+	ginkgo.It("should serve the assignments of a device for debugging", func() {
+		store := NewMemoryStore(time.Hour, 10)
+		selectCluster(store, policy, 2)
+		handler := NewDebugHandler(store)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, DebugPath+"org/group/device", nil))
+		gomega.Expect(recorder.Code).To(gomega.Equal(http.StatusOK))
+		result := DeviceAssignments{}
+		gomega.Expect(json.Unmarshal(recorder.Body.Bytes(), &result)).To(gomega.Succeed())
+		gomega.Expect(result.Current.ClusterIndex).To(gomega.Equal(2))
+		gomega.Expect(result.History).To(gomega.HaveLen(1))
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, DebugPath+"org/group", nil))
+		gomega.Expect(recorder.Code).To(gomega.Equal(http.StatusBadRequest))
+	})
+
+})
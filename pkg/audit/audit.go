@@ -0,0 +1,74 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audit
+
+import (
+	"context"
+	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/claims"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/peer"
+	"io"
+	"os"
+)
+
+// Log records the requests rejected because of the identity of the device. The entries are written as JSON
+// lines to their own file, or to the service log with the audit field if there is no file.
+type Log struct {
+	logger zerolog.Logger
+	file   io.Closer
+}
+
+// NewLog creates an audit log that appends to the given file, or writes to the service log if the path is empty.
+func NewLog(path string) (*Log, derrors.Error) {
+	if path == "" {
+		return &Log{logger: log.With().Bool("audit", true).Logger()}, nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot open audit log")
+	}
+	return &Log{logger: zerolog.New(file).With().Timestamp().Logger(), file: file}, nil
+}
+
+// Rejected records a request of a device that is rejected. The claims are nil if the request does not contain
+// them.
+func (l *Log) Rejected(ctx context.Context, method string, deviceClaims *claims.DeviceClaims,
+	organizationID string, deviceGroupID string, deviceID string, reason derrors.Error) {
+	entry := l.logger.Warn().Str("method", method).
+		Str("organizationId", organizationID).Str("deviceGroupId", deviceGroupID).Str("deviceId", deviceID)
+	if deviceClaims != nil {
+		entry = entry.Str("claimsOrganizationId", deviceClaims.OrganizationId).Str("claimsDeviceGroupId", deviceClaims.DeviceGroupId).
+			Str("claimsDeviceId", deviceClaims.DeviceId)
+	}
+	if source, ok := peer.FromContext(ctx); ok && source.Addr != nil {
+		entry = entry.Str("peer", source.Addr.String())
+	}
+	entry.Str("reason", reason.Error()).Msg("device request rejected")
+}
+
+// Close the file of the audit log, if any.
+func (l *Log) Close() {
+	if l.file == nil {
+		return
+	}
+	err := l.file.Close()
+	if err != nil {
+		log.Warn().Err(err).Msg("cannot close audit log")
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package claims
+
+import (
+	"context"
+	"fmt"
+	"github.com/nalej/derrors"
+	"google.golang.org/grpc/metadata"
+)
+
+// Keys of the incoming metadata where the device authx interceptor stores the claims of the device token.
+const (
+	OrganizationIdKey = "organization_id"
+	DeviceGroupIdKey  = "device_group_id"
+	DeviceIdKey       = "device_id"
+)
+
+// DeviceClaims with the identity of an authenticated device.
+type DeviceClaims struct {
+	OrganizationId string
+	DeviceGroupId  string
+	DeviceId       string
+}
+
+// FromContext returns the claims of the device that sent the request. The claims are rejected if a key
+// has more than one value, as the client could have added its own value next to the one of the interceptor.
+func FromContext(ctx context.Context) (*DeviceClaims, derrors.Error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, derrors.NewUnauthenticatedError("no metadata found in the request")
+	}
+	organizationID, err := singleValue(md, OrganizationIdKey)
+	if err != nil {
+		return nil, err
+	}
+	deviceGroupID, err := singleValue(md, DeviceGroupIdKey)
+	if err != nil {
+		return nil, err
+	}
+	deviceID, err := singleValue(md, DeviceIdKey)
+	if err != nil {
+		return nil, err
+	}
+	if organizationID == "" || deviceGroupID == "" || deviceID == "" {
+		return nil, derrors.NewUnauthenticatedError("device claims not found in the request")
+	}
+	return &DeviceClaims{
+		OrganizationId: organizationID,
+		DeviceGroupId:  deviceGroupID,
+		DeviceId:       deviceID,
+	}, nil
+}
+
+// Matches returns a PermissionDenied error if the given ids do not belong to the device of the claims.
+func (c *DeviceClaims) Matches(organizationID string, deviceGroupID string, deviceID string) derrors.Error {
+	if c.OrganizationId != organizationID {
+		return derrors.NewPermissionDeniedError(fmt.Sprintf("organization_id %s does not match the device token", organizationID))
+	}
+	if c.DeviceGroupId != deviceGroupID {
+		return derrors.NewPermissionDeniedError(fmt.Sprintf("device_group_id %s does not match the device token", deviceGroupID))
+	}
+	if c.DeviceId != deviceID {
+		return derrors.NewPermissionDeniedError(fmt.Sprintf("device_id %s does not match the device token", deviceID))
+	}
+	return nil
+}
+
+func singleValue(md metadata.MD, key string) (string, derrors.Error) {
+	values := md.Get(key)
+	if len(values) > 1 {
+		return "", derrors.NewUnauthenticatedError(fmt.Sprintf("%s has more than one value in the request", key))
+	}
+	if len(values) == 0 {
+		return "", nil
+	}
+	return values[0], nil
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package claims
+
+import (
+	"context"
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc/metadata"
+)
+
+var _ = ginkgo.Describe("Device claims", func() {
+
+	table.DescribeTable("FromContext",
+		func(md metadata.MD, expected *DeviceClaims) {
+			ctx := context.Background()
+			if md != nil {
+				ctx = metadata.NewIncomingContext(ctx, md)
+			}
+			deviceClaims, err := FromContext(ctx)
+			if expected == nil {
+				gomega.Expect(err).NotTo(gomega.BeNil())
+				gomega.Expect(err.Type()).To(gomega.Equal(derrors.Unauthenticated))
+				return
+			}
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(deviceClaims).To(gomega.Equal(expected))
+		},
+		table.Entry("valid claims",
+			metadata.Pairs(OrganizationIdKey, "org", DeviceGroupIdKey, "group", DeviceIdKey, "device"),
+			&DeviceClaims{OrganizationId: "org", DeviceGroupId: "group", DeviceId: "device"}),
+		table.Entry("no metadata", nil, nil),
+		table.Entry("missing device id",
+			metadata.Pairs(OrganizationIdKey, "org", DeviceGroupIdKey, "group"), nil),
+		table.Entry("empty device id",
+			metadata.Pairs(OrganizationIdKey, "org", DeviceGroupIdKey, "group", DeviceIdKey, ""), nil),
+		table.Entry("forged duplicated organization id",
+			metadata.Pairs(OrganizationIdKey, "other-org", OrganizationIdKey, "org", DeviceGroupIdKey, "group", DeviceIdKey, "device"), nil),
+		table.Entry("forged duplicated device id",
+			metadata.Pairs(OrganizationIdKey, "org", DeviceGroupIdKey, "group", DeviceIdKey, "other-device", DeviceIdKey, "device"), nil),
+	)
+
+	table.DescribeTable("Matches",
+		func(organizationID string, deviceGroupID string, deviceID string, matches bool) {
+			deviceClaims := &DeviceClaims{OrganizationId: "org", DeviceGroupId: "group", DeviceId: "device"}
+			err := deviceClaims.Matches(organizationID, deviceGroupID, deviceID)
+			if matches {
+				gomega.Expect(err).To(gomega.BeNil())
+				return
+			}
+			gomega.Expect(err).NotTo(gomega.BeNil())
+			gomega.Expect(err.Type()).To(gomega.Equal(derrors.PermissionDenied))
+		},
+		table.Entry("same device", "org", "group", "device", true),
+		table.Entry("other organization", "other", "group", "device", false),
+		table.Entry("other device group", "org", "other", "device", false),
+		table.Entry("other device", "org", "group", "other", false),
+	)
+
+})
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package health
+
+import (
+	"encoding/json"
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// LivenessPath with the HTTP path that reports whether the process is alive.
+	LivenessPath = "/healthz"
+	// ReadinessPath with the HTTP path that reports whether the service can serve requests.
+	ReadinessPath = "/readyz"
+	// DefaultInterval with the time between two updates of the gRPC health service.
+	DefaultInterval = 5 * time.Second
+)
+
+// Check returns an error if a dependency of the service is not ready.
+type Check func() derrors.Error
+
+// Status with the result of the readiness checks.
+type Status struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Checker with the readiness checks of the service. The checks are declared when the checker is created and
+// fail until they are set, so the service is not ready while it is starting.
+type Checker struct {
+	mu     sync.RWMutex
+	names  []string
+	checks map[string]Check
+	stop   chan struct{}
+}
+
+func NewChecker(names ...string) *Checker {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	return &Checker{
+		names:  sorted,
+		checks: make(map[string]Check, 0),
+		stop:   make(chan struct{}),
+	}
+}
+
+// Set the function of a readiness check.
+func (c *Checker) Set(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// Status runs the readiness checks.
+func (c *Checker) Status() Status {
+	c.mu.RLock()
+	checks := make(map[string]Check, len(c.checks))
+	for name, check := range c.checks {
+		checks[name] = check
+	}
+	c.mu.RUnlock()
+
+	status := Status{Ready: true, Checks: make(map[string]string, len(c.names))}
+	for _, name := range c.names {
+		check, exists := checks[name]
+		if !exists {
+			status.Ready = false
+			status.Checks[name] = "not initialized"
+			continue
+		}
+		if err := check(); err != nil {
+			status.Ready = false
+			status.Checks[name] = err.Error()
+			continue
+		}
+		status.Checks[name] = "ok"
+	}
+	return status
+}
+
+// LivenessHandler answers as long as the process is able to serve HTTP requests.
+func (c *Checker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+}
+
+// ReadinessHandler answers with the result of the readiness checks, using 503 if any of them fails.
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := c.Status()
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(status)
+	})
+}
+
+// update sets the serving status of the gRPC health service from the readiness checks.
+func (c *Checker) update(server *health.Server, services []string, previous bool) bool {
+	status := c.Status()
+	if status.Ready != previous {
+		log.Info().Bool("ready", status.Ready).Interface("checks", status.Checks).Msg("readiness changed")
+	}
+	servingStatus := grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	if status.Ready {
+		servingStatus = grpc_health_v1.HealthCheckResponse_SERVING
+	}
+	for _, service := range services {
+		server.SetServingStatus(service, servingStatus)
+	}
+	return status.Ready
+}
+
+// Run updates the gRPC health service of the given services periodically until Stop is called. The empty
+// service name reports the overall status of the server.
+func (c *Checker) Run(server *health.Server, services []string, interval time.Duration) {
+	ready := c.update(server, services, false)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ready = c.update(server, services, ready)
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Stop updating the gRPC health service.
+func (c *Checker) Stop() {
+	close(c.stop)
+}
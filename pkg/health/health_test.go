@@ -0,0 +1,103 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func succeed() derrors.Error {
+	return nil
+}
+
+func fail() derrors.Error {
+	return derrors.NewUnavailableError("not available")
+}
+
+var _ = ginkgo.Describe("Checker", func() {
+
+	table.DescribeTable("readiness",
+		func(checks map[string]Check, ready bool, expected map[string]string) {
+			checker := NewChecker("login", "cluster_api")
+			for name, check := range checks {
+				checker.Set(name, check)
+			}
+			status := checker.Status()
+			gomega.Expect(status.Ready).To(gomega.Equal(ready))
+			gomega.Expect(status.Checks).To(gomega.Equal(expected))
+
+			recorder := httptest.NewRecorder()
+			checker.ReadinessHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, ReadinessPath, nil))
+			if ready {
+				gomega.Expect(recorder.Code).To(gomega.Equal(http.StatusOK))
+			} else {
+				gomega.Expect(recorder.Code).To(gomega.Equal(http.StatusServiceUnavailable))
+			}
+			received := Status{}
+			gomega.Expect(json.Unmarshal(recorder.Body.Bytes(), &received)).To(gomega.Succeed())
+			gomega.Expect(received).To(gomega.Equal(status))
+		},
+		table.Entry("all the checks succeed",
+			map[string]Check{"login": succeed, "cluster_api": succeed}, true,
+			map[string]string{"login": "ok", "cluster_api": "ok"}),
+		table.Entry("a check is not set",
+			map[string]Check{"login": succeed}, false,
+			map[string]string{"login": "ok", "cluster_api": "not initialized"}),
+		table.Entry("a check fails",
+			map[string]Check{"login": succeed, "cluster_api": fail}, false,
+			map[string]string{"login": "ok", "cluster_api": fail().Error()}),
+	)
+
+	ginkgo.It("should always report that the process is alive", func() {
+		checker := NewChecker("login")
+		checker.Set("login", fail)
+		recorder := httptest.NewRecorder()
+		checker.LivenessHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, LivenessPath, nil))
+		gomega.Expect(recorder.Code).To(gomega.Equal(http.StatusOK))
+	})
+
+	ginkgo.It("should update the gRPC health service", func() {
+		checker := NewChecker("login")
+		server := health.NewServer()
+		servingStatus := func() grpc_health_v1.HealthCheckResponse_ServingStatus {
+			response, err := server.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: "service"})
+			if err != nil {
+				return grpc_health_v1.HealthCheckResponse_SERVICE_UNKNOWN
+			}
+			return response.Status
+		}
+
+		go checker.Run(server, []string{"", "service"}, 10*time.Millisecond)
+		defer checker.Stop()
+		gomega.Eventually(servingStatus).Should(gomega.Equal(grpc_health_v1.HealthCheckResponse_NOT_SERVING))
+		checker.Set("login", succeed)
+		gomega.Eventually(servingStatus).Should(gomega.Equal(grpc_health_v1.HealthCheckResponse_SERVING))
+		checker.Set("login", fail)
+		gomega.Eventually(servingStatus).Should(gomega.Equal(grpc_health_v1.HealthCheckResponse_NOT_SERVING))
+	})
+
+})
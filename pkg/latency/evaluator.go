@@ -0,0 +1,225 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package latency
+
+import (
+	"fmt"
+	"github.com/nalej/derrors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultIdleTimeout with the time after which the window of a device that does not report latencies is discarded.
+const DefaultIdleTimeout = time.Hour
+
+// Statistic computed on a window of samples that is compared against the threshold.
+type Statistic string
+
+const (
+	// StatisticLast uses the last sample of the window.
+	StatisticLast Statistic = "last"
+	// StatisticEWMA uses the exponentially weighted moving average of all the samples.
+	StatisticEWMA Statistic = "ewma"
+	// StatisticP50 uses the median of the window.
+	StatisticP50 Statistic = "p50"
+	// StatisticP95 uses the 95th percentile of the window.
+	StatisticP95 Statistic = "p95"
+	// StatisticP99 uses the 99th percentile of the window.
+	StatisticP99 Statistic = "p99"
+)
+
+// Rule that decides when a device must check its latency again. The samples of a device are split in windows
+// of WindowSize samples that do not overlap, and the statistics of each window are computed once it is full.
+// The window breaches the threshold when its Statistic is above it, or when its jitter is above MaxJitter, and
+// a check is required after ConsecutiveWindows consecutive breaching windows. As the windows do not share
+// samples, a single slow sample never makes more than one window breach.
+type Rule struct {
+	// Statistic compared against the threshold.
+	Statistic Statistic
+	// WindowSize with the number of samples of a window.
+	WindowSize int
+	// ConsecutiveWindows with the number of consecutive breaching windows that require a new check.
+	ConsecutiveWindows int
+	// EWMAAlpha with the weight of a new sample on the moving average.
+	EWMAAlpha float64
+	// MaxJitter with the jitter in milliseconds above which a window breaches. Zero disables the jitter check.
+	MaxJitter int
+}
+
+func (r *Rule) Validate() derrors.Error {
+	switch r.Statistic {
+	case StatisticLast, StatisticEWMA, StatisticP50, StatisticP95, StatisticP99:
+	default:
+		return derrors.NewInvalidArgumentError(fmt.Sprintf("unknown latency statistic %s", r.Statistic))
+	}
+	if r.WindowSize <= 0 {
+		return derrors.NewInvalidArgumentError("latency window size must be valid")
+	}
+	if r.ConsecutiveWindows <= 0 {
+		return derrors.NewInvalidArgumentError("latency consecutive windows must be valid")
+	}
+	if r.EWMAAlpha <= 0 || r.EWMAAlpha > 1 {
+		return derrors.NewInvalidArgumentError("latency EWMA alpha must be in (0, 1]")
+	}
+	if r.MaxJitter < 0 {
+		return derrors.NewInvalidArgumentError("latency max jitter must be valid")
+	}
+	return nil
+}
+
+// Breaches returns whether the statistics of a window breach the threshold.
+func (r *Rule) Breaches(stats *Stats, threshold int) bool {
+	if stats.Value(r.Statistic) > float64(threshold) {
+		return true
+	}
+	return r.MaxJitter > 0 && stats.Jitter > float64(r.MaxJitter)
+}
+
+// Stats with the statistics of a window of samples.
+type Stats struct {
+	EWMA   float64 `json:"ewma"`
+	P50    float64 `json:"p50"`
+	P95    float64 `json:"p95"`
+	P99    float64 `json:"p99"`
+	Jitter float64 `json:"jitter"`
+	Last   int     `json:"last"`
+}
+
+// Value returns the given statistic.
+func (s *Stats) Value(statistic Statistic) float64 {
+	switch statistic {
+	case StatisticEWMA:
+		return s.EWMA
+	case StatisticP50:
+		return s.P50
+	case StatisticP95:
+		return s.P95
+	case StatisticP99:
+		return s.P99
+	}
+	return float64(s.Last)
+}
+
+// deviceWindow with the samples of the current window of a device.
+type deviceWindow struct {
+	samples  []int
+	ewma     float64
+	breaches int
+	lastSeen time.Time
+}
+
+// Evaluator keeps the current window of latencies of each device and decides when the degradation of the
+// latency is sustained enough to require a new check.
+type Evaluator struct {
+	rule        Rule
+	idleTimeout time.Duration
+	mu          sync.Mutex
+	devices     map[string]*deviceWindow
+	lastExpire  time.Time
+}
+
+func NewEvaluator(rule Rule) *Evaluator {
+	return &Evaluator{
+		rule:        rule,
+		idleTimeout: DefaultIdleTimeout,
+		devices:     make(map[string]*deviceWindow, 0),
+		lastExpire:  time.Now(),
+	}
+}
+
+// percentile returns the nearest-rank percentile of a sorted list of samples.
+func percentile(sorted []int, p float64) float64 {
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return float64(sorted[rank])
+}
+
+// computeStats returns the statistics of a window of samples ordered from the oldest to the newest.
+func computeStats(samples []int, ewma float64) Stats {
+	sorted := make([]int, len(samples))
+	copy(sorted, samples)
+	sort.Ints(sorted)
+	jitter := 0.0
+	for i := 1; i < len(samples); i++ {
+		jitter += math.Abs(float64(samples[i] - samples[i-1]))
+	}
+	if len(samples) > 1 {
+		jitter = jitter / float64(len(samples)-1)
+	}
+	return Stats{
+		EWMA:   ewma,
+		P50:    percentile(sorted, 50),
+		P95:    percentile(sorted, 95),
+		P99:    percentile(sorted, 99),
+		Jitter: jitter,
+		Last:   samples[len(samples)-1],
+	}
+}
+
+// Add registers a latency sample of a device. Once the window of the device is full, its statistics are
+// evaluated and a new window is started. It returns whether the device must check its latency again and the
+// statistics of the window, or nil if the window is not full yet.
+func (e *Evaluator) Add(organizationID string, deviceGroupID string, deviceID string, latency int, threshold int) (bool, *Stats) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	e.expire(now)
+
+	key := fmt.Sprintf("%s/%s/%s", organizationID, deviceGroupID, deviceID)
+	window, exists := e.devices[key]
+	if !exists {
+		window = &deviceWindow{samples: make([]int, 0, e.rule.WindowSize), ewma: float64(latency)}
+		e.devices[key] = window
+	} else {
+		window.ewma = e.rule.EWMAAlpha*float64(latency) + (1-e.rule.EWMAAlpha)*window.ewma
+	}
+	window.lastSeen = now
+	window.samples = append(window.samples, latency)
+	if len(window.samples) < e.rule.WindowSize {
+		return false, nil
+	}
+
+	stats := computeStats(window.samples, window.ewma)
+	window.samples = window.samples[:0]
+	if e.rule.Breaches(&stats, threshold) {
+		window.breaches++
+	} else {
+		window.breaches = 0
+	}
+	if window.breaches >= e.rule.ConsecutiveWindows {
+		window.breaches = 0
+		return true, &stats
+	}
+	return false, &stats
+}
+
+// expire discards the windows of the devices that have not reported latencies recently.
+func (e *Evaluator) expire(now time.Time) {
+	if now.Sub(e.lastExpire) < e.idleTimeout {
+		return
+	}
+	e.lastExpire = now
+	for key, window := range e.devices {
+		if now.Sub(window.lastSeen) > e.idleTimeout {
+			delete(e.devices, key)
+		}
+	}
+}
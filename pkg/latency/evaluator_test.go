@@ -0,0 +1,118 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package latency
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+)
+
+const testThreshold = 100
+
+func testRule(statistic Statistic, windowSize int, consecutiveWindows int) Rule {
+	return Rule{Statistic: statistic, WindowSize: windowSize, ConsecutiveWindows: consecutiveWindows, EWMAAlpha: 0.5}
+}
+
+var _ = ginkgo.Describe("Evaluator", func() {
+
+	table.DescribeTable("rule validation",
+		func(rule Rule, valid bool) {
+			err := rule.Validate()
+			if valid {
+				gomega.Expect(err).To(gomega.BeNil())
+			} else {
+				gomega.Expect(err).NotTo(gomega.BeNil())
+			}
+		},
+		table.Entry("valid rule", testRule(StatisticP95, 5, 2), true),
+		table.Entry("unknown statistic", testRule("p90", 5, 2), false),
+		table.Entry("empty window", testRule(StatisticP95, 0, 2), false),
+		table.Entry("no consecutive windows", testRule(StatisticP95, 5, 0), false),
+		table.Entry("alpha above one", Rule{Statistic: StatisticEWMA, WindowSize: 1, ConsecutiveWindows: 1, EWMAAlpha: 1.5}, false),
+		table.Entry("negative jitter", Rule{Statistic: StatisticLast, WindowSize: 1, ConsecutiveWindows: 1, EWMAAlpha: 0.5, MaxJitter: -1}, false),
+	)
+
+	table.DescribeTable("check required after each sample",
+		func(rule Rule, samples []int, expected []bool) {
+			evaluator := NewEvaluator(rule)
+			required := make([]bool, 0, len(samples))
+			for _, sample := range samples {
+				checkRequired, _ := evaluator.Add("org", "group", "device", sample, testThreshold)
+				required = append(required, checkRequired)
+			}
+			gomega.Expect(required).To(gomega.Equal(expected))
+		},
+		table.Entry("every sample on its own", testRule(StatisticLast, 1, 1),
+			[]int{50, 150, 50}, []bool{false, true, false}),
+		table.Entry("consecutive breaching samples", testRule(StatisticLast, 1, 2),
+			[]int{150, 150, 150, 50, 150}, []bool{false, true, false, false, false}),
+		table.Entry("windows do not overlap", testRule(StatisticP50, 3, 1),
+			[]int{50, 50, 200, 200, 200, 50, 50, 50, 50}, []bool{false, false, false, false, false, true, false, false, false}),
+		table.Entry("a slow sample breaches a single window", testRule(StatisticP95, 3, 2),
+			[]int{50, 50, 500, 50, 50, 50, 50, 50, 50}, []bool{false, false, false, false, false, false, false, false, false}),
+		table.Entry("slow samples in consecutive windows", testRule(StatisticP95, 3, 2),
+			[]int{50, 50, 500, 500, 50, 50}, []bool{false, false, false, false, false, true}),
+		table.Entry("a single slow sample in the window", testRule(StatisticP50, 3, 1),
+			[]int{50, 200, 50, 50}, []bool{false, false, false, false}),
+		table.Entry("moving average", testRule(StatisticEWMA, 1, 1),
+			[]int{50, 200, 200}, []bool{false, true, true}),
+		table.Entry("jitter above the limit", Rule{Statistic: StatisticP50, WindowSize: 3, ConsecutiveWindows: 1, EWMAAlpha: 0.5, MaxJitter: 30},
+			[]int{10, 90, 10, 12, 12, 12}, []bool{false, false, true, false, false, false}),
+		table.Entry("jitter check disabled", testRule(StatisticP50, 3, 1),
+			[]int{10, 90, 10, 12, 12, 12}, []bool{false, false, false, false, false, false}),
+	)
+
+	ginkgo.It("should compute the statistics of each window in the order of its samples", func() {
+		evaluator := NewEvaluator(testRule(StatisticP95, 4, 10))
+		var stats *Stats
+		for _, sample := range []int{99, 99, 99, 99, 40, 10, 20, 30} {
+			_, stats = evaluator.Add("org", "group", "device", sample, testThreshold)
+		}
+		gomega.Expect(stats).NotTo(gomega.BeNil())
+		gomega.Expect(stats.Last).To(gomega.Equal(30))
+		gomega.Expect(stats.P50).To(gomega.Equal(20.0))
+		gomega.Expect(stats.P95).To(gomega.Equal(40.0))
+		gomega.Expect(stats.P99).To(gomega.Equal(40.0))
+		gomega.Expect(stats.Jitter).To(gomega.Equal(50.0 / 3))
+	})
+
+	ginkgo.It("should keep a window per device", func() {
+		evaluator := NewEvaluator(testRule(StatisticLast, 2, 1))
+		required, stats := evaluator.Add("org", "group", "d1", 150, testThreshold)
+		gomega.Expect(required).To(gomega.BeFalse())
+		gomega.Expect(stats).To(gomega.BeNil())
+		required, _ = evaluator.Add("org", "group", "d2", 150, testThreshold)
+		gomega.Expect(required).To(gomega.BeFalse())
+		required, _ = evaluator.Add("org", "group", "d1", 150, testThreshold)
+		gomega.Expect(required).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should start a new window once a window is evaluated", func() {
+		evaluator := NewEvaluator(testRule(StatisticLast, 2, 1))
+		_, stats := evaluator.Add("org", "group", "device", 10, testThreshold)
+		gomega.Expect(stats).To(gomega.BeNil())
+		_, stats = evaluator.Add("org", "group", "device", 20, testThreshold)
+		gomega.Expect(stats).NotTo(gomega.BeNil())
+		_, stats = evaluator.Add("org", "group", "device", 30, testThreshold)
+		gomega.Expect(stats).To(gomega.BeNil())
+		_, stats = evaluator.Add("org", "group", "device", 40, testThreshold)
+		gomega.Expect(stats).NotTo(gomega.BeNil())
+		gomega.Expect(stats.Jitter).To(gomega.Equal(10.0))
+	})
+
+})
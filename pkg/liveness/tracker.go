@@ -0,0 +1,216 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package liveness
+
+import (
+	"fmt"
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// State of a device.
+type State string
+
+const (
+	// Unknown is the previous state of a device that is seen for the first time.
+	Unknown State = ""
+	// Online devices have been seen within the stale timeout.
+	Online State = "ONLINE"
+	// Stale devices have not been seen within the stale timeout.
+	Stale State = "STALE"
+	// Offline devices have not been seen within the offline timeout.
+	Offline State = "OFFLINE"
+)
+
+// Config with the timeouts of the tracker.
+type Config struct {
+	// StaleTimeout with the time after which a device that has not been seen becomes STALE.
+	StaleTimeout time.Duration
+	// OfflineTimeout with the time after which a device that has not been seen becomes OFFLINE.
+	OfflineTimeout time.Duration
+	// CheckInterval with the time between two checks of the state of the devices.
+	CheckInterval time.Duration
+	// ForgetTimeout with the time after which an OFFLINE device is no longer tracked.
+	ForgetTimeout time.Duration
+}
+
+func (c *Config) Validate() derrors.Error {
+	if c.StaleTimeout <= 0 || c.OfflineTimeout <= c.StaleTimeout {
+		return derrors.NewInvalidArgumentError("liveness offline timeout must be greater than the stale timeout")
+	}
+	if c.CheckInterval <= 0 {
+		return derrors.NewInvalidArgumentError("liveness check interval must be valid")
+	}
+	if c.ForgetTimeout < c.OfflineTimeout {
+		return derrors.NewInvalidArgumentError("liveness forget timeout must not be lower than the offline timeout")
+	}
+	return nil
+}
+
+// Event with a state transition of a device.
+type Event struct {
+	OrganizationId string    `json:"organization_id"`
+	DeviceGroupId  string    `json:"device_group_id"`
+	DeviceId       string    `json:"device_id"`
+	Previous       State     `json:"previous"`
+	Current        State     `json:"current"`
+	LastSeen       time.Time `json:"last_seen"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// Listener receives the state transitions of the devices.
+type Listener func(event Event)
+
+type device struct {
+	organizationID string
+	deviceGroupID  string
+	deviceID       string
+	state          State
+	lastSeen       time.Time
+}
+
+// Tracker records the last time each device was seen and moves the devices through the ONLINE, STALE and
+// OFFLINE states, notifying the transitions to the subscribed listeners.
+type Tracker struct {
+	config    Config
+	mu        sync.Mutex
+	devices   map[string]*device
+	listeners []Listener
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func NewTracker(config Config) *Tracker {
+	return &Tracker{
+		config:    config,
+		devices:   make(map[string]*device, 0),
+		listeners: make([]Listener, 0),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Subscribe adds a listener of the state transitions. Listeners are called sequentially and must not block.
+func (t *Tracker) Subscribe(listener Listener) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listeners = append(t.listeners, listener)
+}
+
+func deviceKey(organizationID string, deviceGroupID string, deviceID string) string {
+	return fmt.Sprintf("%s/%s/%s", organizationID, deviceGroupID, deviceID)
+}
+
+// Seen records that a device has been seen now.
+func (t *Tracker) Seen(organizationID string, deviceGroupID string, deviceID string) {
+	now := time.Now()
+	t.mu.Lock()
+	key := deviceKey(organizationID, deviceGroupID, deviceID)
+	entry, exists := t.devices[key]
+	if !exists {
+		entry = &device{organizationID: organizationID, deviceGroupID: deviceGroupID, deviceID: deviceID, state: Unknown}
+		t.devices[key] = entry
+	}
+	entry.lastSeen = now
+	var events []Event
+	if entry.state != Online {
+		events = append(events, t.transition(entry, Online, now))
+	}
+	listeners := t.listeners
+	t.mu.Unlock()
+	t.emit(listeners, events)
+}
+
+// GetState returns the state of a device and the last time it was seen.
+func (t *Tracker) GetState(organizationID string, deviceGroupID string, deviceID string) (State, time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, exists := t.devices[deviceKey(organizationID, deviceGroupID, deviceID)]
+	if !exists {
+		return Unknown, time.Time{}, false
+	}
+	return entry.state, entry.lastSeen, true
+}
+
+// transition changes the state of a device and returns the corresponding event.
+func (t *Tracker) transition(entry *device, state State, now time.Time) Event {
+	event := Event{
+		OrganizationId: entry.organizationID,
+		DeviceGroupId:  entry.deviceGroupID,
+		DeviceId:       entry.deviceID,
+		Previous:       entry.state,
+		Current:        state,
+		LastSeen:       entry.lastSeen,
+		Timestamp:      now,
+	}
+	entry.state = state
+	return event
+}
+
+func (t *Tracker) emit(listeners []Listener, events []Event) {
+	for _, event := range events {
+		log.Info().Str("organizationId", event.OrganizationId).Str("deviceGroupId", event.DeviceGroupId).Str("deviceId", event.DeviceId).
+			Str("previous", string(event.Previous)).Str("current", string(event.Current)).Msg("device state changed")
+		for _, listener := range listeners {
+			listener(event)
+		}
+	}
+}
+
+// check updates the state of the devices that have not been seen recently.
+func (t *Tracker) check() {
+	now := time.Now()
+	t.mu.Lock()
+	events := make([]Event, 0)
+	for key, entry := range t.devices {
+		elapsed := now.Sub(entry.lastSeen)
+		switch {
+		case elapsed > t.config.ForgetTimeout:
+			delete(t.devices, key)
+		case elapsed > t.config.OfflineTimeout && entry.state != Offline:
+			events = append(events, t.transition(entry, Offline, now))
+		case elapsed > t.config.StaleTimeout && elapsed <= t.config.OfflineTimeout && entry.state == Online:
+			events = append(events, t.transition(entry, Stale, now))
+		}
+	}
+	listeners := t.listeners
+	t.mu.Unlock()
+	t.emit(listeners, events)
+}
+
+// Run checks the state of the devices periodically until Stop is called.
+func (t *Tracker) Run() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.config.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.check()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Stop checking the state of the devices.
+func (t *Tracker) Stop() {
+	close(t.stop)
+	<-t.done
+}
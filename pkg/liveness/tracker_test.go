@@ -0,0 +1,132 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package liveness
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"time"
+)
+
+var _ = ginkgo.Describe("Tracker", func() {
+
+	config := Config{
+		StaleTimeout:   time.Minute,
+		OfflineTimeout: 5 * time.Minute,
+		CheckInterval:  time.Second,
+		ForgetTimeout:  time.Hour,
+	}
+
+	var tracker *Tracker
+	var events []Event
+
+	// setLastSeen moves the last time the device was seen to the past.
+	setLastSeen := func(elapsed time.Duration) {
+		tracker.mu.Lock()
+		defer tracker.mu.Unlock()
+		tracker.devices[deviceKey("org", "group", "device")].lastSeen = time.Now().Add(-elapsed)
+	}
+
+	transitions := func() []State {
+		result := make([]State, 0, len(events))
+		for _, event := range events {
+			result = append(result, event.Current)
+		}
+		return result
+	}
+
+	ginkgo.BeforeEach(func() {
+		tracker = NewTracker(config)
+		events = make([]Event, 0)
+		tracker.Subscribe(func(event Event) {
+			events = append(events, event)
+		})
+	})
+
+	table.DescribeTable("config validation",
+		func(update func(config *Config), valid bool) {
+			toValidate := config
+			update(&toValidate)
+			if valid {
+				gomega.Expect(toValidate.Validate()).To(gomega.Succeed())
+			} else {
+				gomega.Expect(toValidate.Validate()).NotTo(gomega.Succeed())
+			}
+		},
+		table.Entry("valid config", func(config *Config) {}, true),
+		table.Entry("no stale timeout", func(config *Config) { config.StaleTimeout = 0 }, false),
+		table.Entry("offline timeout not greater than the stale timeout", func(config *Config) { config.OfflineTimeout = time.Minute }, false),
+		table.Entry("no check interval", func(config *Config) { config.CheckInterval = 0 }, false),
+		table.Entry("forget timeout lower than the offline timeout", func(config *Config) { config.ForgetTimeout = time.Minute }, false),
+	)
+
+	ginkgo.It("should report a device seen for the first time as online", func() {
+		tracker.Seen("org", "group", "device")
+		tracker.Seen("org", "group", "device")
+		state, lastSeen, exists := tracker.GetState("org", "group", "device")
+		gomega.Expect(exists).To(gomega.BeTrue())
+		gomega.Expect(state).To(gomega.Equal(Online))
+		gomega.Expect(lastSeen).NotTo(gomega.BeZero())
+		gomega.Expect(events).To(gomega.HaveLen(1))
+		gomega.Expect(events[0].Previous).To(gomega.Equal(Unknown))
+		gomega.Expect(events[0].DeviceId).To(gomega.Equal("device"))
+	})
+
+	table.DescribeTable("state transitions of a device that is not seen",
+		func(elapsed []time.Duration, expected []State) {
+			tracker.Seen("org", "group", "device")
+			for _, value := range elapsed {
+				setLastSeen(value)
+				tracker.check()
+			}
+			gomega.Expect(transitions()).To(gomega.Equal(expected))
+		},
+		table.Entry("within the stale timeout", []time.Duration{30 * time.Second}, []State{Online}),
+		table.Entry("stale", []time.Duration{2 * time.Minute, 3 * time.Minute}, []State{Online, Stale}),
+		table.Entry("stale and offline", []time.Duration{2 * time.Minute, 10 * time.Minute}, []State{Online, Stale, Offline}),
+		table.Entry("offline without being checked while stale", []time.Duration{10 * time.Minute, 20 * time.Minute}, []State{Online, Offline}),
+	)
+
+	ginkgo.It("should report a device seen again as online", func() {
+		tracker.Seen("org", "group", "device")
+		setLastSeen(10 * time.Minute)
+		tracker.check()
+		tracker.Seen("org", "group", "device")
+		gomega.Expect(transitions()).To(gomega.Equal([]State{Online, Offline, Online}))
+		gomega.Expect(events[2].Previous).To(gomega.Equal(Offline))
+	})
+
+	ginkgo.It("should forget the devices that have been offline for long", func() {
+		tracker.Seen("org", "group", "device")
+		setLastSeen(2 * time.Hour)
+		tracker.check()
+		_, _, exists := tracker.GetState("org", "group", "device")
+		gomega.Expect(exists).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should stop checking the devices", func() {
+		done := make(chan struct{})
+		go func() {
+			tracker.Run()
+			close(done)
+		}()
+		tracker.Stop()
+		gomega.Eventually(done).Should(gomega.BeClosed())
+	})
+
+})
@@ -20,10 +20,11 @@ import "time"
 
 const (
 	DefaultTimeout = time.Minute
-	DefaultPath    = "/tmp/"
 	// TokenFileName with the name of the file we use to store the token.
 	TokenFileName = "token"
 	// RefreshTokenFileName with the name of the file that contains the refresh token
 	RefreshTokenFileName = "refresh_token"
-	AuthHeader           = "Authorization"
+	// EncryptedFileName with the name of the file that contains the encrypted credentials.
+	EncryptedFileName = "credentials.enc"
+	AuthHeader        = "Authorization"
 )
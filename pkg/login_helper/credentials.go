@@ -17,42 +17,41 @@ package login_helper
 
 import (
 	"context"
-	"github.com/nalej/derrors"
+	"github.com/dgrijalva/jwt-go"
 	"google.golang.org/grpc/metadata"
-	"io/ioutil"
-	"os"
-	"os/user"
-	"path/filepath"
-	"strings"
 	"time"
 )
 
 type Credentials struct {
-	BasePath     string
-	Token        string
-	RefreshToken string
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	// ExpiresAt with the expiration time of the token. It is zero if the token does not expire or cannot be parsed.
+	ExpiresAt time.Time `json:"-"`
 }
 
 // NewCredentials creates a new Credentials structure.
-func NewCredentials(basePath string, token string, refreshToken string) *Credentials {
-	return &Credentials{basePath, token, refreshToken}
+func NewCredentials(token string, refreshToken string) *Credentials {
+	return &Credentials{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresAt:    parseExpiration(token),
+	}
 }
 
-// Store the credentials in disk
-func (c *Credentials) Store() derrors.Error {
-	rPath := resolvePath(c.BasePath)
-	_ = os.MkdirAll(rPath, 0700)
-	tokenPath := filepath.Join(resolvePath(c.BasePath), TokenFileName)
-	refreshTokenPath := filepath.Join(resolvePath(c.BasePath), RefreshTokenFileName)
-	err := ioutil.WriteFile(tokenPath, []byte(c.Token), 0600)
-	if err != nil {
-		return derrors.AsError(err, "cannot write token file")
-	}
-	err = ioutil.WriteFile(refreshTokenPath, []byte(c.RefreshToken), 0600)
-	if err != nil {
-		return derrors.AsError(err, "cannot write refresh token file")
+// parseExpiration returns the time in the exp claim of a JWT token. The signature is not verified as the
+// token is only forwarded to the cluster API.
+func parseExpiration(token string) time.Time {
+	claims := &jwt.StandardClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(token, claims)
+	if err != nil || claims.ExpiresAt == 0 {
+		return time.Time{}
 	}
-	return nil
+	return time.Unix(claims.ExpiresAt, 0)
+}
+
+// Valid returns whether the token has a known expiration time in the future.
+func (c *Credentials) Valid() bool {
+	return c.Token != "" && !c.ExpiresAt.IsZero() && c.ExpiresAt.After(time.Now())
 }
 
 func (c *Credentials) GetContext(timeout ...time.Duration) (context.Context, context.CancelFunc) {
@@ -64,15 +63,3 @@ func (c *Credentials) GetContext(timeout ...time.Duration) (context.Context, con
 	baseContext, cancel := context.WithTimeout(context.Background(), timeout[0])
 	return metadata.NewOutgoingContext(baseContext, md), cancel
 }
-
-func resolvePath(path string) string {
-	if strings.HasPrefix(path, "~") {
-		usr, _ := user.Current()
-		return strings.Replace(path, "~", usr.HomeDir, 1)
-	}
-	if strings.HasPrefix(path, ".") {
-		abs, _ := filepath.Abs("./")
-		return strings.Replace(path, ".", abs, 1)
-	}
-	return path
-}
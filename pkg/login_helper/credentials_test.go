@@ -0,0 +1,64 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package login_helper
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"time"
+)
+
+// signedToken returns a JWT token that expires at the given time, or without expiration if it is zero.
+func signedToken(expiresAt time.Time) string {
+	claims := jwt.StandardClaims{Subject: "device-controller"}
+	if !expiresAt.IsZero() {
+		claims.ExpiresAt = expiresAt.Unix()
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	gomega.Expect(err).To(gomega.Succeed())
+	return token
+}
+
+var _ = ginkgo.Describe("Credentials", func() {
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	table.DescribeTable("token expiration",
+		func(token func() string, expected time.Time, valid bool) {
+			credentials := NewCredentials(token(), "refresh")
+			gomega.Expect(credentials.ExpiresAt.Equal(expected)).To(gomega.BeTrue())
+			gomega.Expect(credentials.Valid()).To(gomega.Equal(valid))
+		},
+		table.Entry("token that expires later", func() string { return signedToken(expiresAt) }, expiresAt, true),
+		table.Entry("expired token", func() string { return signedToken(expiresAt.Add(-2 * time.Hour)) }, expiresAt.Add(-2*time.Hour), false),
+		table.Entry("token without expiration", func() string { return signedToken(time.Time{}) }, time.Time{}, false),
+		table.Entry("token that is not a JWT", func() string { return "token" }, time.Time{}, false),
+		table.Entry("empty token", func() string { return "" }, time.Time{}, false),
+	)
+
+	ginkgo.It("should send the token in the context", func() {
+		ctx, cancel := NewCredentials("token", "").GetContext(time.Second)
+		defer cancel()
+		gomega.Expect(token(ctx)).To(gomega.Equal("token"))
+		deadline, hasDeadline := ctx.Deadline()
+		gomega.Expect(hasDeadline).To(gomega.BeTrue())
+		gomega.Expect(time.Until(deadline)).To(gomega.BeNumerically("<=", time.Second))
+	})
+
+})
@@ -18,7 +18,10 @@ package login_helper
 
 import (
 	"context"
+	"fmt"
 	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/metrics"
+	"github.com/nalej/device-controller/pkg/tlsdial"
 	"github.com/nalej/grpc-authx-go"
 	"github.com/nalej/grpc-login-api-go"
 	"github.com/nalej/grpc-utils/pkg/conversions"
@@ -26,12 +29,18 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	grpc_status "google.golang.org/grpc/status"
+	"math/rand"
 	"sync"
+	"time"
 )
 
 const (
 	// Maximum number of retries for authentication
 	MaxAuthRetries = 10
+	// InitialAuthBackoff with the time to wait after the first failed authentication.
+	InitialAuthBackoff = 500 * time.Millisecond
+	// MaxAuthBackoff with the maximum time to wait between two authentication attempts.
+	MaxAuthBackoff = 30 * time.Second
 )
 
 type LoginHelper struct {
@@ -40,22 +49,63 @@ type LoginHelper struct {
 	email       string
 	password    string
 	Credentials *Credentials
-	mu          sync.RWMutex
+	// store where the credentials are saved to be restored on restart.
+	store CredentialStore
+	mu    sync.RWMutex
+	// refreshing with the reauthentication in progress, if any.
+	refreshing *refreshCall
+	refreshMu  sync.Mutex
 }
 
 // NewLogin creates a new LoginHelper structure.
-func NewLogin(hostname string, port int, useTLS bool, email string, password string, caCertPath string, clientCertPath string, skipCAValidation bool) *LoginHelper {
+// The connection uses the given TLS material, or plaintext if it is nil.
+func NewLogin(hostname string, port int, email string, password string, material *tlsdial.Material, store CredentialStore) *LoginHelper {
 	return &LoginHelper{
-		Connection: *NewConnection(hostname, port, useTLS, "", "", true),
+		Connection: *NewConnection(hostname, port, material),
 		email:      email,
 		password:   password,
+		store:      store,
 	}
 }
 
-func (l *LoginHelper) Login() derrors.Error {
-	// Lock incoming
+// SetCredentials changes the email and the password used by the next logins.
+func (l *LoginHelper) SetCredentials(email string, password string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.email = email
+	l.password = password
+}
+
+// Restore loads the credentials saved by a previous execution. It returns false if there are no stored
+// credentials with a token that has not expired yet, so a login is required.
+func (l *LoginHelper) Restore() bool {
+	credentials, err := l.store.Load()
+	if err != nil {
+		if err.Type() != derrors.NotFound {
+			log.Warn().Str("err", err.DebugReport()).Msg("cannot load stored credentials")
+		}
+		return false
+	}
+	if !credentials.Valid() {
+		log.Info().Msg("stored token is expired or has no expiration time")
+		return false
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	l.Credentials = credentials
+	log.Info().Str("expiresAt", credentials.ExpiresAt.String()).Msg("restored stored token")
+	return true
+}
+
+// Login obtains new credentials with the email and the password. The lock is only held to read the basic
+// credentials and to store the new ones, so the current token can be used while the login is in progress.
+func (l *LoginHelper) Login() derrors.Error {
+	l.mu.RLock()
+	loginRequest := &grpc_authx_go.LoginWithBasicCredentialsRequest{
+		Username: l.email,
+		Password: l.password,
+	}
+	l.mu.RUnlock()
 	c, err := l.GetConnection()
 	if err != nil {
 		return err
@@ -64,24 +114,45 @@ func (l *LoginHelper) Login() derrors.Error {
 	loginClient := grpc_login_api_go.NewLoginClient(c)
 	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
 	defer cancel()
-	loginRequest := &grpc_authx_go.LoginWithBasicCredentialsRequest{
-		Username: l.email,
-		Password: l.password,
-	}
 	response, lErr := loginClient.LoginWithBasicCredentials(ctx, loginRequest)
 	if lErr != nil {
 		return conversions.ToDerror(lErr)
 	}
-	l.Credentials = NewCredentials(DefaultPath, response.Token, response.RefreshToken)
-	sErr := l.Credentials.Store()
-	if sErr != nil {
-		return sErr
-	}
+	l.storeCredentials(response)
+	return nil
+}
 
+// Ready returns an error if the helper does not have a valid token to call the cluster API.
+func (l *LoginHelper) Ready() derrors.Error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.Credentials == nil || l.Credentials.Token == "" {
+		return derrors.NewUnavailableError("not logged in")
+	}
+	if !l.Credentials.ExpiresAt.IsZero() && !l.Credentials.ExpiresAt.After(time.Now()) {
+		return derrors.NewUnavailableError(fmt.Sprintf("token expired at %s", l.Credentials.ExpiresAt.Format(time.RFC3339)))
+	}
 	return nil
 }
 
+// ExpiresAt returns the expiration time of the current token, or zero if it is unknown.
+func (l *LoginHelper) ExpiresAt() time.Time {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.Credentials == nil {
+		return time.Time{}
+	}
+	return l.Credentials.ExpiresAt
+}
+
+// GetContext returns a context with the current token to call the cluster API. If there is no token yet, the
+// context has no credentials, so the call is rejected as unauthenticated and triggers a reauthentication.
 func (l *LoginHelper) GetContext() (context.Context, context.CancelFunc) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.Credentials == nil {
+		return context.WithTimeout(context.Background(), DefaultTimeout)
+	}
 	return l.Credentials.GetContext()
 }
 
@@ -118,27 +189,122 @@ func (l *LoginHelper) AuthenticatedGrpcCall(
 	return answer, err
 }
 
-// Internal function that runs the authentication process if and only if
-func (l *LoginHelper) RerunAuthentication() derrors.Error {
-	log.Info().Msg("reauthentication launched...")
-	authenticated := false
-	retries := 0
-	for !authenticated && retries < MaxAuthRetries {
-		loginError := l.Login()
-		if loginError != nil {
-			if grpc_status.Convert(loginError).Code() == codes.Unauthenticated {
-				log.Error().Err(loginError).Int("retries", retries).Msg("unanthenticated when retrying login")
+// refreshCall with the result of a reauthentication shared by the concurrent callers.
+type refreshCall struct {
+	done chan struct{}
+	err  derrors.Error
+}
+
+// storeCredentials keeps the tokens of a login response. A failure to persist them is only logged, as the
+// login itself succeeded and the tokens can be used until the service restarts.
+func (l *LoginHelper) storeCredentials(response *grpc_authx_go.LoginResponse) {
+	credentials := NewCredentials(response.Token, response.RefreshToken)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Credentials = credentials
+	err := l.store.Save(credentials)
+	if err != nil {
+		log.Warn().Str("err", err.DebugReport()).Msg("cannot store credentials")
+	}
+}
+
+// Refresh obtains a new token using the refresh token of the current credentials. As in Login, the lock is
+// not held during the request to the login API.
+func (l *LoginHelper) Refresh() derrors.Error {
+	l.mu.RLock()
+	if l.Credentials == nil || l.Credentials.RefreshToken == "" {
+		l.mu.RUnlock()
+		return derrors.NewFailedPreconditionError("no refresh token available")
+	}
+	refreshRequest := &grpc_authx_go.RefreshTokenRequest{
+		Token:        l.Credentials.Token,
+		RefreshToken: l.Credentials.RefreshToken,
+	}
+	l.mu.RUnlock()
+	c, err := l.GetConnection()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	loginClient := grpc_login_api_go.NewLoginClient(c)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	response, rErr := loginClient.RefreshToken(ctx, refreshRequest)
+	if rErr != nil {
+		return conversions.ToDerror(rErr)
+	}
+	l.storeCredentials(response)
+	return nil
+}
+
+// AuthBackoff returns the time to wait before the given retry, doubling the wait on each retry and adding a
+// random jitter so several instances do not retry at the same time.
+func AuthBackoff(retry int) time.Duration {
+	backoff := InitialAuthBackoff
+	for i := 0; i < retry && backoff < MaxAuthBackoff; i++ {
+		backoff = backoff * 2
+	}
+	if backoff > MaxAuthBackoff {
+		backoff = MaxAuthBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// reauthenticate refreshes the token, falling back to the basic credentials if the refresh fails. Failed
+// attempts are retried with backoff up to MaxAuthRetries times.
+func (l *LoginHelper) reauthenticate() derrors.Error {
+	useRefresh := true
+	for retries := 0; retries < MaxAuthRetries; retries++ {
+		if retries > 0 {
+			time.Sleep(AuthBackoff(retries - 1))
+		}
+		if useRefresh {
+			refreshErr := l.Refresh()
+			if refreshErr == nil {
+				log.Info().Msg("token refresh successful")
+				return nil
+			}
+			log.Warn().Str("err", refreshErr.Error()).Int("retries", retries).Msg("cannot refresh token, using basic credentials")
+			// An expired or revoked refresh token will not become valid again.
+			if refreshErr.Type() == derrors.Unauthenticated || refreshErr.Type() == derrors.FailedPrecondition {
+				useRefresh = false
 			}
-			log.Error().Err(loginError).Int("retries", retries).Msg("retrying login...")
-		} else {
+		}
+		loginError := l.Login()
+		if loginError == nil {
 			log.Info().Msg("login renegotiation successful")
-			authenticated = true
+			return nil
 		}
-		retries = retries + 1
+		log.Error().Err(loginError).Int("retries", retries).Msg("retrying login...")
+	}
+	return derrors.NewUnauthenticatedError("authentication failed after reaching max retries")
+}
+
+// RerunAuthentication obtains new credentials after the cluster API rejects the current token. Concurrent
+// callers share the same reauthentication.
+func (l *LoginHelper) RerunAuthentication() derrors.Error {
+	l.refreshMu.Lock()
+	if l.refreshing != nil {
+		call := l.refreshing
+		l.refreshMu.Unlock()
+		<-call.done
+		return call.err
 	}
-	if authenticated {
-		return nil
+	call := &refreshCall{done: make(chan struct{})}
+	l.refreshing = call
+	l.refreshMu.Unlock()
+
+	log.Info().Msg("reauthentication launched...")
+	call.err = l.reauthenticate()
+	if call.err == nil {
+		metrics.Reauthentications.WithLabelValues(metrics.ResultSuccess).Inc()
+	} else {
+		metrics.Reauthentications.WithLabelValues(metrics.ResultFailure).Inc()
 	}
 
-	return derrors.NewUnauthenticatedError("authenticated, failed after reaching max retries")
+	l.refreshMu.Lock()
+	l.refreshing = nil
+	l.refreshMu.Unlock()
+	close(call.done)
+	return call.err
 }
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package login_helper
+
+import (
+	"context"
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-authx-go"
+	"github.com/nalej/grpc-login-api-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"net"
+	"time"
+)
+
+// testLoginServer returns a new token on each login and refresh. If release is set, the refreshes wait until
+// it is closed.
+type testLoginServer struct {
+	refreshing chan *grpc_authx_go.RefreshTokenRequest
+	release    chan struct{}
+}
+
+func (s *testLoginServer) LoginWithBasicCredentials(_ context.Context, request *grpc_authx_go.LoginWithBasicCredentialsRequest) (*grpc_authx_go.LoginResponse, error) {
+	return &grpc_authx_go.LoginResponse{Token: "login-" + request.Username, RefreshToken: "refresh"}, nil
+}
+
+func (s *testLoginServer) RefreshToken(_ context.Context, request *grpc_authx_go.RefreshTokenRequest) (*grpc_authx_go.LoginResponse, error) {
+	s.refreshing <- request
+	if s.release != nil {
+		<-s.release
+	}
+	return &grpc_authx_go.LoginResponse{Token: "refreshed-" + request.Token, RefreshToken: request.RefreshToken}, nil
+}
+
+// failingStore cannot save any credentials.
+type failingStore struct {
+}
+
+func (s *failingStore) Save(_ *Credentials) derrors.Error {
+	return derrors.NewInternalError("disk full")
+}
+
+func (s *failingStore) Load() (*Credentials, derrors.Error) {
+	return nil, derrors.NewNotFoundError("no stored credentials")
+}
+
+// token returns the token sent in the context of a call to the cluster API.
+func token(ctx context.Context) string {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	values := md.Get(AuthHeader)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+var _ = ginkgo.Describe("LoginHelper", func() {
+
+	var loginServer *testLoginServer
+	var server *grpc.Server
+	var store *MemoryStore
+	var helper *LoginHelper
+
+	ginkgo.BeforeEach(func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		gomega.Expect(err).To(gomega.Succeed())
+		loginServer = &testLoginServer{refreshing: make(chan *grpc_authx_go.RefreshTokenRequest, 10)}
+		server = grpc.NewServer()
+		grpc_login_api_go.RegisterLoginServer(server, loginServer)
+		go func(server *grpc.Server) {
+			_ = server.Serve(listener)
+		}(server)
+		store = NewMemoryStore()
+		helper = NewLogin("127.0.0.1", listener.Addr().(*net.TCPAddr).Port, "user", "password", nil, store)
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Stop()
+	})
+
+	ginkgo.It("should return a context without token before the login", func() {
+		ctx, cancel := helper.GetContext()
+		defer cancel()
+		gomega.Expect(token(ctx)).To(gomega.BeEmpty())
+		_, hasDeadline := ctx.Deadline()
+		gomega.Expect(hasDeadline).To(gomega.BeTrue())
+		gomega.Expect(helper.Ready()).NotTo(gomega.Succeed())
+	})
+
+	ginkgo.It("should login and store the credentials", func() {
+		gomega.Expect(helper.Login()).To(gomega.Succeed())
+		ctx, cancel := helper.GetContext()
+		defer cancel()
+		gomega.Expect(token(ctx)).To(gomega.Equal("login-user"))
+		stored, err := store.Load()
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(stored.Token).To(gomega.Equal("login-user"))
+	})
+
+	ginkgo.It("should login even if the credentials cannot be stored", func() {
+		helper.store = &failingStore{}
+		gomega.Expect(helper.Login()).To(gomega.Succeed())
+		gomega.Expect(helper.Ready()).To(gomega.Succeed())
+		ctx, cancel := helper.GetContext()
+		defer cancel()
+		gomega.Expect(token(ctx)).To(gomega.Equal("login-user"))
+	})
+
+	ginkgo.It("should not refresh the token without a refresh token", func() {
+		err := helper.Refresh()
+		gomega.Expect(err).NotTo(gomega.Succeed())
+		gomega.Expect(err.Type()).To(gomega.Equal(derrors.FailedPrecondition))
+	})
+
+	ginkgo.It("should keep serving the current token while it is refreshed", func() {
+		gomega.Expect(helper.Login()).To(gomega.Succeed())
+		loginServer.release = make(chan struct{})
+		refreshed := make(chan derrors.Error, 1)
+		go func() {
+			refreshed <- helper.Refresh()
+		}()
+
+		var request *grpc_authx_go.RefreshTokenRequest
+		gomega.Eventually(loginServer.refreshing, 5*time.Second).Should(gomega.Receive(&request))
+		gomega.Expect(request.Token).To(gomega.Equal("login-user"))
+		gomega.Expect(request.RefreshToken).To(gomega.Equal("refresh"))
+
+		current := make(chan string, 1)
+		go func() {
+			ctx, cancel := helper.GetContext()
+			defer cancel()
+			current <- token(ctx)
+		}()
+		gomega.Eventually(current).Should(gomega.Receive(gomega.Equal("login-user")))
+		gomega.Expect(helper.Ready()).To(gomega.Succeed())
+
+		close(loginServer.release)
+		gomega.Eventually(refreshed, 5*time.Second).Should(gomega.Receive(gomega.BeNil()))
+		ctx, cancel := helper.GetContext()
+		defer cancel()
+		gomega.Expect(token(ctx)).To(gomega.Equal("refreshed-login-user"))
+	})
+
+})
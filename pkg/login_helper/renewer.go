@@ -0,0 +1,135 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package login_helper
+
+import (
+	"fmt"
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+const (
+	// RenewalCheckInterval with the time between two checks of a token without expiration time.
+	RenewalCheckInterval = time.Minute
+	// RenewalRetryInterval with the minimum time between two renewals.
+	RenewalRetryInterval = 30 * time.Second
+)
+
+// Renewer refreshes the token of a LoginHelper a margin before it expires, so the calls to the cluster API
+// do not fail with an expired token.
+type Renewer struct {
+	helper  *LoginHelper
+	margin  time.Duration
+	mu      sync.Mutex
+	lastErr derrors.Error
+	// lastAttempt with the time of the last renewal.
+	lastAttempt time.Time
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+func NewRenewer(helper *LoginHelper, margin time.Duration) *Renewer {
+	return &Renewer{
+		helper: helper,
+		margin: margin,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// RemainingLifetime returns the time until the current token expires. It is zero if the token has expired
+// and negative if the expiration time is unknown.
+func (r *Renewer) RemainingLifetime() time.Duration {
+	expiresAt := r.helper.ExpiresAt()
+	if expiresAt.IsZero() {
+		return -1
+	}
+	remaining := time.Until(expiresAt)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Ready returns an error if the token is within the renewal margin and the last renewal failed.
+func (r *Renewer) Ready() derrors.Error {
+	r.mu.Lock()
+	lastErr := r.lastErr
+	r.mu.Unlock()
+	remaining := r.RemainingLifetime()
+	if lastErr != nil && remaining >= 0 && remaining < r.margin {
+		return derrors.NewUnavailableError(fmt.Sprintf("token expires in %s and cannot be renewed: %s", remaining.Round(time.Second), lastErr.Error()))
+	}
+	return nil
+}
+
+// nextRenewal returns the time to wait before the next renewal, and whether a renewal is due after it.
+func (r *Renewer) nextRenewal() (time.Duration, bool) {
+	expiresAt := r.helper.ExpiresAt()
+	if expiresAt.IsZero() {
+		return RenewalCheckInterval, false
+	}
+	r.mu.Lock()
+	lastAttempt := r.lastAttempt
+	r.mu.Unlock()
+	wait := time.Until(expiresAt.Add(-r.margin))
+	// A token that is still within the margin after a renewal is not renewed again right away.
+	if retry := time.Until(lastAttempt.Add(RenewalRetryInterval)); wait < retry {
+		wait = retry
+	}
+	if wait < 0 {
+		return 0, true
+	}
+	return wait, true
+}
+
+// Run renews the token before it expires until Stop is called.
+func (r *Renewer) Run() {
+	defer close(r.done)
+	for {
+		wait, renew := r.nextRenewal()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-r.stop:
+			timer.Stop()
+			return
+		}
+		if !renew {
+			continue
+		}
+		log.Debug().Str("expiresAt", r.helper.ExpiresAt().String()).Msg("renewing token")
+		err := r.helper.RerunAuthentication()
+		r.mu.Lock()
+		r.lastErr = err
+		r.lastAttempt = time.Now()
+		r.mu.Unlock()
+		if err != nil {
+			log.Error().Str("err", err.DebugReport()).Msg("cannot renew token")
+		} else {
+			log.Info().Str("expiresAt", r.helper.ExpiresAt().String()).Msg("token renewed")
+		}
+	}
+}
+
+// Stop renewing the token.
+func (r *Renewer) Stop() {
+	close(r.stop)
+	<-r.done
+}
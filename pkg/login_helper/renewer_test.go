@@ -0,0 +1,78 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package login_helper
+
+import (
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"time"
+)
+
+var _ = ginkgo.Describe("Renewer", func() {
+
+	margin := 10 * time.Minute
+
+	table.DescribeTable("renewal schedule",
+		func(expiresIn time.Duration, lastAttempt time.Duration, minWait time.Duration, maxWait time.Duration, renew bool) {
+			helper := &LoginHelper{}
+			if expiresIn != 0 {
+				helper.Credentials = NewCredentials(signedToken(time.Now().Add(expiresIn)), "refresh")
+			}
+			renewer := NewRenewer(helper, margin)
+			if lastAttempt != 0 {
+				renewer.lastAttempt = time.Now().Add(-lastAttempt)
+			}
+			wait, due := renewer.nextRenewal()
+			gomega.Expect(due).To(gomega.Equal(renew))
+			gomega.Expect(wait).To(gomega.BeNumerically(">=", minWait))
+			gomega.Expect(wait).To(gomega.BeNumerically("<=", maxWait))
+		},
+		table.Entry("token without expiration", time.Duration(0), time.Duration(0), RenewalCheckInterval, RenewalCheckInterval, false),
+		table.Entry("token that expires after the margin", time.Hour, time.Duration(0), 49*time.Minute, 50*time.Minute, true),
+		table.Entry("token within the margin", 5*time.Minute, time.Duration(0), time.Duration(0), time.Duration(0), true),
+		table.Entry("token within the margin just after a renewal", 5*time.Minute, time.Second, 28*time.Second, RenewalRetryInterval, true),
+	)
+
+	table.DescribeTable("readiness",
+		func(expiresIn time.Duration, lastErr derrors.Error, ready bool) {
+			helper := &LoginHelper{Credentials: NewCredentials(signedToken(time.Now().Add(expiresIn)), "refresh")}
+			renewer := NewRenewer(helper, margin)
+			renewer.lastErr = lastErr
+			if ready {
+				gomega.Expect(renewer.Ready()).To(gomega.Succeed())
+			} else {
+				gomega.Expect(renewer.Ready()).NotTo(gomega.Succeed())
+			}
+		},
+		table.Entry("renewal not needed", time.Hour, derrors.NewUnavailableError("login API not available"), true),
+		table.Entry("renewal succeeded", 5*time.Minute, nil, true),
+		table.Entry("renewal failed within the margin", 5*time.Minute, derrors.NewUnavailableError("login API not available"), false),
+	)
+
+	ginkgo.It("should report the remaining lifetime of the token", func() {
+		helper := &LoginHelper{}
+		renewer := NewRenewer(helper, margin)
+		gomega.Expect(renewer.RemainingLifetime()).To(gomega.BeNumerically("<", 0))
+		helper.Credentials = NewCredentials(signedToken(time.Now().Add(-time.Hour)), "refresh")
+		gomega.Expect(renewer.RemainingLifetime()).To(gomega.BeZero())
+		helper.Credentials = NewCredentials(signedToken(time.Now().Add(time.Hour)), "refresh")
+		gomega.Expect(renewer.RemainingLifetime()).To(gomega.BeNumerically("~", time.Hour, time.Second))
+	})
+
+})
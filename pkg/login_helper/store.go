@@ -0,0 +1,231 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package login_helper
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/nalej/derrors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// MemoryStoreType keeps the credentials in memory.
+	MemoryStoreType = "memory"
+	// FileStoreType writes the credentials as plain files.
+	FileStoreType = "file"
+	// EncryptedFileStoreType writes the credentials in a file encrypted with AES-GCM.
+	EncryptedFileStoreType = "encrypted"
+)
+
+// CredentialStore keeps the credentials obtained from the login API.
+type CredentialStore interface {
+	// Save the credentials.
+	Save(credentials *Credentials) derrors.Error
+	// Load the stored credentials. It returns a NotFound error if there are no credentials.
+	Load() (*Credentials, derrors.Error)
+}
+
+// NewCredentialStore creates a store of the given type. The path is the directory of the file stores, and
+// the key path is the file with the secret of the encrypted store.
+func NewCredentialStore(storeType string, path string, keyPath string) (CredentialStore, derrors.Error) {
+	switch storeType {
+	case MemoryStoreType:
+		return NewMemoryStore(), nil
+	case FileStoreType:
+		if path == "" {
+			return nil, derrors.NewInvalidArgumentError("credential store path must be set")
+		}
+		return NewFileStore(path), nil
+	case EncryptedFileStoreType:
+		if path == "" || keyPath == "" {
+			return nil, derrors.NewInvalidArgumentError("credential store path and key path must be set")
+		}
+		return NewEncryptedFileStore(path, keyPath)
+	}
+	return nil, derrors.NewInvalidArgumentError(fmt.Sprintf("unknown credential store %s", storeType))
+}
+
+// MemoryStore keeps the credentials in memory, so they are lost on restart.
+type MemoryStore struct {
+	mu          sync.Mutex
+	credentials *Credentials
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (m *MemoryStore) Save(credentials *Credentials) derrors.Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.credentials = credentials
+	return nil
+}
+
+func (m *MemoryStore) Load() (*Credentials, derrors.Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.credentials == nil {
+		return nil, derrors.NewNotFoundError("no credentials stored")
+	}
+	return m.credentials, nil
+}
+
+// FileStore writes the token and the refresh token as plain files in a directory.
+type FileStore struct {
+	Path string
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: resolvePath(path)}
+}
+
+// writeFile writes a file with restricted permissions, replacing the previous one atomically.
+func writeFile(path string, content []byte) error {
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, content, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (f *FileStore) Save(credentials *Credentials) derrors.Error {
+	err := os.MkdirAll(f.Path, 0700)
+	if err != nil {
+		return derrors.AsError(err, "cannot create credential store directory")
+	}
+	err = writeFile(filepath.Join(f.Path, TokenFileName), []byte(credentials.Token))
+	if err != nil {
+		return derrors.AsError(err, "cannot write token file")
+	}
+	err = writeFile(filepath.Join(f.Path, RefreshTokenFileName), []byte(credentials.RefreshToken))
+	if err != nil {
+		return derrors.AsError(err, "cannot write refresh token file")
+	}
+	return nil
+}
+
+func (f *FileStore) Load() (*Credentials, derrors.Error) {
+	token, err := ioutil.ReadFile(filepath.Join(f.Path, TokenFileName))
+	if os.IsNotExist(err) {
+		return nil, derrors.NewNotFoundError("no credentials stored")
+	}
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot read token file")
+	}
+	refreshToken, err := ioutil.ReadFile(filepath.Join(f.Path, RefreshTokenFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, derrors.AsError(err, "cannot read refresh token file")
+	}
+	return NewCredentials(string(token), string(refreshToken)), nil
+}
+
+// EncryptedFileStore writes the credentials in a file encrypted with AES-256-GCM. The key is derived from
+// the content of a secret file, usually mounted from a Kubernetes secret.
+type EncryptedFileStore struct {
+	Path string
+	aead cipher.AEAD
+}
+
+func NewEncryptedFileStore(path string, keyPath string) (*EncryptedFileStore, derrors.Error) {
+	secret, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot read credential store key")
+	}
+	if len(strings.TrimSpace(string(secret))) == 0 {
+		return nil, derrors.NewInvalidArgumentError("credential store key is empty")
+	}
+	key := sha256.Sum256([]byte(strings.TrimSpace(string(secret))))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot create credential store cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot create credential store cipher")
+	}
+	return &EncryptedFileStore{Path: resolvePath(path), aead: aead}, nil
+}
+
+func (e *EncryptedFileStore) Save(credentials *Credentials) derrors.Error {
+	plain, err := json.Marshal(credentials)
+	if err != nil {
+		return derrors.AsError(err, "cannot marshal credentials")
+	}
+	nonce := make([]byte, e.aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return derrors.AsError(err, "cannot generate nonce")
+	}
+	err = os.MkdirAll(e.Path, 0700)
+	if err != nil {
+		return derrors.AsError(err, "cannot create credential store directory")
+	}
+	err = writeFile(filepath.Join(e.Path, EncryptedFileName), e.aead.Seal(nonce, nonce, plain, nil))
+	if err != nil {
+		return derrors.AsError(err, "cannot write credentials file")
+	}
+	return nil
+}
+
+func (e *EncryptedFileStore) Load() (*Credentials, derrors.Error) {
+	sealed, err := ioutil.ReadFile(filepath.Join(e.Path, EncryptedFileName))
+	if os.IsNotExist(err) {
+		return nil, derrors.NewNotFoundError("no credentials stored")
+	}
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot read credentials file")
+	}
+	if len(sealed) < e.aead.NonceSize() {
+		return nil, derrors.NewInternalError("credentials file is corrupted")
+	}
+	nonceSize := e.aead.NonceSize()
+	plain, err := e.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot decrypt credentials file")
+	}
+	stored := &Credentials{}
+	err = json.Unmarshal(plain, stored)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot unmarshal credentials")
+	}
+	return NewCredentials(stored.Token, stored.RefreshToken), nil
+}
+
+func resolvePath(path string) string {
+	if strings.HasPrefix(path, "~") {
+		usr, _ := user.Current()
+		return strings.Replace(path, "~", usr.HomeDir, 1)
+	}
+	if strings.HasPrefix(path, ".") {
+		abs, _ := filepath.Abs("./")
+		return strings.Replace(path, ".", abs, 1)
+	}
+	return path
+}
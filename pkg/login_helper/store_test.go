@@ -0,0 +1,144 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package login_helper
+
+import (
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = ginkgo.Describe("Credential stores", func() {
+
+	var dir string
+	var keyPath string
+
+	writeKey := func(name string, key string) string {
+		path := filepath.Join(dir, name)
+		gomega.Expect(ioutil.WriteFile(path, []byte(key), 0600)).To(gomega.Succeed())
+		return path
+	}
+
+	newStore := func(storeType string) CredentialStore {
+		store, err := NewCredentialStore(storeType, filepath.Join(dir, "store"), keyPath)
+		gomega.Expect(err).To(gomega.BeNil())
+		return store
+	}
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "store")
+		gomega.Expect(err).To(gomega.Succeed())
+		keyPath = writeKey("key", "secret-key\n")
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+	})
+
+	table.DescribeTable("round trip",
+		func(storeType string, persistent bool) {
+			token := signedToken(time.Now().Add(time.Hour).Truncate(time.Second))
+			store := newStore(storeType)
+			gomega.Expect(store.Save(NewCredentials("previous", "previous"))).To(gomega.Succeed())
+			gomega.Expect(store.Save(NewCredentials(token, "refresh"))).To(gomega.Succeed())
+			if persistent {
+				// The credentials are read by a new store, as after a restart
+				store = newStore(storeType)
+			}
+			loaded, err := store.Load()
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(loaded.Token).To(gomega.Equal(token))
+			gomega.Expect(loaded.RefreshToken).To(gomega.Equal("refresh"))
+			gomega.Expect(loaded.Valid()).To(gomega.BeTrue())
+		},
+		table.Entry("memory", MemoryStoreType, false),
+		table.Entry("file", FileStoreType, true),
+		table.Entry("encrypted file", EncryptedFileStoreType, true),
+	)
+
+	table.DescribeTable("nothing stored",
+		func(storeType string) {
+			_, err := newStore(storeType).Load()
+			gomega.Expect(err).NotTo(gomega.BeNil())
+			gomega.Expect(err.Type()).To(gomega.Equal(derrors.NotFound))
+		},
+		table.Entry("memory", MemoryStoreType),
+		table.Entry("file", FileStoreType),
+		table.Entry("encrypted file", EncryptedFileStoreType),
+	)
+
+	table.DescribeTable("file permissions",
+		func(storeType string, files []string) {
+			gomega.Expect(newStore(storeType).Save(NewCredentials("token", "refresh"))).To(gomega.Succeed())
+			for _, name := range files {
+				info, err := os.Stat(filepath.Join(dir, "store", name))
+				gomega.Expect(err).To(gomega.Succeed())
+				gomega.Expect(info.Mode().Perm()).To(gomega.Equal(os.FileMode(0600)))
+			}
+		},
+		table.Entry("file", FileStoreType, []string{TokenFileName, RefreshTokenFileName}),
+		table.Entry("encrypted file", EncryptedFileStoreType, []string{EncryptedFileName}),
+	)
+
+	ginkgo.It("should not store the tokens in clear in the encrypted file", func() {
+		gomega.Expect(newStore(EncryptedFileStoreType).Save(NewCredentials("clear-token", "clear-refresh"))).To(gomega.Succeed())
+		sealed, err := ioutil.ReadFile(filepath.Join(dir, "store", EncryptedFileName))
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(string(sealed)).NotTo(gomega.ContainSubstring("clear-token"))
+		gomega.Expect(string(sealed)).NotTo(gomega.ContainSubstring("clear-refresh"))
+	})
+
+	table.DescribeTable("unreadable encrypted file",
+		func(change func(path string)) {
+			gomega.Expect(newStore(EncryptedFileStoreType).Save(NewCredentials("token", "refresh"))).To(gomega.Succeed())
+			change(filepath.Join(dir, "store", EncryptedFileName))
+			_, err := newStore(EncryptedFileStoreType).Load()
+			gomega.Expect(err).NotTo(gomega.BeNil())
+			gomega.Expect(err.Type()).NotTo(gomega.Equal(derrors.NotFound))
+		},
+		table.Entry("wrong key", func(_ string) { keyPath = writeKey("other-key", "other-secret-key") }),
+		table.Entry("tampered ciphertext", func(path string) {
+			sealed, err := ioutil.ReadFile(path)
+			gomega.Expect(err).To(gomega.Succeed())
+			sealed[len(sealed)-1] ^= 0xff
+			gomega.Expect(ioutil.WriteFile(path, sealed, 0600)).To(gomega.Succeed())
+		}),
+		table.Entry("truncated file", func(path string) {
+			gomega.Expect(ioutil.WriteFile(path, []byte("short"), 0600)).To(gomega.Succeed())
+		}),
+	)
+
+	table.DescribeTable("invalid stores",
+		func(storeType string, path string, key func() string) {
+			_, err := NewCredentialStore(storeType, path, key())
+			gomega.Expect(err).NotTo(gomega.BeNil())
+		},
+		table.Entry("unknown type", "vault", "store", func() string { return keyPath }),
+		table.Entry("file without path", FileStoreType, "", func() string { return keyPath }),
+		table.Entry("encrypted file without path", EncryptedFileStoreType, "", func() string { return keyPath }),
+		table.Entry("encrypted file without key", EncryptedFileStoreType, "store", func() string { return "" }),
+		table.Entry("missing key file", EncryptedFileStoreType, "store", func() string { return filepath.Join(dir, "missing") }),
+		table.Entry("empty key file", EncryptedFileStoreType, "store", func() string { return writeKey("empty-key", " \n") }),
+	)
+
+})
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+// Path with the HTTP path that serves the metrics.
+const Path = "/metrics"
+
+const namespace = "device_controller"
+
+const (
+	// ResultSuccess labels the operations that succeeded.
+	ResultSuccess = "success"
+	// ResultFailure labels the operations that failed.
+	ResultFailure = "failure"
+)
+
+var (
+	// RPCRequests counts the gRPC requests by method and status code.
+	RPCRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_requests_total",
+		Help:      "Number of gRPC requests by method and status code.",
+	}, []string{"method", "code"})
+	// RPCDuration measures the time spent serving the gRPC requests by method.
+	RPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Time spent serving the gRPC requests by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+	// DeviceLatency records the latencies reported by the devices.
+	DeviceLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "device_latency_milliseconds",
+		Help:      "Latencies reported by the devices.",
+		Buckets:   []float64{5, 10, 25, 50, 100, 200, 400, 800, 1600, 3200},
+	}, []string{"organization_id", "device_group_id"})
+	// LatencyChecksRequired counts the LATENCY_CHECK_REQUIRED results returned to the devices.
+	LatencyChecksRequired = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "latency_checks_required_total",
+		Help:      "Number of LATENCY_CHECK_REQUIRED results returned to the devices.",
+	}, []string{"organization_id", "device_group_id"})
+	// ForwardedLatencies counts the latency samples sent to the cluster API by result.
+	ForwardedLatencies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "forwarded_latencies_total",
+		Help:      "Number of latency samples sent to the cluster API by result.",
+	}, []string{"result"})
+	// Reauthentications counts the reauthentications against the login API by result.
+	Reauthentications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reauthentications_total",
+		Help:      "Number of reauthentications against the login API by result.",
+	}, []string{"result"})
+	// RateLimited counts the requests rejected because the device exceeded its rate limit.
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Number of requests rejected because the device exceeded its rate limit.",
+	}, []string{"organization_id", "method"})
+)
+
+func init() {
+	prometheus.MustRegister(RPCRequests, RPCDuration, DeviceLatency, LatencyChecksRequired, ForwardedLatencies, Reauthentications, RateLimited)
+}
+
+// RegisterTokenLifetime exposes the remaining lifetime in seconds of the cluster API token returned by the
+// given function.
+func RegisterTokenLifetime(lifetime func() float64) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "token_remaining_lifetime_seconds",
+		Help:      "Remaining lifetime of the cluster API token, negative if it is unknown.",
+	}, lifetime))
+}
+
+// Result returns the label of an operation depending on its error.
+func Result(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
+
+// Handler returns the HTTP handler that exposes the metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
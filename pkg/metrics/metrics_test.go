@@ -0,0 +1,69 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"context"
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = ginkgo.Describe("Metrics", func() {
+
+	table.DescribeTable("operation results",
+		func(err error, expected string) {
+			gomega.Expect(Result(err)).To(gomega.Equal(expected))
+		},
+		table.Entry("without error", nil, ResultSuccess),
+		table.Entry("with error", derrors.NewUnavailableError("cluster API not available"), ResultFailure),
+	)
+
+	table.DescribeTable("StatsHandler",
+		func(method string, err error, code string) {
+			handler := NewStatsHandler()
+			ctx := handler.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: method})
+			requests := testutil.ToFloat64(RPCRequests.WithLabelValues(method, code))
+
+			begin := time.Now()
+			handler.HandleRPC(ctx, &stats.Begin{BeginTime: begin})
+			gomega.Expect(testutil.ToFloat64(RPCRequests.WithLabelValues(method, code))).To(gomega.Equal(requests))
+			handler.HandleRPC(ctx, &stats.End{BeginTime: begin, EndTime: begin.Add(time.Millisecond), Error: err})
+			gomega.Expect(testutil.ToFloat64(RPCRequests.WithLabelValues(method, code))).To(gomega.Equal(requests + 1))
+		},
+		table.Entry("successful request", "/device_controller.Connection/Ping", nil, codes.OK.String()),
+		table.Entry("failed request", "/device_controller.Connection/RegisterLatency",
+			status.Error(codes.Unavailable, "not available"), codes.Unavailable.String()),
+	)
+
+	ginkgo.It("should expose the metrics over HTTP", func() {
+		ForwardedLatencies.WithLabelValues(ResultSuccess).Inc()
+		recorder := httptest.NewRecorder()
+		Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, Path, nil))
+		gomega.Expect(recorder.Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(recorder.Body.String()).To(gomega.ContainSubstring("device_controller_forwarded_latencies_total"))
+	})
+
+})
@@ -0,0 +1,56 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"context"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+type methodKey struct{}
+
+// StatsHandler records the number and the duration of the gRPC requests. It is installed with grpc.StatsHandler.
+type StatsHandler struct {
+}
+
+func NewStatsHandler() *StatsHandler {
+	return &StatsHandler{}
+}
+
+// TagRPC stores the name of the method in the context of the request.
+func (h *StatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return context.WithValue(ctx, methodKey{}, info.FullMethodName)
+}
+
+// HandleRPC records the requests once they finish.
+func (h *StatsHandler) HandleRPC(ctx context.Context, rpcStats stats.RPCStats) {
+	end, ok := rpcStats.(*stats.End)
+	if !ok {
+		return
+	}
+	method, _ := ctx.Value(methodKey{}).(string)
+	RPCRequests.WithLabelValues(method, status.Code(end.Error).String()).Inc()
+	RPCDuration.WithLabelValues(method).Observe(end.EndTime.Sub(end.BeginTime).Seconds())
+}
+
+func (h *StatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *StatsHandler) HandleConn(_ context.Context, _ stats.ConnStats) {
+}
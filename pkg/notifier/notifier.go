@@ -0,0 +1,249 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package notifier
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/latency"
+	"github.com/nalej/device-controller/pkg/liveness"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// SignatureHeader contains the HMAC-SHA256 signature of the timestamp and the body.
+	SignatureHeader = "X-Device-Controller-Signature"
+	// TimestampHeader contains the unix time in seconds when the notification was signed.
+	TimestampHeader = "X-Device-Controller-Timestamp"
+	// EventHeader contains the type of the notification.
+	EventHeader = "X-Device-Controller-Event"
+)
+
+const (
+	// DeviceStateChanged is sent when a device moves between ONLINE, STALE and OFFLINE.
+	DeviceStateChanged = "device_state_changed"
+	// LatencyDegraded is sent when the latency of a device is above its threshold in a sustained way.
+	LatencyDegraded = "latency_degraded"
+)
+
+// Config with the webhooks and the delivery parameters.
+type Config struct {
+	// URLs of the webhooks.
+	URLs []string
+	// Secret used to sign the notifications.
+	Secret []byte
+	// MaxAttempts with the number of delivery attempts of a notification.
+	MaxAttempts int
+	// InitialBackoff with the time to wait after the first failed delivery.
+	InitialBackoff time.Duration
+	// MaxBackoff with the maximum time to wait between two delivery attempts.
+	MaxBackoff time.Duration
+	// Timeout of each HTTP request.
+	Timeout time.Duration
+	// QueueSize with the number of notifications waiting to be sent to a webhook.
+	QueueSize int
+}
+
+func (c *Config) Validate() derrors.Error {
+	for _, target := range c.URLs {
+		parsed, err := url.Parse(target)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return derrors.NewInvalidArgumentError(fmt.Sprintf("invalid webhook URL %s", target))
+		}
+	}
+	if len(c.URLs) > 0 && len(c.Secret) == 0 {
+		return derrors.NewInvalidArgumentError("webhook secret must be set")
+	}
+	if c.MaxAttempts <= 0 || c.InitialBackoff <= 0 || c.MaxBackoff < c.InitialBackoff {
+		return derrors.NewInvalidArgumentError("webhook retry parameters must be valid")
+	}
+	if c.Timeout <= 0 || c.QueueSize <= 0 {
+		return derrors.NewInvalidArgumentError("webhook timeout and queue size must be valid")
+	}
+	return nil
+}
+
+// Notification sent to the webhooks.
+type Notification struct {
+	Type      string      `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	Payload   interface{} `json:"payload"`
+}
+
+// Degradation with the payload of a LatencyDegraded notification.
+type Degradation struct {
+	OrganizationId string         `json:"organization_id"`
+	DeviceGroupId  string         `json:"device_group_id"`
+	DeviceId       string         `json:"device_id"`
+	Threshold      int            `json:"threshold"`
+	Stats          *latency.Stats `json:"stats,omitempty"`
+}
+
+// Sign returns the signature of a notification body sent at the given timestamp.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// endpoint with the notifications waiting to be sent to a webhook.
+type endpoint struct {
+	url           string
+	notifications chan Notification
+}
+
+// Notifier sends signed JSON notifications to a set of webhooks. Each webhook has its own queue so a slow
+// receiver does not delay the others.
+type Notifier struct {
+	config    Config
+	client    *http.Client
+	endpoints []*endpoint
+	stop      chan struct{}
+	workers   sync.WaitGroup
+}
+
+func NewNotifier(config Config) (*Notifier, derrors.Error) {
+	vErr := config.Validate()
+	if vErr != nil {
+		return nil, vErr
+	}
+	endpoints := make([]*endpoint, 0, len(config.URLs))
+	for _, target := range config.URLs {
+		endpoints = append(endpoints, &endpoint{url: target, notifications: make(chan Notification, config.QueueSize)})
+	}
+	return &Notifier{
+		config:    config,
+		client:    &http.Client{Timeout: config.Timeout},
+		endpoints: endpoints,
+		stop:      make(chan struct{}),
+	}, nil
+}
+
+// Notify queues a notification for every webhook. The notification is dropped for the webhooks whose queue
+// is full.
+func (n *Notifier) Notify(notificationType string, payload interface{}) {
+	notification := Notification{Type: notificationType, Timestamp: time.Now(), Payload: payload}
+	for _, target := range n.endpoints {
+		select {
+		case target.notifications <- notification:
+		default:
+			log.Warn().Str("url", target.url).Str("type", notificationType).Msg("webhook queue is full, dropping notification")
+		}
+	}
+}
+
+// DeviceStateChanged notifies a liveness event. It can be subscribed to a liveness.Tracker.
+func (n *Notifier) DeviceStateChanged(event liveness.Event) {
+	n.Notify(DeviceStateChanged, event)
+}
+
+// LatencyDegraded notifies a sustained latency degradation of a device.
+func (n *Notifier) LatencyDegraded(degradation Degradation) {
+	n.Notify(LatencyDegraded, degradation)
+}
+
+// send delivers a notification to a webhook.
+func (n *Notifier) send(target string, notification Notification) derrors.Error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return derrors.AsError(err, "cannot marshal notification")
+	}
+	request, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return derrors.AsError(err, "cannot create webhook request")
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(EventHeader, notification.Type)
+	request.Header.Set(TimestampHeader, timestamp)
+	request.Header.Set(SignatureHeader, Sign(n.config.Secret, timestamp, body))
+	response, err := n.client.Do(request)
+	if err != nil {
+		return derrors.NewUnavailableError("cannot send webhook request", err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return derrors.NewUnavailableError(fmt.Sprintf("webhook returned status %d", response.StatusCode))
+	}
+	return nil
+}
+
+// deliver sends a notification retrying with exponential backoff. It returns false if the notifier is stopped
+// while waiting.
+func (n *Notifier) deliver(target string, notification Notification) bool {
+	backoff := n.config.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := n.send(target, notification)
+		if err == nil {
+			return true
+		}
+		if attempt >= n.config.MaxAttempts {
+			log.Error().Str("url", target).Str("type", notification.Type).Int("attempts", attempt).Str("err", err.Error()).Msg("cannot deliver notification")
+			return true
+		}
+		log.Debug().Str("url", target).Int("attempt", attempt).Str("err", err.Error()).Msg("webhook delivery failed")
+		select {
+		case <-time.After(backoff):
+		case <-n.stop:
+			return false
+		}
+		backoff = backoff * 2
+		if backoff > n.config.MaxBackoff {
+			backoff = n.config.MaxBackoff
+		}
+	}
+}
+
+func (n *Notifier) worker(target *endpoint) {
+	defer n.workers.Done()
+	for {
+		select {
+		case notification := <-target.notifications:
+			if !n.deliver(target.url, notification) {
+				return
+			}
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+// Run starts the delivery of notifications to each webhook.
+func (n *Notifier) Run() {
+	for _, target := range n.endpoints {
+		n.workers.Add(1)
+		go n.worker(target)
+	}
+}
+
+// Stop the delivery of notifications. Queued notifications are discarded.
+func (n *Notifier) Stop() {
+	close(n.stop)
+	n.workers.Wait()
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package notifier
+
+import (
+	"encoding/json"
+	"github.com/nalej/device-controller/pkg/liveness"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// receivedRequest with the headers and the body received by a test webhook.
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// testWebhook records the requests it receives and fails the first ones.
+type testWebhook struct {
+	mu       sync.Mutex
+	failures int
+	requests []receivedRequest
+}
+
+func (w *testWebhook) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.requests = append(w.requests, receivedRequest{header: request.Header, body: body})
+	if len(w.requests) <= w.failures {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (w *testWebhook) Requests() []receivedRequest {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]receivedRequest(nil), w.requests...)
+}
+
+var _ = ginkgo.Describe("Notifier", func() {
+
+	secret := []byte("secret")
+
+	testConfig := func(urls ...string) Config {
+		return Config{
+			URLs:           urls,
+			Secret:         secret,
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     5 * time.Millisecond,
+			Timeout:        time.Second,
+			QueueSize:      10,
+		}
+	}
+
+	table.DescribeTable("config validation",
+		func(update func(config *Config), valid bool) {
+			config := testConfig("http://localhost:8080/hook")
+			update(&config)
+			if valid {
+				gomega.Expect(config.Validate()).To(gomega.Succeed())
+			} else {
+				gomega.Expect(config.Validate()).NotTo(gomega.Succeed())
+			}
+		},
+		table.Entry("valid config", func(config *Config) {}, true),
+		table.Entry("no webhooks without secret", func(config *Config) { config.URLs = nil; config.Secret = nil }, true),
+		table.Entry("invalid scheme", func(config *Config) { config.URLs = []string{"ftp://localhost/hook"} }, false),
+		table.Entry("no host", func(config *Config) { config.URLs = []string{"http:///hook"} }, false),
+		table.Entry("no secret", func(config *Config) { config.Secret = nil }, false),
+		table.Entry("no attempts", func(config *Config) { config.MaxAttempts = 0 }, false),
+		table.Entry("max backoff lower than the initial one", func(config *Config) { config.MaxBackoff = 0 }, false),
+		table.Entry("no timeout", func(config *Config) { config.Timeout = 0 }, false),
+		table.Entry("no queue", func(config *Config) { config.QueueSize = 0 }, false),
+	)
+
+	ginkgo.It("should send signed notifications to every webhook", func() {
+		first, second := &testWebhook{}, &testWebhook{}
+		firstServer, secondServer := httptest.NewServer(first), httptest.NewServer(second)
+		defer firstServer.Close()
+		defer secondServer.Close()
+
+		notifier, err := NewNotifier(testConfig(firstServer.URL, secondServer.URL))
+		gomega.Expect(err).To(gomega.BeNil())
+		notifier.Run()
+		defer notifier.Stop()
+		notifier.DeviceStateChanged(liveness.Event{OrganizationId: "org", DeviceGroupId: "group", DeviceId: "device",
+			Previous: liveness.Online, Current: liveness.Stale})
+
+		for _, webhook := range []*testWebhook{first, second} {
+			gomega.Eventually(webhook.Requests).Should(gomega.HaveLen(1))
+			request := webhook.Requests()[0]
+			gomega.Expect(request.header.Get("Content-Type")).To(gomega.Equal("application/json"))
+			gomega.Expect(request.header.Get(EventHeader)).To(gomega.Equal(DeviceStateChanged))
+			gomega.Expect(request.header.Get(SignatureHeader)).To(gomega.Equal(
+				Sign(secret, request.header.Get(TimestampHeader), request.body)))
+
+			received := struct {
+				Type    string         `json:"type"`
+				Payload liveness.Event `json:"payload"`
+			}{}
+			gomega.Expect(json.Unmarshal(request.body, &received)).To(gomega.Succeed())
+			gomega.Expect(received.Type).To(gomega.Equal(DeviceStateChanged))
+			gomega.Expect(received.Payload.DeviceId).To(gomega.Equal("device"))
+			gomega.Expect(received.Payload.Current).To(gomega.Equal(liveness.Stale))
+		}
+	})
+
+	table.DescribeTable("delivery retries",
+		func(failures int, expectedRequests int) {
+			webhook := &testWebhook{failures: failures}
+			server := httptest.NewServer(webhook)
+			defer server.Close()
+
+			notifier, err := NewNotifier(testConfig(server.URL))
+			gomega.Expect(err).To(gomega.BeNil())
+			notifier.Run()
+			notifier.LatencyDegraded(Degradation{OrganizationId: "org", DeviceGroupId: "group", DeviceId: "device", Threshold: 100})
+			notifier.LatencyDegraded(Degradation{OrganizationId: "org", DeviceGroupId: "group", DeviceId: "other", Threshold: 100})
+			gomega.Eventually(webhook.Requests).Should(gomega.HaveLen(expectedRequests))
+			gomega.Consistently(webhook.Requests, 50*time.Millisecond).Should(gomega.HaveLen(expectedRequests))
+			notifier.Stop()
+		},
+		table.Entry("delivered at once", 0, 2),
+		table.Entry("delivered after retrying", 2, 4),
+		table.Entry("given up after the max attempts", 3, 4),
+	)
+
+	ginkgo.It("should drop the notifications when the queue of a webhook is full", func() {
+		webhook := &testWebhook{}
+		server := httptest.NewServer(webhook)
+		defer server.Close()
+
+		config := testConfig(server.URL)
+		config.QueueSize = 1
+		notifier, err := NewNotifier(config)
+		gomega.Expect(err).To(gomega.BeNil())
+		for i := 0; i < 3; i++ {
+			notifier.Notify(LatencyDegraded, Degradation{DeviceId: "device"})
+		}
+		notifier.Run()
+		gomega.Eventually(webhook.Requests).Should(gomega.HaveLen(1))
+		gomega.Consistently(webhook.Requests, 50*time.Millisecond).Should(gomega.HaveLen(1))
+		notifier.Stop()
+	})
+
+})
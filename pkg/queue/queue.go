@@ -0,0 +1,517 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PendingDir with the name of the directory that contains the entries waiting to be delivered.
+	PendingDir = "pending"
+	// DeadLetterDir with the name of the directory that contains the entries that could not be delivered.
+	DeadLetterDir = "deadletter"
+	// entryExtension with the extension of the files that store an entry.
+	entryExtension = ".json"
+	// tmpExtension with the extension of the files that store an entry while it is being written.
+	tmpExtension = ".tmp"
+	// idleWait with the time the dispatcher sleeps when there is nothing to deliver.
+	idleWait = time.Minute
+	// drainPoll with the time between two checks of the pending entries while draining.
+	drainPoll = 100 * time.Millisecond
+)
+
+// Config with the parameters of a durable queue.
+type Config struct {
+	// Path of the directory where the entries are persisted.
+	Path string
+	// MaxSize with the maximum number of entries waiting to be delivered.
+	MaxSize int
+	// MaxAttempts with the number of delivery attempts before an entry is moved to the dead letter directory.
+	MaxAttempts int
+	// InitialBackoff with the time to wait after the first failed delivery.
+	InitialBackoff time.Duration
+	// MaxBackoff with the maximum time to wait between two delivery attempts.
+	MaxBackoff time.Duration
+	// MaxBatchSize with the maximum number of entries delivered together.
+	MaxBatchSize int
+	// FlushInterval with the maximum time an entry waits for a batch to be filled.
+	FlushInterval time.Duration
+	// Workers with the number of batches that can be delivered concurrently.
+	Workers int
+}
+
+func (c *Config) Validate() derrors.Error {
+	if c.Path == "" {
+		return derrors.NewInvalidArgumentError("queue path must be set")
+	}
+	if c.MaxSize <= 0 {
+		return derrors.NewInvalidArgumentError("queue max size must be valid")
+	}
+	if c.MaxAttempts <= 0 {
+		return derrors.NewInvalidArgumentError("queue max attempts must be valid")
+	}
+	if c.InitialBackoff <= 0 || c.MaxBackoff < c.InitialBackoff {
+		return derrors.NewInvalidArgumentError("queue backoff must be valid")
+	}
+	if c.MaxBatchSize <= 0 {
+		return derrors.NewInvalidArgumentError("queue max batch size must be valid")
+	}
+	if c.FlushInterval <= 0 {
+		return derrors.NewInvalidArgumentError("queue flush interval must be valid")
+	}
+	if c.Workers <= 0 {
+		return derrors.NewInvalidArgumentError("queue workers must be valid")
+	}
+	return nil
+}
+
+// Entry with a payload waiting to be delivered.
+type Entry struct {
+	// Id of the entry. Entries are delivered in the lexicographic order of their identifiers.
+	Id string `json:"id"`
+	// Created with the time the entry was added to the queue.
+	Created time.Time `json:"created"`
+	// Attempts with the number of failed deliveries.
+	Attempts int `json:"attempts"`
+	// NextAttempt with the time after which the entry can be delivered again.
+	NextAttempt time.Time `json:"next_attempt"`
+	// LastError with the error returned by the last failed delivery.
+	LastError string `json:"last_error,omitempty"`
+	// Payload to be delivered.
+	Payload []byte `json:"payload"`
+	// inFlight is set while the entry is part of a batch being delivered.
+	inFlight bool
+}
+
+// Deliverer sends the payloads of a batch of queued entries to their destination.
+type Deliverer interface {
+	// Deliver the payloads returning the result of each one of them in the same order. A nil error
+	// means the payload has been delivered.
+	Deliver(payloads [][]byte) []derrors.Error
+}
+
+// Queue with a bounded list of payloads that are persisted to disk until they are delivered. Entries are
+// grouped in batches bounded by MaxBatchSize and FlushInterval, and the batches are delivered by a pool of
+// workers. Failed deliveries are retried with exponential backoff and moved to the dead letter directory
+// after MaxAttempts. The entries found on disk when the queue is created are replayed.
+type Queue struct {
+	config    Config
+	deliverer Deliverer
+	mu        sync.Mutex
+	pending   []*Entry
+	sequence  uint64
+	lastFlush time.Time
+	draining  bool
+	notify    chan struct{}
+	batches   chan []*Entry
+	workers   sync.WaitGroup
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewQueue creates a queue and loads the entries that were persisted by a previous execution.
+func NewQueue(config Config, deliverer Deliverer) (*Queue, derrors.Error) {
+	vErr := config.Validate()
+	if vErr != nil {
+		return nil, vErr
+	}
+	for _, dir := range []string{PendingDir, DeadLetterDir} {
+		err := os.MkdirAll(filepath.Join(config.Path, dir), 0700)
+		if err != nil {
+			return nil, derrors.AsError(err, "cannot create queue directory")
+		}
+	}
+	q := &Queue{
+		config:    config,
+		deliverer: deliverer,
+		pending:   make([]*Entry, 0),
+		sequence:  uint64(time.Now().UnixNano()),
+		notify:    make(chan struct{}, 1),
+		batches:   make(chan []*Entry),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	lErr := q.load()
+	if lErr != nil {
+		return nil, lErr
+	}
+	return q, nil
+}
+
+// load reads the pending entries from disk.
+func (q *Queue) load() derrors.Error {
+	files, err := ioutil.ReadDir(filepath.Join(q.config.Path, PendingDir))
+	if err != nil {
+		return derrors.AsError(err, "cannot read queue directory")
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), tmpExtension) {
+			// Left behind by a write interrupted before the rename, the entry was never reported as stored
+			_ = os.Remove(filepath.Join(q.config.Path, PendingDir, file.Name()))
+			continue
+		}
+		if file.IsDir() || !strings.HasSuffix(file.Name(), entryExtension) {
+			continue
+		}
+		entryPath := filepath.Join(q.config.Path, PendingDir, file.Name())
+		raw, err := ioutil.ReadFile(entryPath)
+		if err != nil {
+			return derrors.AsError(err, "cannot read queue entry")
+		}
+		entry := &Entry{}
+		err = json.Unmarshal(raw, entry)
+		if err != nil {
+			log.Warn().Str("path", entryPath).Str("err", err.Error()).Msg("moving corrupted queue entry to dead letter")
+			_ = os.Rename(entryPath, filepath.Join(q.config.Path, DeadLetterDir, file.Name()))
+			continue
+		}
+		if sequence, err := strconv.ParseUint(entry.Id, 10, 64); err == nil && sequence > q.sequence {
+			q.sequence = sequence
+		}
+		q.pending = append(q.pending, entry)
+	}
+	if len(q.pending) > 0 {
+		log.Info().Int("entries", len(q.pending)).Str("path", q.config.Path).Msg("replaying queue entries")
+	}
+	return nil
+}
+
+func (q *Queue) entryPath(dir string, entry *Entry) string {
+	return filepath.Join(q.config.Path, dir, entry.Id+entryExtension)
+}
+
+// persist writes the entry in the pending directory. The entry is written and synced to a temporary file
+// first, and the directory is synced after the rename, so that a crash never leaves a partial entry behind
+// nor loses an entry that was reported as stored.
+func (q *Queue) persist(entry *Entry) derrors.Error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return derrors.AsError(err, "cannot marshal queue entry")
+	}
+	target := q.entryPath(PendingDir, entry)
+	tmp := target + tmpExtension
+	err = writeSynced(tmp, raw)
+	if err != nil {
+		return derrors.AsError(err, "cannot write queue entry")
+	}
+	err = os.Rename(tmp, target)
+	if err != nil {
+		return derrors.AsError(err, "cannot write queue entry")
+	}
+	err = syncDir(filepath.Dir(target))
+	if err != nil {
+		return derrors.AsError(err, "cannot sync queue directory")
+	}
+	return nil
+}
+
+// writeSynced writes a file and flushes it to disk before closing it.
+func writeSynced(path string, raw []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(raw)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cErr := file.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// syncDir flushes the entries of a directory to disk, so that the files renamed into it survive a crash.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if cErr := dir.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// Push adds a new payload to the queue.
+func (q *Queue) Push(payload []byte) derrors.Error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.draining {
+		return derrors.NewUnavailableError("queue is draining")
+	}
+	if len(q.pending) >= q.config.MaxSize {
+		return derrors.NewUnavailableError(fmt.Sprintf("queue is full with %d entries", len(q.pending)))
+	}
+	q.sequence++
+	now := time.Now()
+	entry := &Entry{
+		Id:          fmt.Sprintf("%020d", q.sequence),
+		Created:     now,
+		NextAttempt: now,
+		Payload:     payload,
+	}
+	pErr := q.persist(entry)
+	if pErr != nil {
+		return pErr
+	}
+	q.pending = append(q.pending, entry)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Len returns the number of entries waiting to be delivered.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// nextBatch returns the oldest entries that can be delivered once the batch is full or the flush interval
+// has elapsed. Otherwise, it returns the time to wait until a batch may be available.
+func (q *Queue) nextBatch() ([]*Entry, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	wait := idleWait
+	batch := make([]*Entry, 0)
+	for _, entry := range q.pending {
+		if entry.inFlight {
+			continue
+		}
+		if !entry.NextAttempt.After(now) {
+			if len(batch) < q.config.MaxBatchSize {
+				batch = append(batch, entry)
+			}
+		} else if entry.NextAttempt.Sub(now) < wait {
+			wait = entry.NextAttempt.Sub(now)
+		}
+	}
+	if len(batch) == 0 {
+		return nil, wait
+	}
+	flushAt := q.lastFlush.Add(q.config.FlushInterval)
+	if len(batch) < q.config.MaxBatchSize && flushAt.After(now) && !q.draining {
+		return nil, flushAt.Sub(now)
+	}
+	for _, entry := range batch {
+		entry.inFlight = true
+	}
+	q.lastFlush = now
+	return batch, 0
+}
+
+// remove deletes an entry from the list of pending entries.
+func (q *Queue) remove(entry *Entry) {
+	for i, candidate := range q.pending {
+		if candidate == entry {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// backoff returns the time to wait before the next delivery attempt.
+func (q *Queue) backoff(attempts int) time.Duration {
+	backoff := q.config.InitialBackoff
+	for i := 1; i < attempts && backoff < q.config.MaxBackoff; i++ {
+		backoff = backoff * 2
+	}
+	if backoff > q.config.MaxBackoff {
+		return q.config.MaxBackoff
+	}
+	return backoff
+}
+
+// deliver sends a batch of entries and updates the queue with the results.
+func (q *Queue) deliver(batch []*Entry) {
+	payloads := make([][]byte, 0, len(batch))
+	for _, entry := range batch {
+		payloads = append(payloads, entry.Payload)
+	}
+	results := q.deliverer.Deliver(payloads)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, entry := range batch {
+		entry.inFlight = false
+		if i >= len(results) {
+			q.failed(entry, derrors.NewInternalError("missing delivery result"))
+		} else if results[i] != nil {
+			q.failed(entry, results[i])
+		} else {
+			q.delivered(entry)
+		}
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// delivered removes an entry that has reached its destination.
+func (q *Queue) delivered(entry *Entry) {
+	q.remove(entry)
+	err := os.Remove(q.entryPath(PendingDir, entry))
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn().Str("id", entry.Id).Str("err", err.Error()).Msg("cannot remove delivered queue entry")
+	}
+}
+
+// failed schedules the next attempt of an entry, or moves it to the dead letter directory.
+func (q *Queue) failed(entry *Entry, dErr derrors.Error) {
+	entry.Attempts++
+	entry.LastError = dErr.Error()
+	if entry.Attempts >= q.config.MaxAttempts {
+		q.remove(entry)
+		pErr := q.persist(entry)
+		if pErr == nil {
+			pErr = q.moveToDeadLetter(entry)
+		}
+		if pErr != nil {
+			log.Error().Str("id", entry.Id).Str("err", pErr.DebugReport()).Msg("cannot move queue entry to dead letter")
+		}
+		log.Warn().Str("id", entry.Id).Int("attempts", entry.Attempts).Str("err", dErr.Error()).Msg("queue entry moved to dead letter")
+		return
+	}
+	entry.NextAttempt = time.Now().Add(q.backoff(entry.Attempts))
+	pErr := q.persist(entry)
+	if pErr != nil {
+		log.Error().Str("id", entry.Id).Str("err", pErr.DebugReport()).Msg("cannot update queue entry")
+	}
+	log.Debug().Str("id", entry.Id).Int("attempts", entry.Attempts).Time("nextAttempt", entry.NextAttempt).Str("err", dErr.Error()).Msg("queue delivery failed")
+}
+
+func (q *Queue) moveToDeadLetter(entry *Entry) derrors.Error {
+	err := os.Rename(q.entryPath(PendingDir, entry), q.entryPath(DeadLetterDir, entry))
+	if err != nil {
+		return derrors.AsError(err, "cannot move queue entry")
+	}
+	err = syncDir(filepath.Join(q.config.Path, DeadLetterDir))
+	if err != nil {
+		return derrors.AsError(err, "cannot sync queue directory")
+	}
+	return nil
+}
+
+// worker delivers the batches produced by Run.
+func (q *Queue) worker() {
+	defer q.workers.Done()
+	for batch := range q.batches {
+		q.deliver(batch)
+	}
+}
+
+// Run delivers the pending entries until Stop is called.
+func (q *Queue) Run() {
+	defer close(q.done)
+	for i := 0; i < q.config.Workers; i++ {
+		q.workers.Add(1)
+		go q.worker()
+	}
+	defer func() {
+		close(q.batches)
+		q.workers.Wait()
+	}()
+	for {
+		batch, wait := q.nextBatch()
+		if batch != nil {
+			select {
+			case q.batches <- batch:
+				continue
+			case <-q.stop:
+				q.release(batch)
+				return
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-q.notify:
+		case <-timer.C:
+		case <-q.stop:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// release marks the entries of a batch that was not delivered as available.
+func (q *Queue) release(batch []*Entry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, entry := range batch {
+		entry.inFlight = false
+	}
+}
+
+// Stop the delivery of entries once the batches in progress are completed. Pending entries remain on disk
+// and are replayed by the next queue created on the same path.
+func (q *Queue) Stop() {
+	close(q.stop)
+	<-q.done
+}
+
+// Drain stops accepting new entries and delivers the pending ones without waiting for the batches to be
+// filled. Once the queue is empty or the timeout expires, the delivery is stopped as in Stop, waiting for
+// the batches in progress only until the timeout. It returns the number of entries that remain on disk.
+// Drain must be used instead of Stop, not after it.
+func (q *Queue) Drain(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	q.mu.Lock()
+	q.draining = true
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	ticker := time.NewTicker(drainPoll)
+	for q.Len() > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+	}
+	ticker.Stop()
+
+	close(q.stop)
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-q.done:
+	case <-timer.C:
+		log.Warn().Msg("queue deliveries still in progress after the drain timeout")
+	}
+	return q.Len()
+}
@@ -0,0 +1,312 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package queue
+
+import (
+	"fmt"
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// testDeliverer records the delivered batches and fails the payloads for which fail returns true. If release
+// is set, the deliveries wait until it is closed.
+type testDeliverer struct {
+	mu      sync.Mutex
+	batches [][]string
+	fail    func(payload string) bool
+	release chan struct{}
+	active  int
+}
+
+func (d *testDeliverer) Deliver(payloads [][]byte) []derrors.Error {
+	if d.release != nil {
+		d.mu.Lock()
+		d.active++
+		d.mu.Unlock()
+		<-d.release
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.release != nil {
+		d.active--
+	}
+	batch := make([]string, 0, len(payloads))
+	results := make([]derrors.Error, 0, len(payloads))
+	for _, payload := range payloads {
+		batch = append(batch, string(payload))
+		if d.fail != nil && d.fail(string(payload)) {
+			results = append(results, derrors.NewUnavailableError("cannot deliver"))
+		} else {
+			results = append(results, nil)
+		}
+	}
+	d.batches = append(d.batches, batch)
+	return results
+}
+
+// Batches returns the sizes of the delivered batches.
+func (d *testDeliverer) Batches() []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sizes := make([]int, 0, len(d.batches))
+	for _, batch := range d.batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
+
+// Active returns the number of deliveries waiting for the release.
+func (d *testDeliverer) Active() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.active
+}
+
+// Delivered returns the payloads that have been sent, including the failed ones.
+func (d *testDeliverer) Delivered() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delivered := make([]string, 0)
+	for _, batch := range d.batches {
+		delivered = append(delivered, batch...)
+	}
+	return delivered
+}
+
+func testConfig(path string) Config {
+	return Config{
+		Path:           path,
+		MaxSize:        10,
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		MaxBatchSize:   1,
+		FlushInterval:  time.Millisecond,
+		Workers:        1,
+	}
+}
+
+func entryFiles(path string, dir string) []string {
+	files, err := ioutil.ReadDir(filepath.Join(path, dir))
+	gomega.Expect(err).To(gomega.Succeed())
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	return names
+}
+
+var _ = ginkgo.Describe("Queue", func() {
+
+	var path string
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		path, err = ioutil.TempDir("", "queue")
+		gomega.Expect(err).To(gomega.Succeed())
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(os.RemoveAll(path)).To(gomega.Succeed())
+	})
+
+	table.DescribeTable("config validation",
+		func(modify func(config *Config)) {
+			config := testConfig(path)
+			modify(&config)
+			gomega.Expect(config.Validate()).NotTo(gomega.Succeed())
+			_, err := NewQueue(config, &testDeliverer{})
+			gomega.Expect(err).NotTo(gomega.Succeed())
+		},
+		table.Entry("empty path", func(config *Config) { config.Path = "" }),
+		table.Entry("zero max size", func(config *Config) { config.MaxSize = 0 }),
+		table.Entry("zero max attempts", func(config *Config) { config.MaxAttempts = 0 }),
+		table.Entry("zero initial backoff", func(config *Config) { config.InitialBackoff = 0 }),
+		table.Entry("max backoff below the initial one", func(config *Config) { config.MaxBackoff = 0 }),
+		table.Entry("zero batch size", func(config *Config) { config.MaxBatchSize = 0 }),
+		table.Entry("zero flush interval", func(config *Config) { config.FlushInterval = 0 }),
+		table.Entry("zero workers", func(config *Config) { config.Workers = 0 }),
+	)
+
+	ginkgo.It("should persist the pushed entries and replay them in order", func() {
+		q, err := NewQueue(testConfig(path), &testDeliverer{})
+		gomega.Expect(err).To(gomega.Succeed())
+		for i := 0; i < 3; i++ {
+			gomega.Expect(q.Push([]byte(fmt.Sprintf("payload-%d", i)))).To(gomega.Succeed())
+		}
+		gomega.Expect(entryFiles(path, PendingDir)).To(gomega.HaveLen(3))
+
+		deliverer := &testDeliverer{}
+		replayed, err := NewQueue(testConfig(path), deliverer)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(replayed.Len()).To(gomega.Equal(3))
+		gomega.Expect(replayed.Push([]byte("payload-3"))).To(gomega.Succeed())
+
+		go replayed.Run()
+		gomega.Eventually(replayed.Len).Should(gomega.Equal(0))
+		replayed.Stop()
+		gomega.Expect(deliverer.Delivered()).To(gomega.Equal([]string{"payload-0", "payload-1", "payload-2", "payload-3"}))
+		gomega.Expect(entryFiles(path, PendingDir)).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should reject new entries once it is full", func() {
+		config := testConfig(path)
+		config.MaxSize = 2
+		q, err := NewQueue(config, &testDeliverer{})
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(q.Push([]byte("a"))).To(gomega.Succeed())
+		gomega.Expect(q.Push([]byte("b"))).To(gomega.Succeed())
+		pErr := q.Push([]byte("c"))
+		gomega.Expect(pErr).NotTo(gomega.Succeed())
+		gomega.Expect(pErr.Type()).To(gomega.Equal(derrors.Unavailable))
+		gomega.Expect(q.Len()).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("should retry failed entries and move them to the dead letter directory", func() {
+		deliverer := &testDeliverer{fail: func(payload string) bool { return payload == "bad" }}
+		q, err := NewQueue(testConfig(path), deliverer)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(q.Push([]byte("bad"))).To(gomega.Succeed())
+		gomega.Expect(q.Push([]byte("good"))).To(gomega.Succeed())
+
+		go q.Run()
+		gomega.Eventually(q.Len).Should(gomega.Equal(0))
+		q.Stop()
+
+		gomega.Expect(deliverer.Delivered()).To(gomega.ConsistOf("bad", "bad", "bad", "good"))
+		gomega.Expect(entryFiles(path, PendingDir)).To(gomega.BeEmpty())
+		deadLetter := entryFiles(path, DeadLetterDir)
+		gomega.Expect(deadLetter).To(gomega.HaveLen(1))
+		raw, rErr := ioutil.ReadFile(filepath.Join(path, DeadLetterDir, deadLetter[0]))
+		gomega.Expect(rErr).To(gomega.Succeed())
+		gomega.Expect(string(raw)).To(gomega.ContainSubstring(`"attempts":3`))
+		gomega.Expect(string(raw)).To(gomega.ContainSubstring("cannot deliver"))
+	})
+
+	ginkgo.It("should move corrupted entries to the dead letter directory when loading", func() {
+		gomega.Expect(os.MkdirAll(filepath.Join(path, PendingDir), 0700)).To(gomega.Succeed())
+		corrupted := filepath.Join(path, PendingDir, "00000000000000000001"+entryExtension)
+		gomega.Expect(ioutil.WriteFile(corrupted, []byte("{"), 0600)).To(gomega.Succeed())
+
+		q, err := NewQueue(testConfig(path), &testDeliverer{})
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(q.Len()).To(gomega.Equal(0))
+		gomega.Expect(entryFiles(path, DeadLetterDir)).To(gomega.ConsistOf("00000000000000000001" + entryExtension))
+	})
+
+	ginkgo.It("should discard the entries whose write was interrupted when loading", func() {
+		gomega.Expect(os.MkdirAll(filepath.Join(path, PendingDir), 0700)).To(gomega.Succeed())
+		partial := filepath.Join(path, PendingDir, "00000000000000000001"+entryExtension+tmpExtension)
+		gomega.Expect(ioutil.WriteFile(partial, []byte(`{"id":`), 0600)).To(gomega.Succeed())
+
+		q, err := NewQueue(testConfig(path), &testDeliverer{})
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(q.Len()).To(gomega.Equal(0))
+		gomega.Expect(entryFiles(path, PendingDir)).To(gomega.BeEmpty())
+		gomega.Expect(entryFiles(path, DeadLetterDir)).To(gomega.BeEmpty())
+
+		gomega.Expect(q.Push([]byte("payload"))).To(gomega.Succeed())
+		files := entryFiles(path, PendingDir)
+		gomega.Expect(files).To(gomega.HaveLen(1))
+		gomega.Expect(files[0]).To(gomega.HaveSuffix(entryExtension))
+	})
+
+	ginkgo.It("should deliver full batches and keep a partial one until the flush interval", func() {
+		config := testConfig(path)
+		config.MaxBatchSize = 3
+		config.FlushInterval = time.Hour
+		deliverer := &testDeliverer{}
+		q, err := NewQueue(config, deliverer)
+		gomega.Expect(err).To(gomega.Succeed())
+		for i := 0; i < 7; i++ {
+			gomega.Expect(q.Push([]byte(fmt.Sprintf("payload-%d", i)))).To(gomega.Succeed())
+		}
+
+		go q.Run()
+		gomega.Eventually(q.Len).Should(gomega.Equal(1))
+		gomega.Consistently(q.Len, 100*time.Millisecond).Should(gomega.Equal(1))
+		q.Stop()
+		gomega.Expect(deliverer.Batches()).To(gomega.Equal([]int{3, 3}))
+		gomega.Expect(entryFiles(path, PendingDir)).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should deliver batches concurrently up to the number of workers", func() {
+		config := testConfig(path)
+		config.Workers = 2
+		deliverer := &testDeliverer{release: make(chan struct{})}
+		q, err := NewQueue(config, deliverer)
+		gomega.Expect(err).To(gomega.Succeed())
+		for i := 0; i < 3; i++ {
+			gomega.Expect(q.Push([]byte(fmt.Sprintf("payload-%d", i)))).To(gomega.Succeed())
+		}
+
+		go q.Run()
+		gomega.Eventually(deliverer.Active).Should(gomega.Equal(2))
+		gomega.Consistently(deliverer.Active, 100*time.Millisecond).Should(gomega.Equal(2))
+		close(deliverer.release)
+		gomega.Eventually(q.Len).Should(gomega.Equal(0))
+		q.Stop()
+		gomega.Expect(deliverer.Delivered()).To(gomega.ConsistOf("payload-0", "payload-1", "payload-2"))
+	})
+
+	ginkgo.It("should deliver the partial batches and reject new entries when draining", func() {
+		config := testConfig(path)
+		config.MaxBatchSize = 3
+		config.FlushInterval = time.Hour
+		deliverer := &testDeliverer{}
+		q, err := NewQueue(config, deliverer)
+		gomega.Expect(err).To(gomega.Succeed())
+		for i := 0; i < 4; i++ {
+			gomega.Expect(q.Push([]byte(fmt.Sprintf("payload-%d", i)))).To(gomega.Succeed())
+		}
+
+		go q.Run()
+		gomega.Eventually(q.Len).Should(gomega.Equal(1))
+		gomega.Expect(q.Drain(time.Second)).To(gomega.Equal(0))
+		gomega.Expect(deliverer.Batches()).To(gomega.Equal([]int{3, 1}))
+		gomega.Expect(entryFiles(path, PendingDir)).To(gomega.BeEmpty())
+		pErr := q.Push([]byte("payload-4"))
+		gomega.Expect(pErr).NotTo(gomega.Succeed())
+		gomega.Expect(pErr.Type()).To(gomega.Equal(derrors.Unavailable))
+	})
+
+	ginkgo.It("should keep the entries that are not delivered before the drain timeout", func() {
+		deliverer := &testDeliverer{release: make(chan struct{})}
+		q, err := NewQueue(testConfig(path), deliverer)
+		gomega.Expect(err).To(gomega.Succeed())
+		for i := 0; i < 3; i++ {
+			gomega.Expect(q.Push([]byte(fmt.Sprintf("payload-%d", i)))).To(gomega.Succeed())
+		}
+
+		go q.Run()
+		gomega.Eventually(deliverer.Active).Should(gomega.Equal(1))
+		start := time.Now()
+		gomega.Expect(q.Drain(100 * time.Millisecond)).To(gomega.Equal(3))
+		gomega.Expect(time.Since(start)).To(gomega.BeNumerically("<", time.Second))
+		close(deliverer.release)
+		gomega.Eventually(q.done).Should(gomega.BeClosed())
+		gomega.Expect(entryFiles(path, PendingDir)).To(gomega.HaveLen(2))
+	})
+
+})
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"github.com/nalej/device-controller/pkg/claims"
+	"github.com/nalej/device-controller/pkg/metrics"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpc_status "google.golang.org/grpc/status"
+	"math"
+	"strconv"
+)
+
+// RetryAfterKey with the response header that contains the seconds to wait before sending another request.
+const RetryAfterKey = "retry-after"
+
+// deviceRequest is implemented by the requests that contain the ids of the device.
+type deviceRequest interface {
+	GetOrganizationId() string
+	GetDeviceGroupId() string
+	GetDeviceId() string
+}
+
+// deviceIdentity returns the ids of the device that sent a request, from the claims of its token or, if there
+// are none, from the request itself.
+func deviceIdentity(ctx context.Context, req interface{}) (string, string, string, bool) {
+	deviceClaims, err := claims.FromContext(ctx)
+	if err == nil {
+		return deviceClaims.OrganizationId, deviceClaims.DeviceGroupId, deviceClaims.DeviceId, true
+	}
+	request, ok := req.(deviceRequest)
+	if !ok || request.GetOrganizationId() == "" || request.GetDeviceId() == "" {
+		return "", "", "", false
+	}
+	return request.GetOrganizationId(), request.GetDeviceGroupId(), request.GetDeviceId(), true
+}
+
+// UnaryServerInterceptor rejects the requests of the devices that exceed their limit with ResourceExhausted,
+// setting the retry-after header. Only the given methods are limited, or all of them if none is given.
+func (l *Limiter) UnaryServerInterceptor(methods ...string) grpc.UnaryServerInterceptor {
+	limited := make(map[string]bool, len(methods))
+	for _, method := range methods {
+		limited[method] = true
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if len(limited) > 0 && !limited[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		organizationID, deviceGroupID, deviceID, found := deviceIdentity(ctx, req)
+		if !found {
+			return handler(ctx, req)
+		}
+		allowed, wait := l.Allow(organizationID, deviceGroupID, deviceID)
+		if allowed {
+			return handler(ctx, req)
+		}
+		retryAfter := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+		if err := grpc.SetHeader(ctx, metadata.Pairs(RetryAfterKey, retryAfter)); err != nil {
+			log.Debug().Err(err).Msg("cannot set retry-after header")
+		}
+		metrics.RateLimited.WithLabelValues(organizationID, info.FullMethod).Inc()
+		log.Debug().Str("organizationId", organizationID).Str("deviceGroupId", deviceGroupID).Str("deviceId", deviceID).
+			Str("method", info.FullMethod).Str("retryAfter", retryAfter).Msg("rate limit exceeded")
+		return nil, grpc_status.Error(codes.ResourceExhausted, fmt.Sprintf("rate limit exceeded, retry after %s seconds", retryAfter))
+	}
+}
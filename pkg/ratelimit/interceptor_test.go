@@ -0,0 +1,170 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimit
+
+import (
+	"context"
+	"github.com/nalej/device-controller/pkg/claims"
+	"github.com/nalej/grpc-common-go"
+	"github.com/nalej/grpc-device-controller-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpc_status "google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"strconv"
+)
+
+const (
+	registerLatencyMethod = "/device_controller.Connection/RegisterLatency"
+	selectClusterMethod   = "/device_controller.Connection/SelectCluster"
+)
+
+// connectionServer answers every request of the devices.
+type connectionServer struct{}
+
+func (s *connectionServer) Ping(context.Context, *grpc_common_go.Empty) (*grpc_common_go.Success, error) {
+	return &grpc_common_go.Success{}, nil
+}
+
+func (s *connectionServer) RegisterLatency(context.Context, *grpc_device_controller_go.RegisterLatencyRequest) (*grpc_device_controller_go.RegisterLatencyResult, error) {
+	return &grpc_device_controller_go.RegisterLatencyResult{}, nil
+}
+
+func (s *connectionServer) SelectCluster(context.Context, *grpc_device_controller_go.SelectClusterRequest) (*grpc_device_controller_go.SelectedCluster, error) {
+	return &grpc_device_controller_go.SelectedCluster{}, nil
+}
+
+// withClaims returns a context with the claims that the device authx interceptor would add.
+func withClaims(organizationID string, deviceID string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(),
+		claims.OrganizationIdKey, organizationID, claims.DeviceGroupIdKey, "group", claims.DeviceIdKey, deviceID)
+}
+
+var _ = ginkgo.Describe("Interceptor", func() {
+
+	var limiter *Limiter
+	var listener *bufconn.Listener
+	var server *grpc.Server
+	var conn *grpc.ClientConn
+	var client grpc_device_controller_go.ConnectionClient
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		limiter, err = NewLimiter(Limit{Rate: 0.1, Burst: 2})
+		gomega.Expect(err).To(gomega.Succeed())
+		listener = bufconn.Listen(1024 * 1024)
+		server = grpc.NewServer(grpc.UnaryInterceptor(limiter.UnaryServerInterceptor(registerLatencyMethod, selectClusterMethod)))
+		grpc_device_controller_go.RegisterConnectionServer(server, &connectionServer{})
+		go func(server *grpc.Server, listener net.Listener) {
+			_ = server.Serve(listener)
+		}(server, listener)
+		conn, err = grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.Dial()
+		}))
+		gomega.Expect(err).To(gomega.Succeed())
+		client = grpc_device_controller_go.NewConnectionClient(conn)
+	})
+
+	ginkgo.AfterEach(func() {
+		_ = conn.Close()
+		server.Stop()
+	})
+
+	registerLatency := func(ctx context.Context, header *metadata.MD) error {
+		_, err := client.RegisterLatency(ctx, &grpc_device_controller_go.RegisterLatencyRequest{
+			OrganizationId: "org", DeviceGroupId: "group", DeviceId: "device", Latency: 10}, grpc.Header(header))
+		return err
+	}
+
+	// expectExhausted checks that a request was rejected and that the client was told when to retry.
+	expectExhausted := func(err error, header metadata.MD) {
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(grpc_status.Code(err)).To(gomega.Equal(codes.ResourceExhausted))
+		gomega.Expect(header.Get(RetryAfterKey)).To(gomega.HaveLen(1))
+		seconds, err := strconv.Atoi(header.Get(RetryAfterKey)[0])
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(seconds).To(gomega.BeNumerically(">=", 1))
+		gomega.Expect(seconds).To(gomega.BeNumerically("<=", 10))
+	}
+
+	ginkgo.It("should reject the requests over the limit with the retry-after header", func() {
+		ctx := withClaims("org", "device")
+		for i := 0; i < 2; i++ {
+			var header metadata.MD
+			gomega.Expect(registerLatency(ctx, &header)).To(gomega.Succeed())
+			gomega.Expect(header.Get(RetryAfterKey)).To(gomega.BeEmpty())
+		}
+		var header metadata.MD
+		expectExhausted(registerLatency(ctx, &header), header)
+	})
+
+	ginkgo.It("should share the bucket of a device between the limited methods", func() {
+		ctx := withClaims("org", "device")
+		gomega.Expect(registerLatency(ctx, &metadata.MD{})).To(gomega.Succeed())
+		_, err := client.SelectCluster(ctx, &grpc_device_controller_go.SelectClusterRequest{
+			OrganizationId: "org", DeviceGroupId: "group", DeviceId: "device", Latencies: []int32{10}})
+		gomega.Expect(err).To(gomega.Succeed())
+		var header metadata.MD
+		_, err = client.SelectCluster(ctx, &grpc_device_controller_go.SelectClusterRequest{
+			OrganizationId: "org", DeviceGroupId: "group", DeviceId: "device", Latencies: []int32{10}}, grpc.Header(&header))
+		expectExhausted(err, header)
+	})
+
+	ginkgo.It("should not limit the methods that are not given", func() {
+		ctx := withClaims("org", "device")
+		for i := 0; i < 5; i++ {
+			_, err := client.Ping(ctx, &grpc_common_go.Empty{})
+			gomega.Expect(err).To(gomega.Succeed())
+		}
+	})
+
+	ginkgo.It("should identify the device from the request when there are no claims", func() {
+		for i := 0; i < 2; i++ {
+			gomega.Expect(registerLatency(context.Background(), &metadata.MD{})).To(gomega.Succeed())
+		}
+		var header metadata.MD
+		expectExhausted(registerLatency(context.Background(), &header), header)
+	})
+
+	table.DescribeTable("per organization limits after an update",
+		func(organizationID string, allowed int) {
+			err := limiter.Update(&PolicyFile{Organizations: []OrganizationPolicy{
+				{OrganizationId: "limited", Limit: Limit{Rate: 0.1, Burst: 1}},
+				{OrganizationId: "premium", Limit: Limit{Rate: 0.1, Burst: 4}},
+				{OrganizationId: "unlimited", Limit: Limit{Rate: 0}},
+			}})
+			gomega.Expect(err).To(gomega.Succeed())
+			ctx := withClaims(organizationID, "device")
+			for i := 0; i < allowed; i++ {
+				gomega.Expect(registerLatency(ctx, &metadata.MD{})).To(gomega.Succeed())
+			}
+			if allowed < 10 {
+				var header metadata.MD
+				expectExhausted(registerLatency(ctx, &header), header)
+			}
+		},
+		table.Entry("organization with a lower limit", "limited", 1),
+		table.Entry("organization with a higher limit", "premium", 4),
+		table.Entry("organization without limit", "unlimited", 10),
+		table.Entry("organization with the default limit", "other", 2),
+	)
+})
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nalej/derrors"
+	"io/ioutil"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultIdleTimeout with the time after which the bucket of a device that does not send requests is discarded.
+const DefaultIdleTimeout = 10 * time.Minute
+
+// Limit of the requests of a device. The bucket of a device is refilled at Rate tokens per second up to Burst
+// tokens, and each request takes one token. A zero rate disables the limit.
+type Limit struct {
+	// Rate with the requests per second allowed on average.
+	Rate float64 `json:"rate"`
+	// Burst with the requests allowed at once.
+	Burst int `json:"burst"`
+}
+
+func (l *Limit) Validate() derrors.Error {
+	if l.Rate < 0 {
+		return derrors.NewInvalidArgumentError("rate limit cannot be negative")
+	}
+	if l.Rate > 0 && l.Burst <= 0 {
+		return derrors.NewInvalidArgumentError("rate limit burst must be greater than zero")
+	}
+	return nil
+}
+
+// OrganizationPolicy with the limit of the devices of an organization.
+type OrganizationPolicy struct {
+	Limit
+	// OrganizationId of the policy.
+	OrganizationId string `json:"organization_id"`
+}
+
+// PolicyFile with the content of a file of rate limit policies.
+type PolicyFile struct {
+	// Default limit. If not set, the limit given on the command line is used.
+	Default *Limit `json:"default,omitempty"`
+	// Organizations with the limits of specific organizations.
+	Organizations []OrganizationPolicy `json:"organizations"`
+}
+
+// LoadPolicyFile reads a file of rate limit policies.
+func LoadPolicyFile(path string) (*PolicyFile, derrors.Error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot read rate limit policy file")
+	}
+	policyFile := &PolicyFile{}
+	err = json.Unmarshal(raw, policyFile)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot parse rate limit policy file")
+	}
+	return policyFile, nil
+}
+
+// limitSet is an immutable view of the limits in use.
+type limitSet struct {
+	defaultLimit  Limit
+	organizations map[string]Limit
+}
+
+// bucket with the tokens available to a device.
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// Limiter keeps a token bucket per device.
+type Limiter struct {
+	defaultLimit Limit
+	current      atomic.Value
+	idleTimeout  time.Duration
+	mu           sync.Mutex
+	buckets      map[string]*bucket
+	lastExpire   time.Time
+}
+
+// NewLimiter creates a limiter that applies the given limit to every organization.
+func NewLimiter(defaultLimit Limit) (*Limiter, derrors.Error) {
+	err := defaultLimit.Validate()
+	if err != nil {
+		return nil, err
+	}
+	limiter := &Limiter{
+		defaultLimit: defaultLimit,
+		idleTimeout:  DefaultIdleTimeout,
+		buckets:      make(map[string]*bucket, 0),
+		lastExpire:   time.Now(),
+	}
+	limiter.current.Store(&limitSet{defaultLimit: defaultLimit, organizations: make(map[string]Limit, 0)})
+	return limiter, nil
+}
+
+// Update replaces the limits in use. If the policies are not valid, the current limits are kept.
+func (l *Limiter) Update(policyFile *PolicyFile) derrors.Error {
+	defaultLimit := l.defaultLimit
+	if policyFile.Default != nil {
+		defaultLimit = *policyFile.Default
+	}
+	err := defaultLimit.Validate()
+	if err != nil {
+		return err
+	}
+	set := &limitSet{
+		defaultLimit:  defaultLimit,
+		organizations: make(map[string]Limit, len(policyFile.Organizations)),
+	}
+	for _, policy := range policyFile.Organizations {
+		if policy.OrganizationId == "" {
+			return derrors.NewInvalidArgumentError("organization_id cannot be empty")
+		}
+		if _, exists := set.organizations[policy.OrganizationId]; exists {
+			return derrors.NewInvalidArgumentError(fmt.Sprintf("duplicated policy for %s", policy.OrganizationId))
+		}
+		err = policy.Limit.Validate()
+		if err != nil {
+			return err
+		}
+		set.organizations[policy.OrganizationId] = policy.Limit
+	}
+	l.current.Store(set)
+	return nil
+}
+
+// GetLimit returns the limit of the devices of an organization.
+func (l *Limiter) GetLimit(organizationID string) Limit {
+	set := l.current.Load().(*limitSet)
+	if limit, exists := set.organizations[organizationID]; exists {
+		return limit
+	}
+	return set.defaultLimit
+}
+
+// Allow takes a token from the bucket of a device. If there are no tokens left, it returns false and the time
+// until the next token is available.
+func (l *Limiter) Allow(organizationID string, deviceGroupID string, deviceID string) (bool, time.Duration) {
+	limit := l.GetLimit(organizationID)
+	if limit.Rate == 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.expire(now)
+
+	key := fmt.Sprintf("%s/%s/%s", organizationID, deviceGroupID, deviceID)
+	deviceBucket, exists := l.buckets[key]
+	if !exists {
+		deviceBucket = &bucket{tokens: float64(limit.Burst), lastSeen: now}
+		l.buckets[key] = deviceBucket
+	}
+	elapsed := now.Sub(deviceBucket.lastSeen).Seconds()
+	deviceBucket.tokens = math.Min(float64(limit.Burst), deviceBucket.tokens+elapsed*limit.Rate)
+	deviceBucket.lastSeen = now
+	if deviceBucket.tokens < 1 {
+		wait := time.Duration((1 - deviceBucket.tokens) / limit.Rate * float64(time.Second))
+		return false, wait
+	}
+	deviceBucket.tokens--
+	return true, 0
+}
+
+// expire discards the buckets of the devices that have not sent requests recently.
+func (l *Limiter) expire(now time.Time) {
+	if now.Sub(l.lastExpire) < l.idleTimeout {
+		return
+	}
+	l.lastExpire = now
+	for key, deviceBucket := range l.buckets {
+		if now.Sub(deviceBucket.lastSeen) > l.idleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimit
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = ginkgo.Describe("Limiter", func() {
+
+	table.DescribeTable("limit validation",
+		func(limit Limit, valid bool) {
+			err := limit.Validate()
+			if valid {
+				gomega.Expect(err).To(gomega.Succeed())
+			} else {
+				gomega.Expect(err).To(gomega.HaveOccurred())
+			}
+		},
+		table.Entry("disabled limit", Limit{Rate: 0, Burst: 0}, true),
+		table.Entry("rate with burst", Limit{Rate: 1, Burst: 5}, true),
+		table.Entry("negative rate", Limit{Rate: -1, Burst: 5}, false),
+		table.Entry("rate without burst", Limit{Rate: 1, Burst: 0}, false),
+		table.Entry("negative burst", Limit{Rate: 1, Burst: -1}, false),
+	)
+
+	ginkgo.It("should reject an invalid default limit", func() {
+		_, err := NewLimiter(Limit{Rate: -1})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	table.DescribeTable("requests allowed at once",
+		func(limit Limit, requests int, allowed int) {
+			limiter, err := NewLimiter(limit)
+			gomega.Expect(err).To(gomega.Succeed())
+			count := 0
+			for i := 0; i < requests; i++ {
+				if ok, _ := limiter.Allow("org", "group", "device"); ok {
+					count++
+				}
+			}
+			gomega.Expect(count).To(gomega.Equal(allowed))
+		},
+		table.Entry("disabled limit", Limit{Rate: 0, Burst: 0}, 10, 10),
+		table.Entry("burst of one", Limit{Rate: 0.1, Burst: 1}, 10, 1),
+		table.Entry("burst of three", Limit{Rate: 0.1, Burst: 3}, 10, 3),
+		table.Entry("burst over the requests", Limit{Rate: 0.1, Burst: 20}, 10, 10),
+	)
+
+	ginkgo.It("should keep a bucket per device", func() {
+		limiter, err := NewLimiter(Limit{Rate: 0.1, Burst: 1})
+		gomega.Expect(err).To(gomega.Succeed())
+		for _, device := range []string{"device1", "device2", "device3"} {
+			allowed, _ := limiter.Allow("org", "group", device)
+			gomega.Expect(allowed).To(gomega.BeTrue())
+		}
+		allowed, _ := limiter.Allow("org", "group", "device1")
+		gomega.Expect(allowed).To(gomega.BeFalse())
+		allowed, _ = limiter.Allow("org", "other-group", "device1")
+		gomega.Expect(allowed).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should return the time until the next token", func() {
+		limiter, err := NewLimiter(Limit{Rate: 0.5, Burst: 1})
+		gomega.Expect(err).To(gomega.Succeed())
+		allowed, wait := limiter.Allow("org", "group", "device")
+		gomega.Expect(allowed).To(gomega.BeTrue())
+		gomega.Expect(wait).To(gomega.BeZero())
+		allowed, wait = limiter.Allow("org", "group", "device")
+		gomega.Expect(allowed).To(gomega.BeFalse())
+		gomega.Expect(wait).To(gomega.BeNumerically(">", time.Second))
+		gomega.Expect(wait).To(gomega.BeNumerically("<=", 2*time.Second))
+	})
+
+	ginkgo.It("should refill the bucket over time", func() {
+		limiter, err := NewLimiter(Limit{Rate: 20, Burst: 1})
+		gomega.Expect(err).To(gomega.Succeed())
+		allowed, _ := limiter.Allow("org", "group", "device")
+		gomega.Expect(allowed).To(gomega.BeTrue())
+		allowed, wait := limiter.Allow("org", "group", "device")
+		gomega.Expect(allowed).To(gomega.BeFalse())
+		time.Sleep(wait)
+		allowed, _ = limiter.Allow("org", "group", "device")
+		gomega.Expect(allowed).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should discard the buckets of idle devices", func() {
+		limiter, err := NewLimiter(Limit{Rate: 0.1, Burst: 1})
+		gomega.Expect(err).To(gomega.Succeed())
+		limiter.idleTimeout = 10 * time.Millisecond
+		allowed, _ := limiter.Allow("org", "group", "device")
+		gomega.Expect(allowed).To(gomega.BeTrue())
+		time.Sleep(20 * time.Millisecond)
+		allowed, _ = limiter.Allow("org", "group", "other")
+		gomega.Expect(allowed).To(gomega.BeTrue())
+		gomega.Expect(limiter.buckets).To(gomega.HaveLen(1))
+		gomega.Expect(limiter.buckets).To(gomega.HaveKey("org/group/other"))
+	})
+
+	ginkgo.Context("with policies", func() {
+
+		var limiter *Limiter
+
+		ginkgo.BeforeEach(func() {
+			var err error
+			limiter, err = NewLimiter(Limit{Rate: 1, Burst: 5})
+			gomega.Expect(err).To(gomega.Succeed())
+		})
+
+		ginkgo.It("should apply the limit of each organization", func() {
+			err := limiter.Update(&PolicyFile{Organizations: []OrganizationPolicy{
+				{OrganizationId: "limited", Limit: Limit{Rate: 0.1, Burst: 1}},
+				{OrganizationId: "unlimited", Limit: Limit{Rate: 0}},
+			}})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(limiter.GetLimit("limited")).To(gomega.Equal(Limit{Rate: 0.1, Burst: 1}))
+			gomega.Expect(limiter.GetLimit("unlimited")).To(gomega.Equal(Limit{Rate: 0}))
+			gomega.Expect(limiter.GetLimit("other")).To(gomega.Equal(Limit{Rate: 1, Burst: 5}))
+
+			allowed, _ := limiter.Allow("limited", "group", "device")
+			gomega.Expect(allowed).To(gomega.BeTrue())
+			allowed, _ = limiter.Allow("limited", "group", "device")
+			gomega.Expect(allowed).To(gomega.BeFalse())
+			for i := 0; i < 10; i++ {
+				allowed, _ = limiter.Allow("unlimited", "group", "device")
+				gomega.Expect(allowed).To(gomega.BeTrue())
+			}
+		})
+
+		ginkgo.It("should replace the default limit", func() {
+			err := limiter.Update(&PolicyFile{Default: &Limit{Rate: 2, Burst: 10}})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(limiter.GetLimit("other")).To(gomega.Equal(Limit{Rate: 2, Burst: 10}))
+		})
+
+		ginkgo.It("should go back to the command line limit when the policies are removed", func() {
+			err := limiter.Update(&PolicyFile{Default: &Limit{Rate: 2, Burst: 10},
+				Organizations: []OrganizationPolicy{{OrganizationId: "limited", Limit: Limit{Rate: 0.1, Burst: 1}}}})
+			gomega.Expect(err).To(gomega.Succeed())
+			err = limiter.Update(&PolicyFile{})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(limiter.GetLimit("limited")).To(gomega.Equal(Limit{Rate: 1, Burst: 5}))
+			gomega.Expect(limiter.GetLimit("other")).To(gomega.Equal(Limit{Rate: 1, Burst: 5}))
+		})
+
+		table.DescribeTable("invalid policies keep the current limits",
+			func(policyFile *PolicyFile) {
+				err := limiter.Update(&PolicyFile{Organizations: []OrganizationPolicy{
+					{OrganizationId: "limited", Limit: Limit{Rate: 0.1, Burst: 1}},
+				}})
+				gomega.Expect(err).To(gomega.Succeed())
+				err = limiter.Update(policyFile)
+				gomega.Expect(err).To(gomega.HaveOccurred())
+				gomega.Expect(limiter.GetLimit("limited")).To(gomega.Equal(Limit{Rate: 0.1, Burst: 1}))
+				gomega.Expect(limiter.GetLimit("other")).To(gomega.Equal(Limit{Rate: 1, Burst: 5}))
+			},
+			table.Entry("invalid default", &PolicyFile{Default: &Limit{Rate: 1, Burst: 0}}),
+			table.Entry("empty organization", &PolicyFile{Organizations: []OrganizationPolicy{
+				{OrganizationId: "", Limit: Limit{Rate: 1, Burst: 1}},
+			}}),
+			table.Entry("duplicated organization", &PolicyFile{Organizations: []OrganizationPolicy{
+				{OrganizationId: "org", Limit: Limit{Rate: 1, Burst: 1}},
+				{OrganizationId: "org", Limit: Limit{Rate: 2, Burst: 2}},
+			}}),
+			table.Entry("invalid organization limit", &PolicyFile{Organizations: []OrganizationPolicy{
+				{OrganizationId: "org", Limit: Limit{Rate: -1, Burst: 1}},
+			}}),
+		)
+	})
+
+	ginkgo.Context("policy files", func() {
+
+		var dir string
+
+		ginkgo.BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "ratelimit")
+			gomega.Expect(err).To(gomega.Succeed())
+		})
+
+		ginkgo.AfterEach(func() {
+			_ = os.RemoveAll(dir)
+		})
+
+		table.DescribeTable("loading",
+			func(content string, valid bool, expected *PolicyFile) {
+				path := filepath.Join(dir, "policies.json")
+				gomega.Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(gomega.Succeed())
+				policyFile, err := LoadPolicyFile(path)
+				if !valid {
+					gomega.Expect(err).To(gomega.HaveOccurred())
+					return
+				}
+				gomega.Expect(err).To(gomega.Succeed())
+				gomega.Expect(policyFile).To(gomega.Equal(expected))
+			},
+			table.Entry("organizations", `{"organizations": [{"organization_id": "org", "rate": 0.5, "burst": 2}]}`, true,
+				&PolicyFile{Organizations: []OrganizationPolicy{{OrganizationId: "org", Limit: Limit{Rate: 0.5, Burst: 2}}}}),
+			table.Entry("default", `{"default": {"rate": 3, "burst": 6}, "organizations": []}`, true,
+				&PolicyFile{Default: &Limit{Rate: 3, Burst: 6}, Organizations: []OrganizationPolicy{}}),
+			table.Entry("invalid JSON", `{"organizations": [`, false, nil),
+		)
+
+		ginkgo.It("should fail if the file does not exist", func() {
+			_, err := LoadPolicyFile(filepath.Join(dir, "missing.json"))
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package reload
+
+import (
+	"crypto/sha256"
+	"github.com/fsnotify/fsnotify"
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultDebounce with the time the watcher waits for a burst of file events to finish.
+const DefaultDebounce = 500 * time.Millisecond
+
+// ReloadFunc reads, validates and applies the content of a file. If an error is returned, the running
+// configuration must be left untouched.
+type ReloadFunc func() derrors.Error
+
+// watchedFile with a file and the functions to call when its content changes.
+type watchedFile struct {
+	path    string
+	digest  [sha256.Size]byte
+	reloads []ReloadFunc
+}
+
+// Watcher calls the registered reload functions when the content of a file changes or when the process
+// receives SIGHUP. The parent directories are watched instead of the files so that the atomic symlink swap
+// used by Kubernetes to update mounted config maps and secrets is detected.
+type Watcher struct {
+	mu       sync.Mutex
+	files    map[string]*watchedFile
+	watcher  *fsnotify.Watcher
+	signals  chan os.Signal
+	debounce time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewWatcher creates a watcher with no files.
+func NewWatcher() (*Watcher, derrors.Error) {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot create file watcher")
+	}
+	return &Watcher{
+		files:    make(map[string]*watchedFile, 0),
+		watcher:  fsWatcher,
+		signals:  make(chan os.Signal, 1),
+		debounce: DefaultDebounce,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+func fileDigest(path string) [sha256.Size]byte {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}
+	}
+	return sha256.Sum256(raw)
+}
+
+// Add registers a function to be called when the content of a file changes.
+func (w *Watcher) Add(path string, reload ReloadFunc) derrors.Error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return derrors.AsError(err, "cannot resolve watched file path")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	file, exists := w.files[absPath]
+	if !exists {
+		err = w.watcher.Add(filepath.Dir(absPath))
+		if err != nil {
+			return derrors.AsError(err, "cannot watch file")
+		}
+		file = &watchedFile{path: absPath, digest: fileDigest(absPath)}
+		w.files[absPath] = file
+	}
+	file.reloads = append(file.reloads, reload)
+	log.Debug().Str("path", absPath).Msg("watching file")
+	return nil
+}
+
+// check reloads the files whose content has changed. If force is set, all files are reloaded.
+func (w *Watcher) check(force bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, file := range w.files {
+		digest := fileDigest(file.path)
+		if !force && digest == file.digest {
+			continue
+		}
+		log.Info().Str("path", file.path).Msg("reloading file")
+		reloaded := true
+		for _, reload := range file.reloads {
+			rErr := reload()
+			if rErr != nil {
+				reloaded = false
+				log.Error().Str("path", file.path).Str("err", rErr.DebugReport()).Msg("cannot reload file, keeping current configuration")
+			}
+		}
+		if reloaded {
+			file.digest = digest
+		}
+	}
+}
+
+// Run waits for file events and signals until Stop is called.
+func (w *Watcher) Run() {
+	defer close(w.done)
+	signal.Notify(w.signals, syscall.SIGHUP)
+	defer signal.Stop(w.signals)
+
+	var pending <-chan time.Time
+	for {
+		select {
+		case event := <-w.watcher.Events:
+			log.Debug().Str("file", event.Name).Str("op", event.Op.String()).Msg("file event")
+			if pending == nil {
+				pending = time.After(w.debounce)
+			}
+		case err := <-w.watcher.Errors:
+			log.Warn().Err(err).Msg("file watcher error")
+		case <-pending:
+			pending = nil
+			w.check(false)
+		case <-w.signals:
+			log.Info().Msg("SIGHUP received")
+			w.check(true)
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Stop watching files.
+func (w *Watcher) Stop() {
+	close(w.stop)
+	<-w.done
+	_ = w.watcher.Close()
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package reload
+
+import (
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// testReload records the content of a file each time it is reloaded.
+type testReload struct {
+	mu       sync.Mutex
+	path     string
+	fail     bool
+	contents []string
+}
+
+func (r *testReload) reload() derrors.Error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	raw, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return derrors.AsError(err, "cannot read file")
+	}
+	r.contents = append(r.contents, string(raw))
+	if r.fail {
+		return derrors.NewInvalidArgumentError("invalid content")
+	}
+	return nil
+}
+
+func (r *testReload) setFail(fail bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fail = fail
+}
+
+func (r *testReload) Contents() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.contents...)
+}
+
+func writeFile(path string, content string) {
+	gomega.Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(gomega.Succeed())
+}
+
+var _ = ginkgo.Describe("Watcher", func() {
+
+	var dir string
+	var path string
+	var watcher *Watcher
+	var reloaded *testReload
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "reload")
+		gomega.Expect(err).To(gomega.Succeed())
+		path = filepath.Join(dir, "config.json")
+		writeFile(path, "initial")
+		var wErr derrors.Error
+		watcher, wErr = NewWatcher()
+		gomega.Expect(wErr).To(gomega.BeNil())
+		watcher.debounce = 10 * time.Millisecond
+		reloaded = &testReload{path: path}
+		gomega.Expect(watcher.Add(path, reloaded.reload)).To(gomega.BeNil())
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+	})
+
+	ginkgo.Context("checking the files", func() {
+
+		ginkgo.AfterEach(func() {
+			_ = watcher.watcher.Close()
+		})
+
+		table.DescribeTable("reloads",
+			func(content string, force bool, expected []string) {
+				writeFile(path, content)
+				watcher.check(force)
+				gomega.Expect(reloaded.Contents()).To(gomega.Equal(expected))
+			},
+			table.Entry("changed content", "changed", false, []string{"changed"}),
+			table.Entry("same content", "initial", false, []string{}),
+			table.Entry("same content when forced", "initial", true, []string{"initial"}),
+		)
+
+		ginkgo.It("should call every function registered for a file", func() {
+			other := &testReload{path: path}
+			gomega.Expect(watcher.Add(path, other.reload)).To(gomega.BeNil())
+			writeFile(path, "changed")
+			watcher.check(false)
+			gomega.Expect(reloaded.Contents()).To(gomega.Equal([]string{"changed"}))
+			gomega.Expect(other.Contents()).To(gomega.Equal([]string{"changed"}))
+		})
+
+		ginkgo.It("should retry a failed reload on the next check", func() {
+			reloaded.setFail(true)
+			writeFile(path, "invalid")
+			watcher.check(false)
+			watcher.check(false)
+			gomega.Expect(reloaded.Contents()).To(gomega.Equal([]string{"invalid", "invalid"}))
+
+			reloaded.setFail(false)
+			writeFile(path, "fixed")
+			watcher.check(false)
+			watcher.check(false)
+			gomega.Expect(reloaded.Contents()).To(gomega.Equal([]string{"invalid", "invalid", "fixed"}))
+		})
+
+		ginkgo.It("should fail to watch a file in a directory that does not exist", func() {
+			gomega.Expect(watcher.Add(filepath.Join(dir, "missing", "config.json"), reloaded.reload)).NotTo(gomega.BeNil())
+		})
+	})
+
+	ginkgo.Context("running", func() {
+
+		ginkgo.BeforeEach(func() {
+			go watcher.Run()
+		})
+
+		ginkgo.AfterEach(func() {
+			watcher.Stop()
+		})
+
+		ginkgo.It("should reload a file when it is written", func() {
+			writeFile(path, "changed")
+			gomega.Eventually(reloaded.Contents).Should(gomega.Equal([]string{"changed"}))
+			gomega.Consistently(reloaded.Contents, 50*time.Millisecond).Should(gomega.HaveLen(1))
+		})
+
+		ginkgo.It("should ignore the changes of the other files of the directory", func() {
+			writeFile(filepath.Join(dir, "other.json"), "other")
+			gomega.Consistently(reloaded.Contents, 100*time.Millisecond).Should(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should reload a file replaced by a symlink swap", func() {
+			// Kubernetes mounts the files as links to a data directory that is swapped atomically
+			gomega.Expect(os.Remove(path)).To(gomega.Succeed())
+			for _, version := range []string{"v1", "v2"} {
+				gomega.Expect(os.Mkdir(filepath.Join(dir, version), 0700)).To(gomega.Succeed())
+				writeFile(filepath.Join(dir, version, "config.json"), version)
+			}
+			gomega.Expect(os.Symlink("v1", filepath.Join(dir, "..data"))).To(gomega.Succeed())
+			gomega.Expect(os.Symlink(filepath.Join("..data", "config.json"), path)).To(gomega.Succeed())
+			gomega.Eventually(reloaded.Contents).Should(gomega.Equal([]string{"v1"}))
+
+			gomega.Expect(os.Symlink("v2", filepath.Join(dir, "..data_tmp"))).To(gomega.Succeed())
+			gomega.Expect(os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data"))).To(gomega.Succeed())
+			gomega.Eventually(reloaded.Contents).Should(gomega.Equal([]string{"v1", "v2"}))
+		})
+
+		ginkgo.It("should reload every file on SIGHUP", func() {
+			watcher.signals <- syscall.SIGHUP
+			gomega.Eventually(reloaded.Contents).Should(gomega.Equal([]string{"initial"}))
+		})
+	})
+})
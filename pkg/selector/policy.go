@@ -0,0 +1,142 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package selector
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nalej/derrors"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// OrganizationPolicy with the selection strategy of an organization.
+type OrganizationPolicy struct {
+	StrategyConfig
+	// OrganizationId of the policy.
+	OrganizationId string `json:"organization_id"`
+}
+
+// PolicyFile with the content of a file of selection policies.
+type PolicyFile struct {
+	// Default strategy. If not set, the strategy given on the command line is used.
+	Default *StrategyConfig `json:"default,omitempty"`
+	// Organizations with the strategies of specific organizations.
+	Organizations []OrganizationPolicy `json:"organizations"`
+}
+
+func (pf *PolicyFile) Validate() derrors.Error {
+	if pf.Default != nil {
+		_, err := NewSelector(*pf.Default)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := pf.organizationSelectors()
+	return err
+}
+
+// organizationSelectors creates the selectors of the organizations with a policy.
+func (pf *PolicyFile) organizationSelectors() (map[string]Selector, derrors.Error) {
+	selectors := make(map[string]Selector, len(pf.Organizations))
+	for _, policy := range pf.Organizations {
+		if policy.OrganizationId == "" {
+			return nil, derrors.NewInvalidArgumentError("organization_id cannot be empty")
+		}
+		if _, exists := selectors[policy.OrganizationId]; exists {
+			return nil, derrors.NewInvalidArgumentError(fmt.Sprintf("duplicated policy for %s", policy.OrganizationId))
+		}
+		orgSelector, err := NewSelector(policy.StrategyConfig)
+		if err != nil {
+			return nil, err
+		}
+		selectors[policy.OrganizationId] = orgSelector
+	}
+	return selectors, nil
+}
+
+// LoadPolicyFile reads and validates a file of selection policies.
+func LoadPolicyFile(path string) (*PolicyFile, derrors.Error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot read selection policy file")
+	}
+	policyFile := &PolicyFile{}
+	err = json.Unmarshal(raw, policyFile)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot parse selection policy file")
+	}
+	vErr := policyFile.Validate()
+	if vErr != nil {
+		return nil, vErr
+	}
+	return policyFile, nil
+}
+
+// selectorSet is an immutable view of the selectors in use.
+type selectorSet struct {
+	defaultSelector Selector
+	organizations   map[string]Selector
+}
+
+// Registry returns the selector that applies to an organization.
+type Registry struct {
+	defaultConfig StrategyConfig
+	current       atomic.Value
+}
+
+// NewRegistry creates a registry that uses the given strategy for every organization.
+func NewRegistry(defaultConfig StrategyConfig) (*Registry, derrors.Error) {
+	defaultSelector, err := NewSelector(defaultConfig)
+	if err != nil {
+		return nil, err
+	}
+	registry := &Registry{defaultConfig: defaultConfig}
+	registry.current.Store(&selectorSet{defaultSelector: defaultSelector, organizations: make(map[string]Selector, 0)})
+	return registry, nil
+}
+
+// Update replaces the selectors in use. If the policies are not valid, the current selectors are kept.
+func (r *Registry) Update(policyFile *PolicyFile) derrors.Error {
+	defaultConfig := r.defaultConfig
+	if policyFile.Default != nil {
+		defaultConfig = *policyFile.Default
+	}
+	defaultSelector, err := NewSelector(defaultConfig)
+	if err != nil {
+		return err
+	}
+	organizations, err := policyFile.organizationSelectors()
+	if err != nil {
+		return err
+	}
+	set := &selectorSet{
+		defaultSelector: defaultSelector,
+		organizations:   organizations,
+	}
+	r.current.Store(set)
+	return nil
+}
+
+// GetSelector returns the selector of an organization.
+func (r *Registry) GetSelector(organizationID string) Selector {
+	set := r.current.Load().(*selectorSet)
+	if orgSelector, exists := set.organizations[organizationID]; exists {
+		return orgSelector
+	}
+	return set.defaultSelector
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package selector
+
+import (
+	"fmt"
+	"github.com/nalej/derrors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// MinLatencyStrategy selects the cluster with the minimum latency.
+	MinLatencyStrategy = "min_latency"
+	// WeightedRandomStrategy selects a random cluster among those close to the best one.
+	WeightedRandomStrategy = "weighted_random"
+	// HysteresisStrategy keeps the current cluster unless the gain of moving is big enough.
+	HysteresisStrategy = "hysteresis"
+)
+
+// NoCluster is used as current cluster when the device has no previous assignment.
+const NoCluster = -1
+
+// Selector chooses the cluster a device should connect to.
+type Selector interface {
+	// Select returns the index of the chosen cluster given the latency to each cluster and the index of the
+	// cluster the device is currently assigned to, or NoCluster.
+	Select(latencies []int32, current int) int
+}
+
+// bestCluster returns the index of the cluster with the minimum latency.
+func bestCluster(latencies []int32) int {
+	pos := 0
+	min := math.MaxInt32
+	for i, latency := range latencies {
+		if int(latency) < min {
+			min = int(latency)
+			pos = i
+		}
+	}
+	return pos
+}
+
+// MinLatency selects the cluster with the minimum latency, breaking ties on the first one.
+type MinLatency struct {
+}
+
+func NewMinLatency() *MinLatency {
+	return &MinLatency{}
+}
+
+func (s *MinLatency) Select(latencies []int32, current int) int {
+	return bestCluster(latencies)
+}
+
+// WeightedRandom selects a random cluster among those whose latency is within Tolerance percent of the best
+// one. Clusters with lower latency are more likely to be chosen.
+type WeightedRandom struct {
+	Tolerance float64
+	mu        sync.Mutex
+	rand      *rand.Rand
+}
+
+func NewWeightedRandom(tolerance float64) *WeightedRandom {
+	return &WeightedRandom{
+		Tolerance: tolerance,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *WeightedRandom) Select(latencies []int32, current int) int {
+	if len(latencies) == 0 {
+		return 0
+	}
+	best := bestCluster(latencies)
+	limit := float64(latencies[best]) * (1 + s.Tolerance/100)
+	candidates := make([]int, 0)
+	weights := make([]float64, 0)
+	total := 0.0
+	for i, latency := range latencies {
+		if float64(latency) <= limit {
+			weight := 1 / math.Max(float64(latency), 1)
+			candidates = append(candidates, i)
+			weights = append(weights, weight)
+			total += weight
+		}
+	}
+	s.mu.Lock()
+	target := s.rand.Float64() * total
+	s.mu.Unlock()
+	for i, weight := range weights {
+		target -= weight
+		if target < 0 {
+			return candidates[i]
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// Hysteresis keeps the device on its current cluster unless the best cluster improves its latency by more than
+// Margin percent.
+type Hysteresis struct {
+	Margin float64
+}
+
+func NewHysteresis(margin float64) *Hysteresis {
+	return &Hysteresis{Margin: margin}
+}
+
+func (s *Hysteresis) Select(latencies []int32, current int) int {
+	best := bestCluster(latencies)
+	if current < 0 || current >= len(latencies) || current == best {
+		return best
+	}
+	if float64(latencies[current]) <= float64(latencies[best])*(1+s.Margin/100) {
+		return current
+	}
+	return best
+}
+
+// StrategyConfig with the parameters of a selection strategy.
+type StrategyConfig struct {
+	// Strategy with the name of the strategy.
+	Strategy string `json:"strategy"`
+	// Tolerance in percent used by the weighted random strategy.
+	Tolerance float64 `json:"tolerance,omitempty"`
+	// Margin in percent used by the hysteresis strategy.
+	Margin float64 `json:"margin,omitempty"`
+}
+
+// NewSelector creates the selector described by the configuration.
+func NewSelector(config StrategyConfig) (Selector, derrors.Error) {
+	switch config.Strategy {
+	case MinLatencyStrategy:
+		return NewMinLatency(), nil
+	case WeightedRandomStrategy:
+		if config.Tolerance < 0 {
+			return nil, derrors.NewInvalidArgumentError("tolerance must be valid")
+		}
+		return NewWeightedRandom(config.Tolerance), nil
+	case HysteresisStrategy:
+		if config.Margin < 0 {
+			return nil, derrors.NewInvalidArgumentError("margin must be valid")
+		}
+		return NewHysteresis(config.Margin), nil
+	}
+	return nil, derrors.NewInvalidArgumentError(fmt.Sprintf("unknown selection strategy %s", config.Strategy))
+}
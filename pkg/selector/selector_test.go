@@ -0,0 +1,140 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package selector
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = ginkgo.Describe("Selector", func() {
+
+	table.DescribeTable("deterministic strategies",
+		func(config StrategyConfig, latencies []int32, current int, expected int) {
+			selector, err := NewSelector(config)
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(selector.Select(latencies, current)).To(gomega.Equal(expected))
+		},
+		table.Entry("min latency", StrategyConfig{Strategy: MinLatencyStrategy}, []int32{30, 10, 20}, NoCluster, 1),
+		table.Entry("min latency breaks ties on the first cluster", StrategyConfig{Strategy: MinLatencyStrategy}, []int32{30, 10, 10}, 2, 1),
+		table.Entry("hysteresis without assignment", StrategyConfig{Strategy: HysteresisStrategy, Margin: 25}, []int32{30, 10, 20}, NoCluster, 1),
+		table.Entry("hysteresis keeps the cluster within the margin", StrategyConfig{Strategy: HysteresisStrategy, Margin: 25}, []int32{12, 10, 20}, 0, 0),
+		table.Entry("hysteresis moves above the margin", StrategyConfig{Strategy: HysteresisStrategy, Margin: 25}, []int32{13, 10, 20}, 0, 1),
+		table.Entry("hysteresis with an unknown current cluster", StrategyConfig{Strategy: HysteresisStrategy, Margin: 25}, []int32{12, 10}, 5, 1),
+		table.Entry("weighted random without tolerance", StrategyConfig{Strategy: WeightedRandomStrategy}, []int32{30, 10, 20}, NoCluster, 1),
+	)
+
+	table.DescribeTable("invalid strategies",
+		func(config StrategyConfig) {
+			_, err := NewSelector(config)
+			gomega.Expect(err).NotTo(gomega.BeNil())
+		},
+		table.Entry("unknown strategy", StrategyConfig{Strategy: "round_robin"}),
+		table.Entry("negative tolerance", StrategyConfig{Strategy: WeightedRandomStrategy, Tolerance: -1}),
+		table.Entry("negative margin", StrategyConfig{Strategy: HysteresisStrategy, Margin: -1}),
+	)
+
+	ginkgo.It("should only choose the clusters within the tolerance", func() {
+		selector := NewWeightedRandom(50)
+		chosen := make(map[int]int, 0)
+		for i := 0; i < 1000; i++ {
+			chosen[selector.Select([]int32{100, 140, 151, 10000}, NoCluster)]++
+		}
+		gomega.Expect(chosen).To(gomega.HaveLen(2))
+		gomega.Expect(chosen[0]).To(gomega.BeNumerically(">", chosen[1]))
+	})
+
+})
+
+var _ = ginkgo.Describe("Registry", func() {
+
+	var registry *Registry
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		registry, err = NewRegistry(StrategyConfig{Strategy: MinLatencyStrategy})
+		gomega.Expect(err).To(gomega.BeNil())
+	})
+
+	ginkgo.It("should use the strategy of the organization or the default one", func() {
+		err := registry.Update(&PolicyFile{
+			Default:       &StrategyConfig{Strategy: HysteresisStrategy, Margin: 25},
+			Organizations: []OrganizationPolicy{{OrganizationId: "org", StrategyConfig: StrategyConfig{Strategy: MinLatencyStrategy}}},
+		})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(registry.GetSelector("org")).To(gomega.BeAssignableToTypeOf(&MinLatency{}))
+		gomega.Expect(registry.GetSelector("other")).To(gomega.BeAssignableToTypeOf(&Hysteresis{}))
+	})
+
+	table.DescribeTable("invalid policies keep the current selectors",
+		func(policyFile *PolicyFile) {
+			gomega.Expect(registry.Update(policyFile)).NotTo(gomega.BeNil())
+			gomega.Expect(registry.GetSelector("org")).To(gomega.BeAssignableToTypeOf(&MinLatency{}))
+		},
+		table.Entry("invalid default", &PolicyFile{Default: &StrategyConfig{Strategy: "unknown"}}),
+		table.Entry("empty organization", &PolicyFile{Organizations: []OrganizationPolicy{{StrategyConfig: StrategyConfig{Strategy: HysteresisStrategy}}}}),
+		table.Entry("duplicated organization", &PolicyFile{Organizations: []OrganizationPolicy{
+			{OrganizationId: "org", StrategyConfig: StrategyConfig{Strategy: HysteresisStrategy}},
+			{OrganizationId: "org", StrategyConfig: StrategyConfig{Strategy: HysteresisStrategy}},
+		}}),
+	)
+
+	ginkgo.Context("policy files", func() {
+
+		var dir string
+
+		ginkgo.BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "selector")
+			gomega.Expect(err).To(gomega.Succeed())
+		})
+
+		ginkgo.AfterEach(func() {
+			gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+		})
+
+		table.DescribeTable("loading",
+			func(content string, valid bool) {
+				path := filepath.Join(dir, "selection.json")
+				gomega.Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(gomega.Succeed())
+				policyFile, err := LoadPolicyFile(path)
+				if valid {
+					gomega.Expect(err).To(gomega.BeNil())
+					gomega.Expect(policyFile).NotTo(gomega.BeNil())
+				} else {
+					gomega.Expect(err).NotTo(gomega.BeNil())
+				}
+			},
+			table.Entry("valid policies", `{"default": {"strategy": "hysteresis", "margin": 20},
+				"organizations": [{"organization_id": "org", "strategy": "weighted_random", "tolerance": 10}]}`, true),
+			table.Entry("no default", `{"organizations": [{"organization_id": "org", "strategy": "min_latency"}]}`, true),
+			table.Entry("invalid JSON", `{"organizations": [`, false),
+			table.Entry("unknown default strategy", `{"default": {"strategy": "closest"}, "organizations": []}`, false),
+			table.Entry("unknown organization strategy", `{"organizations": [{"organization_id": "org", "strategy": "round_robin"}]}`, false),
+			table.Entry("missing organization strategy", `{"organizations": [{"organization_id": "org"}]}`, false),
+			table.Entry("invalid organization parameters", `{"organizations": [{"organization_id": "org", "strategy": "hysteresis", "margin": -1}]}`, false),
+			table.Entry("empty organization", `{"organizations": [{"strategy": "min_latency"}]}`, false),
+			table.Entry("duplicated organization", `{"organizations": [
+				{"organization_id": "org", "strategy": "min_latency"}, {"organization_id": "org", "strategy": "hysteresis"}]}`, false),
+		)
+	})
+
+})
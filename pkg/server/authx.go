@@ -0,0 +1,107 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/nalej/device-controller/pkg/server/ping"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+	"sync"
+)
+
+// authxGuard keeps the authorization config of the authx interceptor from changing while a request is being
+// authorized. The interceptor is only available as a server option that reads the config it was created with,
+// so the config cannot be swapped and is updated in place instead. The guard is the stats handler of the gRPC
+// servers, called when a request begins, before the interceptor, and holds the config until the interceptor
+// hands the request to the handler, where the guard interceptor releases it, or until the request ends if it
+// is rejected. A reload only waits for the requests being authorized, not for the ones being handled.
+type authxGuard struct {
+	stats.Handler
+	mu sync.RWMutex
+}
+
+type authorizationKey struct{}
+
+// guardedMethods with the methods authorized by the authx interceptor, whose handler releases the config. The
+// rest of the methods of the servers are streams, which the interceptor does not authorize.
+var guardedMethods = map[string]bool{
+	ping.PingMethod:            true,
+	ping.RegisterLatencyMethod: true,
+	ping.SelectClusterMethod:   true,
+}
+
+// authorization with the hold of a request on the config.
+type authorization struct {
+	once sync.Once
+	mu   *sync.RWMutex
+}
+
+// release the config, once per request.
+func (a *authorization) release() {
+	a.once.Do(a.mu.RUnlock)
+}
+
+func newAuthxGuard(handler stats.Handler) *authxGuard {
+	return &authxGuard{Handler: handler}
+}
+
+// TagRPC adds the hold of the request to its context.
+func (g *authxGuard) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	ctx = g.Handler.TagRPC(ctx, info)
+	if !guardedMethods[info.FullMethodName] {
+		return ctx
+	}
+	return context.WithValue(ctx, authorizationKey{}, &authorization{mu: &g.mu})
+}
+
+// HandleRPC holds the config from the beginning of each request, releasing it at the end if the request did
+// not reach the handler.
+func (g *authxGuard) HandleRPC(ctx context.Context, rpcStats stats.RPCStats) {
+	switch rpcStats.(type) {
+	case *stats.Begin:
+		if _, ok := ctx.Value(authorizationKey{}).(*authorization); ok {
+			g.mu.RLock()
+		}
+	case *stats.End:
+		release(ctx)
+	}
+	g.Handler.HandleRPC(ctx, rpcStats)
+}
+
+// release the config held by a request.
+func release(ctx context.Context) {
+	if hold, ok := ctx.Value(authorizationKey{}).(*authorization); ok {
+		hold.release()
+	}
+}
+
+// UnaryServerInterceptor releases the config once the request has been authorized. It must be applied on the
+// handler, after the authx interceptor.
+func (g *authxGuard) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		release(ctx)
+		return handler(ctx, req)
+	}
+}
+
+// update applies a change to the authorization config while no request is being authorized.
+func (g *authxGuard) update(apply func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	apply()
+}
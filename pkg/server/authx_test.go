@@ -0,0 +1,170 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/nalej/authx/pkg/interceptor"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const pingMethod = "/device_controller.Connection/Ping"
+
+func writeAuthConfig(path string, must string) {
+	content := fmt.Sprintf(`{"allows_all":false, "permissions": {"%s":{"must":["%s"]}}}`, pingMethod, must)
+	gomega.Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(gomega.Succeed())
+}
+
+var _ = ginkgo.Describe("Auth config reload", func() {
+
+	var dir string
+	var service *Service
+	var authConfig *interceptor.AuthorizationConfig
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "authx")
+		gomega.Expect(err).To(gomega.Succeed())
+		service = NewService(Config{AuthConfigPath: filepath.Join(dir, "authx.json")})
+		writeAuthConfig(service.Configuration.AuthConfigPath, "DEVICE")
+		var lErr error
+		authConfig, lErr = service.Configuration.LoadAuthConfig()
+		gomega.Expect(lErr).To(gomega.BeNil())
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+	})
+
+	// begin starts a request as the gRPC server does before calling the authx interceptor.
+	begin := func(method string) context.Context {
+		ctx := service.authx.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: method})
+		service.authx.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		return ctx
+	}
+
+	end := func(ctx context.Context) {
+		service.authx.HandleRPC(ctx, &stats.End{BeginTime: time.Now(), EndTime: time.Now()})
+	}
+
+	// handle passes a request to its handler as the authx interceptor does once it is authorized.
+	handle := func(ctx context.Context, handler func()) {
+		_, err := service.authx.UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: pingMethod},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				handler()
+				return nil, nil
+			})
+		gomega.Expect(err).To(gomega.Succeed())
+	}
+
+	reloadInBackground := func() chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			gomega.Expect(service.reloadAuthConfig(authConfig)()).To(gomega.BeNil())
+		}()
+		return done
+	}
+
+	ginkgo.It("should not change the config while a request is being authorized", func() {
+		reload := service.reloadAuthConfig(authConfig)
+		stop := make(chan struct{})
+		var requests sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			requests.Add(1)
+			go func() {
+				defer requests.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					ctx := begin(pingMethod)
+					// The authx interceptor reads the config before calling the handler
+					permission := authConfig.Permissions[pingMethod]
+					gomega.Expect(permission.Must).To(gomega.HaveLen(1))
+					handle(ctx, func() {})
+					end(ctx)
+				}
+			}()
+		}
+		for i := 0; i < 20; i++ {
+			writeAuthConfig(service.Configuration.AuthConfigPath, fmt.Sprintf("PRIMITIVE_%d", i))
+			gomega.Expect(reload()).To(gomega.BeNil())
+		}
+		close(stop)
+		requests.Wait()
+		gomega.Expect(authConfig.Permissions[pingMethod].Must).To(gomega.Equal([]string{"PRIMITIVE_19"}))
+	})
+
+	ginkgo.It("should wait for the requests being authorized before applying the new config", func() {
+		ctx := begin(pingMethod)
+		writeAuthConfig(service.Configuration.AuthConfigPath, "ORG")
+		done := reloadInBackground()
+		gomega.Consistently(done, 100*time.Millisecond).ShouldNot(gomega.BeClosed())
+		handle(ctx, func() {
+			gomega.Eventually(done).Should(gomega.BeClosed())
+		})
+		end(ctx)
+		gomega.Expect(authConfig.Permissions[pingMethod].Must).To(gomega.Equal([]string{"ORG"}))
+	})
+
+	ginkgo.It("should not wait for the requests being handled", func() {
+		ctx := begin(pingMethod)
+		writeAuthConfig(service.Configuration.AuthConfigPath, "ORG")
+		handle(ctx, func() {
+			gomega.Eventually(reloadInBackground()).Should(gomega.BeClosed())
+			other := begin(pingMethod)
+			handle(other, func() {})
+			end(other)
+		})
+		end(ctx)
+		gomega.Expect(authConfig.Permissions[pingMethod].Must).To(gomega.Equal([]string{"ORG"}))
+	})
+
+	ginkgo.It("should release the config of the requests rejected by the authx interceptor", func() {
+		ctx := begin(pingMethod)
+		end(ctx)
+		writeAuthConfig(service.Configuration.AuthConfigPath, "ORG")
+		gomega.Eventually(reloadInBackground()).Should(gomega.BeClosed())
+	})
+
+	ginkgo.It("should not hold the config for the streams", func() {
+		ctx := begin("/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo")
+		writeAuthConfig(service.Configuration.AuthConfigPath, "ORG")
+		gomega.Eventually(reloadInBackground()).Should(gomega.BeClosed())
+		end(ctx)
+	})
+
+	ginkgo.It("should keep the previous config if the new one has no permissions", func() {
+		content := `{"allows_all":false, "permissions": {}}`
+		gomega.Expect(ioutil.WriteFile(service.Configuration.AuthConfigPath, []byte(content), 0600)).To(gomega.Succeed())
+		gomega.Expect(service.reloadAuthConfig(authConfig)()).NotTo(gomega.BeNil())
+		gomega.Expect(authConfig.Permissions[pingMethod].Must).To(gomega.Equal([]string{"DEVICE"}))
+	})
+
+})
@@ -17,11 +17,24 @@
 package server
 
 import (
+	"fmt"
 	"github.com/nalej/authx/pkg/interceptor"
 	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/assignment"
+	"github.com/nalej/device-controller/pkg/latency"
+	"github.com/nalej/device-controller/pkg/liveness"
+	"github.com/nalej/device-controller/pkg/login_helper"
+	"github.com/nalej/device-controller/pkg/notifier"
+	"github.com/nalej/device-controller/pkg/queue"
+	"github.com/nalej/device-controller/pkg/ratelimit"
+	"github.com/nalej/device-controller/pkg/selector"
+	"github.com/nalej/device-controller/pkg/server/ping"
+	"github.com/nalej/device-controller/pkg/threshold"
 	"github.com/nalej/device-controller/version"
 	"github.com/rs/zerolog/log"
+	"io/ioutil"
 	"strings"
+	"time"
 )
 
 type Config struct {
@@ -29,6 +42,10 @@ type Config struct {
 	Port int
 	// HTTPPort where the HTTP gRPC gateway will be listening.
 	HTTPPort int
+	// HealthPort where the gRPC health service will be listening.
+	HealthPort int
+	// MetricsPort where the metrics will be served, apart from the device HTTP API.
+	MetricsPort int
 	// ClusterAPIHostname with the hostname of the cluster API on the management cluster
 	ClusterAPIHostname string
 	// ClusterAPIPort with the port where the cluster API is listening.
@@ -42,18 +59,120 @@ type Config struct {
 	Email string
 	// Password to log into the managment cluster.
 	Password string
+	// EmailFile contains the path of the file with the email. It takes precedence over Email.
+	EmailFile string
+	// PasswordFile contains the path of the file with the password. It takes precedence over Password.
+	PasswordFile string
 	// Threshold in milliseconds by which it will be considered if a latency is acceptable or not
 	Threshold int
+	// ThresholdPolicyPath contains the path of the file with the thresholds of organizations, device groups and devices.
+	ThresholdPolicyPath string
+	// LatencyStatistic with the statistic of a window of latencies that is compared against the threshold.
+	LatencyStatistic string
+	// LatencyWindowSize with the number of latency samples of a window.
+	LatencyWindowSize int
+	// LatencyConsecutiveWindows with the number of consecutive windows above the threshold that require a new latency check.
+	LatencyConsecutiveWindows int
+	// LatencyEWMAAlpha with the weight of a new sample on the moving average of the latency.
+	LatencyEWMAAlpha float64
+	// LatencyMaxJitter with the jitter in milliseconds of a window that requires a new latency check. Zero disables it.
+	LatencyMaxJitter int
+	// SelectionStrategy with the default cluster selection strategy.
+	SelectionStrategy string
+	// SelectionTolerance in percent with the clusters considered by the weighted random strategy.
+	SelectionTolerance float64
+	// SelectionMargin in percent with the latency gain required by the hysteresis strategy to move a device.
+	SelectionMargin float64
+	// SelectionPolicyPath contains the path of the file with the selection strategy of each organization.
+	SelectionPolicyPath string
+	// RateLimit with the requests per second allowed to each device on average, zero for no limit.
+	RateLimit float64
+	// RateLimitBurst with the requests allowed to each device at once.
+	RateLimitBurst int
+	// RateLimitPolicyPath contains the path of the file with the rate limit of each organization.
+	RateLimitPolicyPath string
+	// AssignmentTTL with the time a device assignment is remembered after its last selection.
+	AssignmentTTL time.Duration
+	// AssignmentCooldown with the minimum time between two moves of a device.
+	AssignmentCooldown time.Duration
+	// AssignmentMaxMovesPerHour with the maximum number of moves of a device in an hour, zero for no limit.
+	AssignmentMaxMovesPerHour int
+	// AssignmentHistorySize with the number of selections remembered for each device.
+	AssignmentHistorySize int
+	// LivenessStaleTimeout with the time after which a device that has not been seen becomes STALE.
+	LivenessStaleTimeout time.Duration
+	// LivenessOfflineTimeout with the time after which a device that has not been seen becomes OFFLINE.
+	LivenessOfflineTimeout time.Duration
+	// LivenessCheckInterval with the time between two checks of the state of the devices.
+	LivenessCheckInterval time.Duration
+	// LivenessForgetTimeout with the time after which an OFFLINE device is no longer tracked.
+	LivenessForgetTimeout time.Duration
+	// WebhookURLs with the webhooks notified of device state changes and latency degradations.
+	WebhookURLs []string
+	// WebhookSecretPath contains the path of the file with the secret used to sign the notifications.
+	WebhookSecretPath string
+	// WebhookMaxAttempts with the number of delivery attempts of a notification.
+	WebhookMaxAttempts int
+	// WebhookInitialBackoff with the time to wait after the first failed delivery of a notification.
+	WebhookInitialBackoff time.Duration
+	// WebhookMaxBackoff with the maximum time to wait between two delivery attempts of a notification.
+	WebhookMaxBackoff time.Duration
+	// WebhookTimeout with the timeout of each webhook request.
+	WebhookTimeout time.Duration
+	// WebhookQueueSize with the number of notifications waiting to be sent to each webhook.
+	WebhookQueueSize int
+	// CredentialStore with the type of store of the cluster API credentials: memory, file or encrypted.
+	CredentialStore string
+	// CredentialStorePath with the directory where the file stores save the credentials.
+	CredentialStorePath string
+	// CredentialStoreKeyPath contains the path of the file with the secret of the encrypted store.
+	CredentialStoreKeyPath string
+	// TokenRenewalMargin with the time before the expiration of the cluster API token when it is renewed.
+	TokenRenewalMargin time.Duration
+	// ShutdownTimeout with the time given to the servers and the latency queue to finish on shutdown.
+	ShutdownTimeout time.Duration
+	// EnableDebugEndpoints exposes the debug endpoints on the metrics port.
+	EnableDebugEndpoints bool
 	// AuthHeader contains the name of the target header.
 	AuthHeader string
 	// AuthConfigPath contains the path of the file with the authentication configuration.
 	AuthConfigPath string
+	// AuditLogPath contains the path of the file where the requests rejected because of the identity of the
+	// device are recorded. If empty, they are recorded in the service log.
+	AuditLogPath string
 	// Path for the certificate of the CA
 	CACertPath string
 	// Client Cert Path
 	ClientCertPath string
 	// Skip Server validation
 	SkipServerCertValidation bool
+	// ServerCertPath contains the path of the directory with the tls.crt and tls.key served on the gRPC and HTTP
+	// ports. If empty, both ports serve plaintext.
+	ServerCertPath string
+	// DeviceCACertPath contains the path of the CA bundle used to verify the client certificates of the devices.
+	DeviceCACertPath string
+	// RequireDeviceCert rejects the devices that do not present a client certificate signed by DeviceCACertPath.
+	RequireDeviceCert bool
+	// QueuePath with the directory where the latency samples waiting to be sent to the cluster API are stored.
+	QueuePath string
+	// QueueMaxSize with the maximum number of latency samples waiting to be sent.
+	QueueMaxSize int
+	// QueueMaxAttempts with the number of delivery attempts before a sample is moved to the dead letter directory.
+	QueueMaxAttempts int
+	// QueueInitialBackoff with the time to wait after the first failed delivery of a sample.
+	QueueInitialBackoff time.Duration
+	// QueueMaxBackoff with the maximum time to wait between two delivery attempts of a sample.
+	QueueMaxBackoff time.Duration
+	// BatchFlushInterval with the maximum time a latency sample waits to be sent in a batch.
+	BatchFlushInterval time.Duration
+	// BatchMaxSize with the maximum number of latency samples handed to a forwarding worker at once. Each sample
+	// is still sent to the cluster API in its own call, as the cluster API has no batch operation.
+	BatchMaxSize int
+	// ForwardWorkers with the number of batches that are sent to the cluster API concurrently.
+	ForwardWorkers int
+	// LatencyNotReadyPolicy decides whether the latency samples received before the controller is connected to
+	// the management cluster are queued or rejected.
+	LatencyNotReadyPolicy string
 }
 
 // LoadAuthConfig loads the security configuration.
@@ -61,28 +180,258 @@ func (conf *Config) LoadAuthConfig() (*interceptor.AuthorizationConfig, derrors.
 	return interceptor.LoadAuthorizationConfig(conf.AuthConfigPath)
 }
 
-func (conf *Config) Validate() derrors.Error {
+// LoadThresholds loads the latency threshold policies.
+func (conf *Config) LoadThresholds() (*threshold.Resolver, derrors.Error) {
+	resolver := threshold.NewResolver(conf.Threshold)
+	if conf.ThresholdPolicyPath == "" {
+		return resolver, nil
+	}
+	policyFile, err := threshold.LoadPolicyFile(conf.ThresholdPolicyPath)
+	if err != nil {
+		return nil, err
+	}
+	resolver.Update(policyFile)
+	return resolver, nil
+}
+
+// GetLatencyRule returns the rule used to decide when a device must check its latency again.
+func (conf *Config) GetLatencyRule() latency.Rule {
+	return latency.Rule{
+		Statistic:          latency.Statistic(conf.LatencyStatistic),
+		WindowSize:         conf.LatencyWindowSize,
+		ConsecutiveWindows: conf.LatencyConsecutiveWindows,
+		EWMAAlpha:          conf.LatencyEWMAAlpha,
+		MaxJitter:          conf.LatencyMaxJitter,
+	}
+}
 
-	if conf.Port <= 0 {
-		return derrors.NewInvalidArgumentError("ports must be valid")
+// GetRateLimit returns the default rate limit of the devices.
+func (conf *Config) GetRateLimit() ratelimit.Limit {
+	return ratelimit.Limit{
+		Rate:  conf.RateLimit,
+		Burst: conf.RateLimitBurst,
 	}
+}
+
+// LoadRateLimiter loads the rate limits of the devices.
+func (conf *Config) LoadRateLimiter() (*ratelimit.Limiter, derrors.Error) {
+	limiter, err := ratelimit.NewLimiter(conf.GetRateLimit())
+	if err != nil {
+		return nil, err
+	}
+	if conf.RateLimitPolicyPath == "" {
+		return limiter, nil
+	}
+	policyFile, err := ratelimit.LoadPolicyFile(conf.RateLimitPolicyPath)
+	if err != nil {
+		return nil, err
+	}
+	err = limiter.Update(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	return limiter, nil
+}
+
+// LoadSelectors loads the cluster selection strategies.
+func (conf *Config) LoadSelectors() (*selector.Registry, derrors.Error) {
+	registry, err := selector.NewRegistry(selector.StrategyConfig{
+		Strategy:  conf.SelectionStrategy,
+		Tolerance: conf.SelectionTolerance,
+		Margin:    conf.SelectionMargin,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if conf.SelectionPolicyPath == "" {
+		return registry, nil
+	}
+	policyFile, err := selector.LoadPolicyFile(conf.SelectionPolicyPath)
+	if err != nil {
+		return nil, err
+	}
+	err = registry.Update(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// GetAssignmentPolicy returns the policy that limits the moves of the devices between clusters.
+func (conf *Config) GetAssignmentPolicy() assignment.Policy {
+	return assignment.Policy{
+		Cooldown:        conf.AssignmentCooldown,
+		MaxMovesPerHour: conf.AssignmentMaxMovesPerHour,
+	}
+}
+
+// GetLivenessConfig returns the configuration of the device liveness tracker.
+func (conf *Config) GetLivenessConfig() liveness.Config {
+	return liveness.Config{
+		StaleTimeout:   conf.LivenessStaleTimeout,
+		OfflineTimeout: conf.LivenessOfflineTimeout,
+		CheckInterval:  conf.LivenessCheckInterval,
+		ForgetTimeout:  conf.LivenessForgetTimeout,
+	}
+}
+
+// GetNotifierConfig returns the configuration of the webhook notifier, reading the signing secret.
+func (conf *Config) GetNotifierConfig() (*notifier.Config, derrors.Error) {
+	notifierConfig := &notifier.Config{
+		URLs:           conf.WebhookURLs,
+		MaxAttempts:    conf.WebhookMaxAttempts,
+		InitialBackoff: conf.WebhookInitialBackoff,
+		MaxBackoff:     conf.WebhookMaxBackoff,
+		Timeout:        conf.WebhookTimeout,
+		QueueSize:      conf.WebhookQueueSize,
+	}
+	if conf.WebhookSecretPath != "" {
+		secret, err := ioutil.ReadFile(conf.WebhookSecretPath)
+		if err != nil {
+			return nil, derrors.AsError(err, "cannot read webhook secret")
+		}
+		notifierConfig.Secret = []byte(strings.TrimSpace(string(secret)))
+	}
+	return notifierConfig, nil
+}
+
+// readSecretFile returns the content of a file with a single secret value.
+func readSecretFile(path string) (string, derrors.Error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", derrors.AsError(err, "cannot read secret file")
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return "", derrors.NewInvalidArgumentError(fmt.Sprintf("secret file %s is empty", path))
+	}
+	return value, nil
+}
+
+// ReadCredentials returns the email and the password to log into the management cluster, reading them from
+// their files if they are set.
+func (conf *Config) ReadCredentials() (string, string, derrors.Error) {
+	email := conf.Email
+	password := conf.Password
+	var err derrors.Error
+	if conf.EmailFile != "" {
+		email, err = readSecretFile(conf.EmailFile)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	if conf.PasswordFile != "" {
+		password, err = readSecretFile(conf.PasswordFile)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return email, password, nil
+}
+
+// GetCredentialStore returns the store of the cluster API credentials.
+func (conf *Config) GetCredentialStore() (login_helper.CredentialStore, derrors.Error) {
+	return login_helper.NewCredentialStore(conf.CredentialStore, conf.CredentialStorePath, conf.CredentialStoreKeyPath)
+}
+
+// GetQueueConfig returns the configuration of the queue of latency samples.
+func (conf *Config) GetQueueConfig() queue.Config {
+	return queue.Config{
+		Path:           conf.QueuePath,
+		MaxSize:        conf.QueueMaxSize,
+		MaxAttempts:    conf.QueueMaxAttempts,
+		InitialBackoff: conf.QueueInitialBackoff,
+		MaxBackoff:     conf.QueueMaxBackoff,
+		MaxBatchSize:   conf.BatchMaxSize,
+		FlushInterval:  conf.BatchFlushInterval,
+		Workers:        conf.ForwardWorkers,
+	}
+}
+
+func (conf *Config) Validate() derrors.Error {
+	problems := &validation{}
+
+	conf.validatePorts(problems)
 	if conf.Threshold <= 0 {
-		return derrors.NewInvalidArgumentError("Threshold must be valid")
+		problems.add("threshold must be greater than zero")
+	}
+	if conf.ClusterAPIHostname == "" {
+		problems.add("clusterAPIHostname must be set")
 	}
-	if conf.AuthConfigPath == "" {
-		return derrors.NewInvalidArgumentError("authConfigPath must be set")
+	if conf.LoginHostname == "" {
+		problems.add("loginHostname must be set")
 	}
-	return nil
+	conf.validateCredentials(problems)
+	conf.validateCertificates(problems)
+	conf.validateFiles(problems)
+
+	latencyRule := conf.GetLatencyRule()
+	problems.check(latencyRule.Validate())
+	_, vErr := selector.NewSelector(selector.StrategyConfig{Strategy: conf.SelectionStrategy, Tolerance: conf.SelectionTolerance, Margin: conf.SelectionMargin})
+	problems.check(vErr)
+	rateLimit := conf.GetRateLimit()
+	problems.check(rateLimit.Validate())
+	if conf.AssignmentTTL <= 0 || conf.AssignmentCooldown < 0 || conf.AssignmentMaxMovesPerHour < 0 || conf.AssignmentHistorySize <= 0 {
+		problems.add("assignment parameters must be valid")
+	}
+	livenessConfig := conf.GetLivenessConfig()
+	problems.check(livenessConfig.Validate())
+	if len(conf.WebhookURLs) > 0 {
+		notifierConfig, nErr := conf.GetNotifierConfig()
+		if nErr == nil {
+			nErr = notifierConfig.Validate()
+		}
+		problems.check(nErr)
+	}
+	_, sErr := conf.GetCredentialStore()
+	problems.check(sErr)
+	if conf.TokenRenewalMargin <= 0 {
+		problems.add("token renewal margin must be valid")
+	}
+	if conf.ShutdownTimeout <= 0 {
+		problems.add("shutdown timeout must be valid")
+	}
+	problems.check(ping.NotReadyPolicy(conf.LatencyNotReadyPolicy).Validate())
+	queueConfig := conf.GetQueueConfig()
+	problems.check(queueConfig.Validate())
+
+	return problems.error()
 }
 
 func (conf *Config) Print() {
 	log.Info().Str("app", version.AppVersion).Str("commit", version.Commit).Msg("Version")
 	log.Info().Int("port", conf.Port).Msg("gRPC port")
 	log.Info().Int("port", conf.HTTPPort).Msg("HTTP port")
+	log.Info().Int("port", conf.HealthPort).Msg("gRPC health port")
+	log.Info().Int("port", conf.MetricsPort).Msg("Metrics port")
 	log.Info().Int("Threshold", conf.Threshold).Msg("Threshold in milliseconds")
+	log.Info().Str("path", conf.ThresholdPolicyPath).Msg("Threshold policy file")
+	log.Info().Str("statistic", conf.LatencyStatistic).Int("windowSize", conf.LatencyWindowSize).
+		Int("consecutiveWindows", conf.LatencyConsecutiveWindows).Float64("ewmaAlpha", conf.LatencyEWMAAlpha).Int("maxJitter", conf.LatencyMaxJitter).Msg("Latency evaluation")
+	log.Info().Str("strategy", conf.SelectionStrategy).Float64("tolerance", conf.SelectionTolerance).Float64("margin", conf.SelectionMargin).
+		Str("path", conf.SelectionPolicyPath).Msg("Cluster selection")
+	log.Info().Float64("rate", conf.RateLimit).Int("burst", conf.RateLimitBurst).Str("path", conf.RateLimitPolicyPath).Msg("Rate limit")
+	log.Info().Str("ttl", conf.AssignmentTTL.String()).Str("cooldown", conf.AssignmentCooldown.String()).
+		Int("maxMovesPerHour", conf.AssignmentMaxMovesPerHour).Int("historySize", conf.AssignmentHistorySize).Msg("Cluster assignments")
+	log.Info().Str("staleTimeout", conf.LivenessStaleTimeout.String()).Str("offlineTimeout", conf.LivenessOfflineTimeout.String()).
+		Str("checkInterval", conf.LivenessCheckInterval.String()).Str("forgetTimeout", conf.LivenessForgetTimeout.String()).Msg("Device liveness")
+	log.Info().Strs("URLs", conf.WebhookURLs).Str("secretPath", conf.WebhookSecretPath).Int("maxAttempts", conf.WebhookMaxAttempts).
+		Str("timeout", conf.WebhookTimeout.String()).Msg("Webhooks")
+	log.Info().Str("type", conf.CredentialStore).Str("path", conf.CredentialStorePath).Str("keyPath", conf.CredentialStoreKeyPath).Msg("Credential store")
+	log.Info().Str("margin", conf.TokenRenewalMargin.String()).Msg("Token renewal")
+	log.Info().Str("timeout", conf.ShutdownTimeout.String()).Msg("Shutdown")
+	log.Info().Bool("enabled", conf.EnableDebugEndpoints).Msg("Debug endpoints")
 	log.Info().Str("URL", conf.ClusterAPIHostname).Uint32("port", conf.ClusterAPIPort).Msg("Cluster API on management cluster")
 	log.Info().Str("URL", conf.LoginHostname).Uint32("port", conf.LoginPort).Bool("UseTLSForLogin", conf.UseTLSForLogin).Msg("Login API on management cluster")
-	log.Info().Str("Email", conf.Email).Str("password", strings.Repeat("*", len(conf.Password))).Msg("Application cluster credentials")
+	log.Info().Str("Email", conf.Email).Bool("passwordSet", conf.Password != "").
+		Str("emailFile", conf.EmailFile).Str("passwordFile", conf.PasswordFile).Msg("Application cluster credentials")
+	log.Info().Str("serverCertPath", conf.ServerCertPath).Str("deviceCACertPath", conf.DeviceCACertPath).
+		Bool("requireDeviceCert", conf.RequireDeviceCert).Msg("Server TLS")
 	log.Info().Str("header", conf.AuthHeader).Msg("Authorization")
 	log.Info().Str("path", conf.AuthConfigPath).Msg("Permissions file")
+	log.Info().Str("path", conf.AuditLogPath).Msg("Audit log")
+	log.Info().Str("path", conf.QueuePath).Int("maxSize", conf.QueueMaxSize).Int("maxAttempts", conf.QueueMaxAttempts).
+		Str("initialBackoff", conf.QueueInitialBackoff.String()).Str("maxBackoff", conf.QueueMaxBackoff.String()).Msg("Latency queue")
+	log.Info().Str("flushInterval", conf.BatchFlushInterval.String()).Int("maxSize", conf.BatchMaxSize).Int("workers", conf.ForwardWorkers).
+		Str("notReadyPolicy", conf.LatencyNotReadyPolicy).Msg("Latency forwarding")
 }
@@ -0,0 +1,64 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+)
+
+var _ = ginkgo.Describe("Config", func() {
+
+	var dir string
+	var logger zerolog.Logger
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config")
+		gomega.Expect(err).To(gomega.Succeed())
+		logger = log.Logger
+	})
+
+	ginkgo.AfterEach(func() {
+		log.Logger = logger
+		gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+	})
+
+	table.DescribeTable("printed credentials",
+		func(password string, expected string) {
+			var output bytes.Buffer
+			log.Logger = zerolog.New(&output)
+			conf := validConfig(dir)
+			conf.Password = password
+			conf.Print()
+			gomega.Expect(output.String()).To(gomega.ContainSubstring(expected))
+			gomega.Expect(output.String()).NotTo(gomega.ContainSubstring("*"))
+			if password != "" {
+				gomega.Expect(output.String()).NotTo(gomega.ContainSubstring(password))
+			}
+		},
+		table.Entry("password set", "secret-password", `"passwordSet":true`),
+		table.Entry("password not set", "", `"passwordSet":false`),
+	)
+
+})
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/health"
+	"github.com/nalej/device-controller/pkg/supervisor"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	grpc_health "google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+)
+
+// Names of the readiness checks.
+const (
+	// LoginCheck verifies that there is a token to call the cluster API.
+	LoginCheck = "login"
+	// TokenRenewalCheck verifies that the token is renewed before it expires.
+	TokenRenewalCheck = "token_renewal"
+	// ClusterAPICheck verifies that the cluster API is reachable.
+	ClusterAPICheck = "cluster_api"
+	// SecretAccessCheck verifies that the device secrets can be retrieved to authenticate the devices.
+	SecretAccessCheck = "secret_access"
+	// GRPCCheck verifies that the gRPC server is listening.
+	GRPCCheck = "grpc"
+)
+
+// ConnectionServiceName with the name of the device API reported by the gRPC health service.
+const ConnectionServiceName = "device_controller.Connection"
+
+// connectionCheck returns a check that fails unless the connection is ready. The check only reads the state of
+// the connection, so it never blocks the health loop while the connection is being established.
+func connectionCheck(conn *grpc.ClientConn) health.Check {
+	return func() derrors.Error {
+		state := conn.GetState()
+		if state != connectivity.Ready {
+			return derrors.NewUnavailableError(fmt.Sprintf("connection is %s", state.String()))
+		}
+		return nil
+	}
+}
+
+// LaunchGRPCHealth serves the standard gRPC health service on its own port, so the probes do not need to go
+// through the authx interceptor of the device API.
+func (s *Service) LaunchGRPCHealth() error {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Configuration.HealthPort))
+	if err != nil {
+		return derrors.AsError(err, fmt.Sprintf("failed to listen on port %d", s.Configuration.HealthPort))
+	}
+	healthServer := grpc_health.NewServer()
+	grpcServer := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
+	if !s.components.setHealthServer(grpcServer) {
+		_ = lis.Close()
+		return nil
+	}
+	services := []string{"", ConnectionServiceName}
+	s.tasks.Go("health", supervisor.Worker(func() {
+		s.Health.Run(healthServer, services, health.DefaultInterval)
+	}))
+
+	log.Info().Int("port", s.Configuration.HealthPort).Msg("Launching gRPC health server")
+	return grpcServer.Serve(lis)
+}
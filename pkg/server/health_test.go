@@ -0,0 +1,76 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+)
+
+var _ = ginkgo.Describe("Connection check", func() {
+
+	var listener *bufconn.Listener
+	var server *grpc.Server
+	var conn *grpc.ClientConn
+
+	ginkgo.BeforeEach(func() {
+		listener = bufconn.Listen(1024 * 1024)
+		server = grpc.NewServer()
+		go func(server *grpc.Server, listener net.Listener) {
+			_ = server.Serve(listener)
+		}(server, listener)
+		var err error
+		conn, err = grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.Dial()
+		}))
+		gomega.Expect(err).To(gomega.Succeed())
+	})
+
+	ginkgo.AfterEach(func() {
+		_ = conn.Close()
+		server.Stop()
+	})
+
+	ginkgo.It("should succeed once the connection is established", func() {
+		check := connectionCheck(conn)
+		gomega.Eventually(func() error {
+			return check()
+		}).Should(gomega.Succeed())
+	})
+
+	ginkgo.It("should fail once the server is not available", func() {
+		check := connectionCheck(conn)
+		gomega.Eventually(func() error {
+			return check()
+		}).Should(gomega.Succeed())
+		server.Stop()
+		_ = listener.Close()
+		gomega.Eventually(func() error {
+			return check()
+		}).ShouldNot(gomega.Succeed())
+	})
+
+	ginkgo.It("should fail for a closed connection", func() {
+		gomega.Expect(conn.Close()).To(gomega.Succeed())
+		gomega.Expect(connectionCheck(conn)()).NotTo(gomega.Succeed())
+	})
+
+})
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ping
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/login_helper"
+	"github.com/nalej/device-controller/pkg/metrics"
+	"github.com/nalej/grpc-cluster-api-go"
+	"github.com/nalej/grpc-device-controller-go"
+	"github.com/nalej/grpc-utils/pkg/conversions"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	grpc_status "google.golang.org/grpc/status"
+)
+
+// Forwarder sends the latency samples stored in the outbound queue to the cluster API.
+type Forwarder struct {
+	// LoginHelper Helper
+	ClusterAPILoginHelper *login_helper.LoginHelper
+	// clusterAPIClient
+	ClusterAPIClient grpc_cluster_api_go.DeviceManagerClient
+}
+
+func NewForwarder(helper *login_helper.LoginHelper, client grpc_cluster_api_go.DeviceManagerClient) *Forwarder {
+	return &Forwarder{
+		ClusterAPILoginHelper: helper,
+		ClusterAPIClient:      client,
+	}
+}
+
+// Deliver a batch of serialized RegisterLatencyRequest to the cluster API. The cluster API has no batch
+// operation, so each sample is sent in its own RegisterLatency call with a timeout of its own. Batching does
+// not reduce the number of calls, it bounds how many of them are in flight to the number of queue workers.
+// A single reauthentication is attempted per batch.
+func (f *Forwarder) Deliver(payloads [][]byte) []derrors.Error {
+	result := make([]derrors.Error, len(payloads))
+	reauthenticated := false
+
+	for i, payload := range payloads {
+		ping := &grpc_device_controller_go.RegisterLatencyRequest{}
+		err := proto.Unmarshal(payload, ping)
+		if err != nil {
+			result[i] = derrors.AsError(err, "cannot unmarshal latency sample")
+			metrics.ForwardedLatencies.WithLabelValues(metrics.ResultFailure).Inc()
+			continue
+		}
+		err = f.register(ping)
+		if err != nil && !reauthenticated && grpc_status.Convert(err).Code() == codes.Unauthenticated {
+			reauthenticated = true
+			errLogin := f.ClusterAPILoginHelper.RerunAuthentication()
+			if errLogin != nil {
+				log.Error().Err(errLogin).Msg("error during reauthentication")
+				result[i] = errLogin
+				metrics.ForwardedLatencies.WithLabelValues(metrics.ResultFailure).Inc()
+				continue
+			}
+			err = f.register(ping)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("OrganizationId", ping.OrganizationId).Str("deviceGroupId", ping.DeviceGroupId).Str("deviceId", ping.DeviceId).Msgf("error recording latencies")
+			result[i] = conversions.ToDerror(err)
+		}
+		metrics.ForwardedLatencies.WithLabelValues(metrics.Result(err)).Inc()
+	}
+
+	return result
+}
+
+// register sends a latency sample to the cluster API.
+func (f *Forwarder) register(ping *grpc_device_controller_go.RegisterLatencyRequest) error {
+	ctx, cancel := f.ClusterAPILoginHelper.GetContext()
+	defer cancel()
+	_, err := f.ClusterAPIClient.RegisterLatency(ctx, ping)
+	return err
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ping
+
+import (
+	"context"
+	"github.com/golang/protobuf/proto"
+	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/login_helper"
+	"github.com/nalej/device-controller/pkg/metrics"
+	"github.com/nalej/grpc-cluster-api-go"
+	"github.com/nalej/grpc-common-go"
+	"github.com/nalej/grpc-device-controller-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpc_status "google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+// testDeviceManager records the remaining time of the context of each RegisterLatency call.
+type testDeviceManager struct {
+	grpc_cluster_api_go.DeviceManagerClient
+	mu        sync.Mutex
+	delay     time.Duration
+	devices   []string
+	remaining []time.Duration
+}
+
+func (m *testDeviceManager) RegisterLatency(ctx context.Context, in *grpc_device_controller_go.RegisterLatencyRequest, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	deadline, _ := ctx.Deadline()
+	m.mu.Lock()
+	m.devices = append(m.devices, in.DeviceId)
+	m.remaining = append(m.remaining, time.Until(deadline))
+	m.mu.Unlock()
+	time.Sleep(m.delay)
+	if in.DeviceId == "rejected" {
+		return nil, grpc_status.Error(codes.InvalidArgument, "rejected")
+	}
+	return &grpc_common_go.Success{}, nil
+}
+
+func latencyPayload(deviceId string) []byte {
+	payload, err := proto.Marshal(&grpc_device_controller_go.RegisterLatencyRequest{
+		OrganizationId: "org",
+		DeviceGroupId:  "group",
+		DeviceId:       deviceId,
+		Latency:        10,
+	})
+	gomega.Expect(err).To(gomega.Succeed())
+	return payload
+}
+
+var _ = ginkgo.Describe("Forwarder", func() {
+
+	var client *testDeviceManager
+	var forwarder *Forwarder
+
+	ginkgo.BeforeEach(func() {
+		client = &testDeviceManager{delay: 50 * time.Millisecond}
+		helper := &login_helper.LoginHelper{Credentials: login_helper.NewCredentials("token", "")}
+		forwarder = NewForwarder(helper, client)
+	})
+
+	ginkgo.It("should send each sample in its own call with a fresh timeout", func() {
+		results := forwarder.Deliver([][]byte{latencyPayload("d1"), latencyPayload("d2"), latencyPayload("d3")})
+		gomega.Expect(results).To(gomega.Equal(make([]derrors.Error, 3)))
+		gomega.Expect(client.devices).To(gomega.Equal([]string{"d1", "d2", "d3"}))
+		for _, remaining := range client.remaining {
+			gomega.Expect(remaining).To(gomega.BeNumerically(">", login_helper.DefaultTimeout-client.delay/2))
+		}
+	})
+
+	ginkgo.It("should report the result of each sample", func() {
+		results := forwarder.Deliver([][]byte{latencyPayload("d1"), []byte("not a sample"), latencyPayload("rejected")})
+		gomega.Expect(results).To(gomega.HaveLen(3))
+		gomega.Expect(results[0]).To(gomega.BeNil())
+		gomega.Expect(results[1]).NotTo(gomega.BeNil())
+		gomega.Expect(results[2]).NotTo(gomega.BeNil())
+		gomega.Expect(client.devices).To(gomega.Equal([]string{"d1", "rejected"}))
+	})
+
+	ginkgo.It("should count every sample that is not delivered as failed", func() {
+		succeeded := testutil.ToFloat64(metrics.ForwardedLatencies.WithLabelValues(metrics.ResultSuccess))
+		failed := testutil.ToFloat64(metrics.ForwardedLatencies.WithLabelValues(metrics.ResultFailure))
+		forwarder.Deliver([][]byte{latencyPayload("d1"), []byte("not a sample"), latencyPayload("rejected"), []byte("nor this")})
+		gomega.Expect(testutil.ToFloat64(metrics.ForwardedLatencies.WithLabelValues(metrics.ResultSuccess))).To(gomega.Equal(succeeded + 1))
+		gomega.Expect(testutil.ToFloat64(metrics.ForwardedLatencies.WithLabelValues(metrics.ResultFailure))).To(gomega.Equal(failed + 3))
+	})
+
+})
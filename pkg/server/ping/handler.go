@@ -17,21 +17,46 @@ package ping
 
 import (
 	"context"
+	"github.com/nalej/device-controller/pkg/audit"
+	"github.com/nalej/device-controller/pkg/claims"
 	"github.com/nalej/device-controller/pkg/entities"
 	"github.com/nalej/grpc-common-go"
 	"github.com/nalej/grpc-device-controller-go"
+	"github.com/nalej/grpc-utils/pkg/conversions"
+	"github.com/rs/zerolog/log"
 )
 
 type Handler struct {
 	Manager Manager
+	// Audit log of the requests rejected because of the identity of the device.
+	Audit *audit.Log
 }
 
-func NewHandler(manager Manager) *Handler {
-	return &Handler{manager}
+func NewHandler(manager Manager, auditLog *audit.Log) *Handler {
+	return &Handler{manager, auditLog}
+}
+
+// authorize checks that the ids of a request belong to the device that sent it, recording the rejections
+// in the audit log. A request without claims is rejected as Unauthenticated and a request with the ids of
+// another device as PermissionDenied.
+func (h *Handler) authorize(ctx context.Context, method string, organizationID string, deviceGroupID string, deviceID string) error {
+	deviceClaims, err := claims.FromContext(ctx)
+	if err == nil {
+		err = deviceClaims.Matches(organizationID, deviceGroupID, deviceID)
+	}
+	if err != nil {
+		h.Audit.Rejected(ctx, method, deviceClaims, organizationID, deviceGroupID, deviceID, err)
+		return conversions.ToGRPCError(err)
+	}
+	return nil
 }
 
 func (h *Handler) Ping(ctx context.Context, in *grpc_common_go.Empty) (*grpc_common_go.Success, error) {
-	return h.Manager.Ping()
+	deviceClaims, err := claims.FromContext(ctx)
+	if err != nil {
+		log.Debug().Str("err", err.Error()).Msg("ping without device claims")
+	}
+	return h.Manager.Ping(deviceClaims)
 }
 
 func (h *Handler) RegisterLatency(ctx context.Context, ping *grpc_device_controller_go.RegisterLatencyRequest) (*grpc_device_controller_go.RegisterLatencyResult, error) {
@@ -39,6 +64,10 @@ func (h *Handler) RegisterLatency(ctx context.Context, ping *grpc_device_control
 	if err != nil {
 		return nil, err
 	}
+	aErr := h.authorize(ctx, RegisterLatencyMethod, ping.OrganizationId, ping.DeviceGroupId, ping.DeviceId)
+	if aErr != nil {
+		return nil, aErr
+	}
 	return h.Manager.RegisterPing(ping)
 }
 
@@ -47,5 +76,9 @@ func (h *Handler) SelectCluster(ctx context.Context, request *grpc_device_contro
 	if err != nil {
 		return nil, err
 	}
+	aErr := h.authorize(ctx, SelectClusterMethod, request.OrganizationId, request.DeviceGroupId, request.DeviceId)
+	if aErr != nil {
+		return nil, aErr
+	}
 	return h.Manager.SelectCluster(request)
 }
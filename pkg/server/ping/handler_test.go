@@ -0,0 +1,147 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ping
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/audit"
+	"github.com/nalej/device-controller/pkg/claims"
+	"github.com/nalej/grpc-device-controller-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpc_status "google.golang.org/grpc/status"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var _ = ginkgo.Describe("Handler", func() {
+
+	var dir string
+	var auditPath string
+	var auditLog *audit.Log
+	var handler *Handler
+
+	// deviceContext returns the context of a request whose token has the given claims.
+	deviceContext := func(pairs ...string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(pairs...))
+	}
+
+	validContext := func() context.Context {
+		return deviceContext(claims.OrganizationIdKey, "org", claims.DeviceGroupIdKey, "group", claims.DeviceIdKey, "device")
+	}
+
+	// auditEntries returns the entries written to the audit log.
+	auditEntries := func() []map[string]interface{} {
+		raw, err := ioutil.ReadFile(auditPath)
+		gomega.Expect(err).To(gomega.Succeed())
+		entries := make([]map[string]interface{}, 0)
+		for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+			if line == "" {
+				continue
+			}
+			entry := make(map[string]interface{}, 0)
+			gomega.Expect(json.Unmarshal([]byte(line), &entry)).To(gomega.Succeed())
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "handler")
+		gomega.Expect(err).To(gomega.Succeed())
+		auditPath = filepath.Join(dir, "audit.log")
+		var aErr derrors.Error
+		auditLog, aErr = audit.NewLog(auditPath)
+		gomega.Expect(aErr).To(gomega.BeNil())
+		ready := func() derrors.Error {
+			return nil
+		}
+		handler = NewHandler(newManager(filepath.Join(dir, "queue"), 10, ready, QueueWhenNotReady), auditLog)
+	})
+
+	ginkgo.AfterEach(func() {
+		auditLog.Close()
+		gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+	})
+
+	table.DescribeTable("RegisterLatency",
+		func(ctx context.Context, organizationID string, deviceGroupID string, deviceID string, expected codes.Code) {
+			_, err := handler.RegisterLatency(ctx, &grpc_device_controller_go.RegisterLatencyRequest{
+				OrganizationId: organizationID, DeviceGroupId: deviceGroupID, DeviceId: deviceID, Latency: 10,
+			})
+			gomega.Expect(grpc_status.Code(err)).To(gomega.Equal(expected))
+		},
+		table.Entry("device of the token", validContext(), "org", "group", "device", codes.OK),
+		table.Entry("other organization", validContext(), "other-org", "group", "device", codes.PermissionDenied),
+		table.Entry("other device group", validContext(), "org", "other-group", "device", codes.PermissionDenied),
+		table.Entry("other device", validContext(), "org", "group", "other-device", codes.PermissionDenied),
+		table.Entry("no claims", context.Background(), "org", "group", "device", codes.Unauthenticated),
+		table.Entry("missing claim", deviceContext(claims.OrganizationIdKey, "org", claims.DeviceGroupIdKey, "group"),
+			"org", "group", "device", codes.Unauthenticated),
+	)
+
+	table.DescribeTable("SelectCluster",
+		func(ctx context.Context, organizationID string, deviceGroupID string, deviceID string, expected codes.Code) {
+			_, err := handler.SelectCluster(ctx, &grpc_device_controller_go.SelectClusterRequest{
+				OrganizationId: organizationID, DeviceGroupId: deviceGroupID, DeviceId: deviceID, Latencies: []int32{20, 10},
+			})
+			gomega.Expect(grpc_status.Code(err)).To(gomega.Equal(expected))
+		},
+		table.Entry("device of the token", validContext(), "org", "group", "device", codes.OK),
+		table.Entry("other organization", validContext(), "other-org", "group", "device", codes.PermissionDenied),
+		table.Entry("other device group", validContext(), "org", "other-group", "device", codes.PermissionDenied),
+		table.Entry("other device", validContext(), "org", "group", "other-device", codes.PermissionDenied),
+		table.Entry("missing claim", deviceContext(claims.OrganizationIdKey, "org", claims.DeviceIdKey, "device"),
+			"org", "group", "device", codes.Unauthenticated),
+	)
+
+	ginkgo.It("should record the rejected requests in the audit log", func() {
+		_, err := handler.RegisterLatency(validContext(), &grpc_device_controller_go.RegisterLatencyRequest{
+			OrganizationId: "org", DeviceGroupId: "group", DeviceId: "other-device", Latency: 10,
+		})
+		gomega.Expect(err).NotTo(gomega.Succeed())
+		_, err = handler.SelectCluster(context.Background(), &grpc_device_controller_go.SelectClusterRequest{
+			OrganizationId: "org", DeviceGroupId: "group", DeviceId: "device", Latencies: []int32{10},
+		})
+		gomega.Expect(err).NotTo(gomega.Succeed())
+
+		entries := auditEntries()
+		gomega.Expect(entries).To(gomega.HaveLen(2))
+		gomega.Expect(entries[0]).To(gomega.HaveKeyWithValue("method", RegisterLatencyMethod))
+		gomega.Expect(entries[0]).To(gomega.HaveKeyWithValue("deviceId", "other-device"))
+		gomega.Expect(entries[0]).To(gomega.HaveKeyWithValue("claimsDeviceId", "device"))
+		gomega.Expect(entries[1]).To(gomega.HaveKeyWithValue("method", SelectClusterMethod))
+		gomega.Expect(entries[1]).NotTo(gomega.HaveKey("claimsDeviceId"))
+	})
+
+	ginkgo.It("should not record the authorized requests in the audit log", func() {
+		_, err := handler.RegisterLatency(validContext(), &grpc_device_controller_go.RegisterLatencyRequest{
+			OrganizationId: "org", DeviceGroupId: "group", DeviceId: "device", Latency: 10,
+		})
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(auditEntries()).To(gomega.BeEmpty())
+	})
+
+})
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ping
+
+import (
+	"context"
+	"github.com/nalej/grpc-common-go"
+	"github.com/nalej/grpc-device-controller-go"
+	"google.golang.org/grpc"
+)
+
+// Full names of the methods of the Connection service.
+const (
+	PingMethod            = "/device_controller.Connection/Ping"
+	RegisterLatencyMethod = "/device_controller.Connection/RegisterLatency"
+	SelectClusterMethod   = "/device_controller.Connection/SelectCluster"
+)
+
+// Intercepted applies unary interceptors to the methods of a Connection server. The server only accepts one
+// interceptor, used by authx, so the rest are applied on the handler.
+type Intercepted struct {
+	server       grpc_device_controller_go.ConnectionServer
+	interceptors []grpc.UnaryServerInterceptor
+}
+
+// NewIntercepted creates a server that applies the interceptors in the given order.
+func NewIntercepted(server grpc_device_controller_go.ConnectionServer, interceptors ...grpc.UnaryServerInterceptor) *Intercepted {
+	return &Intercepted{server: server, interceptors: interceptors}
+}
+
+// intercept calls the handler of a method through the interceptors.
+func (i *Intercepted) intercept(ctx context.Context, req interface{}, method string, handler grpc.UnaryHandler) (interface{}, error) {
+	info := &grpc.UnaryServerInfo{Server: i.server, FullMethod: method}
+	chained := handler
+	for index := len(i.interceptors) - 1; index >= 0; index-- {
+		interceptor, next := i.interceptors[index], chained
+		chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+	return chained(ctx, req)
+}
+
+func (i *Intercepted) Ping(ctx context.Context, in *grpc_common_go.Empty) (*grpc_common_go.Success, error) {
+	response, err := i.intercept(ctx, in, PingMethod, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return i.server.Ping(ctx, req.(*grpc_common_go.Empty))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response.(*grpc_common_go.Success), nil
+}
+
+func (i *Intercepted) RegisterLatency(ctx context.Context, ping *grpc_device_controller_go.RegisterLatencyRequest) (*grpc_device_controller_go.RegisterLatencyResult, error) {
+	response, err := i.intercept(ctx, ping, RegisterLatencyMethod, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return i.server.RegisterLatency(ctx, req.(*grpc_device_controller_go.RegisterLatencyRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response.(*grpc_device_controller_go.RegisterLatencyResult), nil
+}
+
+func (i *Intercepted) SelectCluster(ctx context.Context, request *grpc_device_controller_go.SelectClusterRequest) (*grpc_device_controller_go.SelectedCluster, error) {
+	response, err := i.intercept(ctx, request, SelectClusterMethod, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return i.server.SelectCluster(ctx, req.(*grpc_device_controller_go.SelectClusterRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response.(*grpc_device_controller_go.SelectedCluster), nil
+}
@@ -17,68 +17,140 @@
 package ping
 
 import (
-	"github.com/nalej/device-controller/pkg/login_helper"
-	"github.com/nalej/grpc-cluster-api-go"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/assignment"
+	"github.com/nalej/device-controller/pkg/claims"
+	"github.com/nalej/device-controller/pkg/health"
+	"github.com/nalej/device-controller/pkg/latency"
+	"github.com/nalej/device-controller/pkg/liveness"
+	"github.com/nalej/device-controller/pkg/metrics"
+	"github.com/nalej/device-controller/pkg/notifier"
+	"github.com/nalej/device-controller/pkg/queue"
+	"github.com/nalej/device-controller/pkg/selector"
+	"github.com/nalej/device-controller/pkg/threshold"
 	"github.com/nalej/grpc-common-go"
 	"github.com/nalej/grpc-device-controller-go"
+	"github.com/nalej/grpc-utils/pkg/conversions"
 	"github.com/rs/zerolog/log"
-	"google.golang.org/grpc/codes"
-	grpc_status "google.golang.org/grpc/status"
-	"math"
+	"time"
 )
 
+// NotReadyPolicy decides what happens with the latency samples received while the controller is not connected
+// to the management cluster.
+type NotReadyPolicy string
+
+const (
+	// QueueWhenNotReady stores the samples so they are sent once the controller is connected.
+	QueueWhenNotReady NotReadyPolicy = "queue"
+	// RejectWhenNotReady rejects the samples as unavailable so the devices send them again later.
+	RejectWhenNotReady NotReadyPolicy = "reject"
+)
+
+func (p NotReadyPolicy) Validate() derrors.Error {
+	if p != QueueWhenNotReady && p != RejectWhenNotReady {
+		return derrors.NewInvalidArgumentError(fmt.Sprintf("unknown not ready policy %s", p))
+	}
+	return nil
+}
+
 type Manager struct {
-	Threshold int
-	// LoginHelper Helper
-	ClusterAPILoginHelper *login_helper.LoginHelper
-	// clusterAPIClient
-	ClusterAPIClient grpc_cluster_api_go.DeviceManagerClient
+	// Thresholds with the latency threshold policies.
+	Thresholds *threshold.Resolver
+	// Evaluator with the latency windows of the devices.
+	Evaluator *latency.Evaluator
+	// LatencyQueue with the samples waiting to be sent to the cluster API.
+	LatencyQueue *queue.Queue
+	// Selectors with the cluster selection strategy of each organization.
+	Selectors *selector.Registry
+	// Assignments with the cluster selected for each device.
+	Assignments assignment.Store
+	// AssignmentPolicy limiting the moves of the devices between clusters.
+	AssignmentPolicy assignment.Policy
+	// Liveness with the last time each device was seen.
+	Liveness *liveness.Tracker
+	// Notifier of the sustained latency degradations. Nil if there are no webhooks.
+	Notifier *notifier.Notifier
+	// Ready returns an error while the controller is not connected to the management cluster.
+	Ready health.Check
+	// NotReadyPolicy applied to the latency samples received while the controller is not ready.
+	NotReadyPolicy NotReadyPolicy
 }
 
-func NewManager(threshold int, helper *login_helper.LoginHelper, client grpc_cluster_api_go.DeviceManagerClient) Manager {
+func NewManager(thresholds *threshold.Resolver, evaluator *latency.Evaluator, latencyQueue *queue.Queue, selectors *selector.Registry,
+	assignments assignment.Store, assignmentPolicy assignment.Policy, tracker *liveness.Tracker, notifier *notifier.Notifier,
+	ready health.Check, notReadyPolicy NotReadyPolicy) Manager {
 	return Manager{
-		Threshold:             threshold,
-		ClusterAPILoginHelper: helper,
-		ClusterAPIClient:      client,
+		Thresholds:       thresholds,
+		Evaluator:        evaluator,
+		LatencyQueue:     latencyQueue,
+		Selectors:        selectors,
+		Assignments:      assignments,
+		AssignmentPolicy: assignmentPolicy,
+		Liveness:         tracker,
+		Notifier:         notifier,
+		Ready:            ready,
+		NotReadyPolicy:   notReadyPolicy,
 	}
 }
 
-func (m *Manager) Ping() (*grpc_common_go.Success, error) {
+// Ping records that the device has been seen. The device is only tracked if its claims are known.
+func (m *Manager) Ping(deviceClaims *claims.DeviceClaims) (*grpc_common_go.Success, error) {
+	if deviceClaims != nil {
+		m.Liveness.Seen(deviceClaims.OrganizationId, deviceClaims.DeviceGroupId, deviceClaims.DeviceId)
+	}
 	return &grpc_common_go.Success{}, nil
 }
 
-func (m *Manager) sendRegisterPingToClusterAPI(ping *grpc_device_controller_go.RegisterLatencyRequest) error {
-
-	ctx, cancel := m.ClusterAPILoginHelper.GetContext()
-	defer cancel()
-
-	_, err := m.ClusterAPIClient.RegisterLatency(ctx, ping)
+// enqueueRegisterPing stores the latency sample so it is sent to the cluster API. It returns an Unavailable
+// error if the sample cannot be stored, so the device sends it again later.
+func (m *Manager) enqueueRegisterPing(ping *grpc_device_controller_go.RegisterLatencyRequest) derrors.Error {
+	payload, err := proto.Marshal(ping)
 	if err != nil {
-		st := grpc_status.Convert(err).Code()
-		if st == codes.Unauthenticated {
-			errLogin := m.ClusterAPILoginHelper.RerunAuthentication()
-			if errLogin != nil {
-				log.Error().Err(errLogin).Msg("error during reauthentication")
-			}
-			ctx2, cancel2 := m.ClusterAPILoginHelper.GetContext()
-			defer cancel2()
-			_, err = m.ClusterAPIClient.RegisterLatency(ctx2, ping)
-		} else {
-			log.Error().Err(err).Str("OrganizationId", ping.OrganizationId).Str("deviceGroupId", ping.DeviceGroupId).Str("deviceId", ping.DeviceId).Msgf("error recording latencies")
-		}
+		return derrors.AsError(err, "cannot marshal latency sample")
+	}
+	qErr := m.LatencyQueue.Push(payload)
+	if qErr != nil {
+		log.Error().Str("err", qErr.DebugReport()).Str("OrganizationId", ping.OrganizationId).Str("deviceGroupId", ping.DeviceGroupId).Str("deviceId", ping.DeviceId).Msg("cannot enqueue latency sample")
+		return derrors.NewUnavailableError("cannot store the latency sample, try again later", qErr)
 	}
-
 	return nil
 }
 
 func (m *Manager) RegisterPing(ping *grpc_device_controller_go.RegisterLatencyRequest) (*grpc_device_controller_go.RegisterLatencyResult, error) {
+	m.Liveness.Seen(ping.OrganizationId, ping.DeviceGroupId, ping.DeviceId)
+	if m.NotReadyPolicy == RejectWhenNotReady {
+		if err := m.Ready(); err != nil {
+			return nil, conversions.ToGRPCError(derrors.NewUnavailableError("not connected to the management cluster, try again later", err))
+		}
+	}
+	// The sample is stored before it is evaluated, so a sample that the device has to send again is not
+	// counted twice
+	if err := m.enqueueRegisterPing(ping); err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+	metrics.DeviceLatency.WithLabelValues(ping.OrganizationId, ping.DeviceGroupId).Observe(float64(ping.Latency))
+
 	result := grpc_device_controller_go.RegisterResult_OK
-	if int(ping.Latency) > m.Threshold {
+	deviceThreshold := m.Thresholds.GetThreshold(ping.OrganizationId, ping.DeviceGroupId, ping.DeviceId)
+	checkRequired, stats := m.Evaluator.Add(ping.OrganizationId, ping.DeviceGroupId, ping.DeviceId, int(ping.Latency), deviceThreshold)
+	if checkRequired {
 		result = grpc_device_controller_go.RegisterResult_LATENCY_CHECK_REQUIRED
+		metrics.LatencyChecksRequired.WithLabelValues(ping.OrganizationId, ping.DeviceGroupId).Inc()
+		log.Debug().Str("OrganizationId", ping.OrganizationId).Str("deviceGroupId", ping.DeviceGroupId).Str("deviceId", ping.DeviceId).
+			Int("threshold", deviceThreshold).Interface("stats", stats).Msg("sustained latency degradation")
+		if m.Notifier != nil {
+			m.Notifier.LatencyDegraded(notifier.Degradation{
+				OrganizationId: ping.OrganizationId,
+				DeviceGroupId:  ping.DeviceGroupId,
+				DeviceId:       ping.DeviceId,
+				Threshold:      deviceThreshold,
+				Stats:          stats,
+			})
+		}
 	}
 
-	go m.sendRegisterPingToClusterAPI(ping)
-
 	return &grpc_device_controller_go.RegisterLatencyResult{
 		Result: result,
 	}, nil
@@ -86,17 +158,33 @@ func (m *Manager) RegisterPing(ping *grpc_device_controller_go.RegisterLatencyRe
 
 func (m *Manager) SelectCluster(request *grpc_device_controller_go.SelectClusterRequest) (*grpc_device_controller_go.SelectedCluster, error) {
 
-	pos := 0
-	min := math.MaxInt32
-
-	for i, latency := range request.Latencies {
-		if int(latency) < min {
-			min = int(latency)
-			pos = i
-		}
-	}
+	// The selection runs while the assignment of the device is locked, so concurrent requests of a device
+	// cannot bypass the cooldown and the move limit
+	candidate := selector.NoCluster
+	reason := ""
+	selected := m.Assignments.Update(request.OrganizationId, request.DeviceGroupId, request.DeviceId,
+		func(previous *assignment.Assignment) (assignment.Assignment, assignment.Record) {
+			current := selector.NoCluster
+			if previous != nil && previous.ClusterIndex < len(request.Latencies) {
+				current = previous.ClusterIndex
+			}
+			candidate = m.Selectors.GetSelector(request.OrganizationId).Select(request.Latencies, current)
+
+			now := time.Now()
+			var next assignment.Assignment
+			next, reason = m.AssignmentPolicy.Apply(previous, candidate, len(request.Latencies), now)
+			return next, assignment.Record{
+				Timestamp:    now,
+				Candidate:    candidate,
+				ClusterIndex: next.ClusterIndex,
+				Latencies:    request.Latencies,
+				Reason:       reason,
+			}
+		})
+	log.Debug().Str("OrganizationId", request.OrganizationId).Str("deviceGroupId", request.DeviceGroupId).Str("deviceId", request.DeviceId).
+		Int("candidate", candidate).Int("selected", selected.ClusterIndex).Str("reason", reason).Msg("cluster selected")
 
 	return &grpc_device_controller_go.SelectedCluster{
-		ClusterIndex: int32(pos),
+		ClusterIndex: int32(selected.ClusterIndex),
 	}, nil
 }
@@ -0,0 +1,154 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ping
+
+import (
+	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/assignment"
+	"github.com/nalej/device-controller/pkg/latency"
+	"github.com/nalej/device-controller/pkg/liveness"
+	"github.com/nalej/device-controller/pkg/metrics"
+	"github.com/nalej/device-controller/pkg/queue"
+	"github.com/nalej/device-controller/pkg/selector"
+	"github.com/nalej/device-controller/pkg/threshold"
+	"github.com/nalej/grpc-device-controller-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	grpc_status "google.golang.org/grpc/status"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// pendingDeliverer keeps the samples in the queue, as the queue is not run by the tests.
+type pendingDeliverer struct {
+}
+
+func (d *pendingDeliverer) Deliver(payloads [][]byte) []derrors.Error {
+	return make([]derrors.Error, len(payloads))
+}
+
+// newManager creates a manager whose latency queue, stored in dir, accepts the given number of samples.
+func newManager(dir string, queueSize int, ready func() derrors.Error, policy NotReadyPolicy) Manager {
+	latencyQueue, err := queue.NewQueue(queue.Config{
+		Path:           dir,
+		MaxSize:        queueSize,
+		MaxAttempts:    1,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Second,
+		MaxBatchSize:   1,
+		FlushInterval:  time.Second,
+		Workers:        1,
+	}, &pendingDeliverer{})
+	gomega.Expect(err).To(gomega.BeNil())
+	selectors, err := selector.NewRegistry(selector.StrategyConfig{Strategy: selector.MinLatencyStrategy})
+	gomega.Expect(err).To(gomega.BeNil())
+	evaluator := latency.NewEvaluator(latency.Rule{Statistic: latency.StatisticLast, WindowSize: 1, ConsecutiveWindows: 1, EWMAAlpha: 0.5})
+	tracker := liveness.NewTracker(liveness.Config{StaleTimeout: time.Minute, OfflineTimeout: time.Hour, CheckInterval: time.Minute, ForgetTimeout: time.Hour})
+	return NewManager(threshold.NewResolver(100), evaluator, latencyQueue, selectors,
+		assignment.NewMemoryStore(time.Hour, 10), assignment.Policy{Cooldown: time.Hour}, tracker, nil, ready, policy)
+}
+
+var _ = ginkgo.Describe("Manager", func() {
+
+	var dir string
+
+	sample := func(latency int32) *grpc_device_controller_go.RegisterLatencyRequest {
+		return &grpc_device_controller_go.RegisterLatencyRequest{OrganizationId: "org", DeviceGroupId: "group", DeviceId: "device", Latency: latency}
+	}
+
+	ready := func() derrors.Error {
+		return nil
+	}
+
+	notReady := func() derrors.Error {
+		return derrors.NewUnavailableError("not logged in")
+	}
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "ping")
+		gomega.Expect(err).To(gomega.Succeed())
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+	})
+
+	table.DescribeTable("RegisterPing",
+		func(latency int32, expected grpc_device_controller_go.RegisterResult) {
+			manager := newManager(dir, 10, ready, QueueWhenNotReady)
+			result, err := manager.RegisterPing(sample(latency))
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(result.Result).To(gomega.Equal(expected))
+			gomega.Expect(manager.LatencyQueue.Len()).To(gomega.Equal(1))
+			state, _, _ := manager.Liveness.GetState("org", "group", "device")
+			gomega.Expect(state).To(gomega.Equal(liveness.Online))
+		},
+		table.Entry("latency below the threshold", int32(50), grpc_device_controller_go.RegisterResult_OK),
+		table.Entry("latency above the threshold", int32(150), grpc_device_controller_go.RegisterResult_LATENCY_CHECK_REQUIRED),
+	)
+
+	table.DescribeTable("samples that cannot be stored",
+		func(queueSize int, queued int, ready func() derrors.Error, policy NotReadyPolicy) {
+			manager := newManager(dir, queueSize, ready, policy)
+			for i := 0; i < queued; i++ {
+				gomega.Expect(manager.LatencyQueue.Push([]byte("sample"))).To(gomega.Succeed())
+			}
+			_, err := manager.RegisterPing(sample(50))
+			gomega.Expect(err).NotTo(gomega.Succeed())
+			gomega.Expect(grpc_status.Code(err)).To(gomega.Equal(codes.Unavailable))
+			gomega.Expect(manager.LatencyQueue.Len()).To(gomega.Equal(queued))
+		},
+		table.Entry("queue full", 1, 1, ready, QueueWhenNotReady),
+		table.Entry("queue full while not ready", 1, 1, notReady, QueueWhenNotReady),
+		table.Entry("rejected while not ready", 10, 0, notReady, RejectWhenNotReady),
+	)
+
+	ginkgo.It("should not evaluate the samples that cannot be stored", func() {
+		manager := newManager(dir, 1, ready, QueueWhenNotReady)
+		checksRequired := testutil.ToFloat64(metrics.LatencyChecksRequired.WithLabelValues("org", "group"))
+		_, err := manager.RegisterPing(sample(50))
+		gomega.Expect(err).To(gomega.Succeed())
+		_, err = manager.RegisterPing(sample(150))
+		gomega.Expect(grpc_status.Code(err)).To(gomega.Equal(codes.Unavailable))
+		gomega.Expect(testutil.ToFloat64(metrics.LatencyChecksRequired.WithLabelValues("org", "group"))).To(gomega.Equal(checksRequired))
+	})
+
+	ginkgo.It("should keep the selected cluster during the cooldown", func() {
+		manager := newManager(dir, 10, ready, QueueWhenNotReady)
+		request := &grpc_device_controller_go.SelectClusterRequest{OrganizationId: "org", DeviceGroupId: "group", DeviceId: "device"}
+		request.Latencies = []int32{30, 10, 20}
+		selected, err := manager.SelectCluster(request)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(selected.ClusterIndex).To(gomega.Equal(int32(1)))
+
+		request.Latencies = []int32{30, 10, 5}
+		selected, err = manager.SelectCluster(request)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(selected.ClusterIndex).To(gomega.Equal(int32(1)))
+
+		request.Latencies = []int32{5}
+		selected, err = manager.SelectCluster(request)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(selected.ClusterIndex).To(gomega.Equal(int32(0)))
+	})
+
+})
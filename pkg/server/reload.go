@@ -0,0 +1,218 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/nalej/authx/pkg/interceptor"
+	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/login_helper"
+	"github.com/nalej/device-controller/pkg/ratelimit"
+	"github.com/nalej/device-controller/pkg/reload"
+	"github.com/nalej/device-controller/pkg/selector"
+	"github.com/nalej/device-controller/pkg/threshold"
+	"github.com/nalej/device-controller/pkg/tlsdial"
+	"github.com/rs/zerolog/log"
+	"reflect"
+)
+
+// reloadAuthConfig returns the function that reloads the permissions file. The authx interceptor keeps a
+// reference to the AuthorizationConfig it was created with, so the new values are copied into it once the
+// file has been validated and no request is being authorized.
+func (s *Service) reloadAuthConfig(authConfig *interceptor.AuthorizationConfig) reload.ReloadFunc {
+	return func() derrors.Error {
+		newConfig, err := s.Configuration.LoadAuthConfig()
+		if err != nil {
+			return err
+		}
+		if !newConfig.AllowsAll && len(newConfig.Permissions) == 0 {
+			return derrors.NewInvalidArgumentError("authx config does not define any permission")
+		}
+		s.authx.update(func() {
+			logAuthConfigChanges(authConfig, newConfig)
+			*authConfig = *newConfig
+		})
+		log.Info().Bool("AllowsAll", newConfig.AllowsAll).Int("permissions", len(newConfig.Permissions)).Msg("Auth config reloaded")
+		return nil
+	}
+}
+
+// logAuthConfigChanges logs the permissions that differ between two authorization configs.
+func logAuthConfigChanges(previous *interceptor.AuthorizationConfig, current *interceptor.AuthorizationConfig) {
+	if current.AllowsAll != previous.AllowsAll {
+		log.Info().Bool("previous", previous.AllowsAll).Bool("current", current.AllowsAll).Msg("authx AllowsAll changed")
+	}
+	for method, permission := range current.Permissions {
+		previousPermission, exists := previous.Permissions[method]
+		if !exists {
+			log.Info().Str("method", method).Interface("permission", permission).Msg("authx permission added")
+		} else if !reflect.DeepEqual(previousPermission, permission) {
+			log.Info().Str("method", method).Interface("previous", previousPermission).Interface("current", permission).Msg("authx permission changed")
+		}
+	}
+	for method, permission := range previous.Permissions {
+		if _, exists := current.Permissions[method]; !exists {
+			log.Info().Str("method", method).Interface("permission", permission).Msg("authx permission removed")
+		}
+	}
+}
+
+// reloadThresholds returns the function that reloads the threshold policy file.
+func (s *Service) reloadThresholds(thresholds *threshold.Resolver) reload.ReloadFunc {
+	return func() derrors.Error {
+		policyFile, err := threshold.LoadPolicyFile(s.Configuration.ThresholdPolicyPath)
+		if err != nil {
+			return err
+		}
+		changes := thresholds.Update(policyFile)
+		for _, change := range changes {
+			log.Info().Str("scope", change.Key).Int("previous", change.Previous).Int("current", change.Current).Msg("threshold changed")
+		}
+		log.Info().Int("policies", len(policyFile.Policies)).Int("changes", len(changes)).Msg("Threshold policies reloaded")
+		return nil
+	}
+}
+
+// reloadSelectors returns the function that reloads the selection policy file.
+func (s *Service) reloadSelectors(selectors *selector.Registry) reload.ReloadFunc {
+	return func() derrors.Error {
+		policyFile, err := selector.LoadPolicyFile(s.Configuration.SelectionPolicyPath)
+		if err != nil {
+			return err
+		}
+		err = selectors.Update(policyFile)
+		if err != nil {
+			return err
+		}
+		log.Info().Int("organizations", len(policyFile.Organizations)).Msg("Selection policies reloaded")
+		return nil
+	}
+}
+
+// reloadRateLimits returns the function that reloads the rate limit policy file.
+func (s *Service) reloadRateLimits(limiter *ratelimit.Limiter) reload.ReloadFunc {
+	return func() derrors.Error {
+		policyFile, err := ratelimit.LoadPolicyFile(s.Configuration.RateLimitPolicyPath)
+		if err != nil {
+			return err
+		}
+		err = limiter.Update(policyFile)
+		if err != nil {
+			return err
+		}
+		log.Info().Int("organizations", len(policyFile.Organizations)).Msg("Rate limit policies reloaded")
+		return nil
+	}
+}
+
+// reloadCredentials returns the function that logs in again with the email and password files when they
+// change, for example when the Kubernetes secret is rotated. The access to the device secrets is created
+// again with the new credentials, as it logs in on its own.
+func (s *Service) reloadCredentials(helper *login_helper.LoginHelper, clients *Clients, access *secretAccess) reload.ReloadFunc {
+	return func() derrors.Error {
+		email, password, err := s.Configuration.ReadCredentials()
+		if err != nil {
+			return err
+		}
+		helper.SetCredentials(email, password)
+		err = helper.Login()
+		if err != nil {
+			return err
+		}
+		s.Configuration.Email = email
+		s.Configuration.Password = password
+		err = access.updateCredentials(clients, email, password)
+		if err != nil {
+			return err
+		}
+		log.Info().Str("email", email).Msg("Logged in with the reloaded credentials")
+		return nil
+	}
+}
+
+// WatchCredentialFiles adds the email and password files to the watcher so the helper and the access to the
+// device secrets log in again when they change.
+func (s *Service) WatchCredentialFiles(watcher *reload.Watcher, helper *login_helper.LoginHelper, clients *Clients,
+	access *secretAccess) derrors.Error {
+	for _, path := range []string{s.Configuration.EmailFile, s.Configuration.PasswordFile} {
+		if path == "" {
+			continue
+		}
+		err := watcher.Add(path, s.reloadCredentials(helper, clients, access))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reloadCertificates returns the function that loads the CA and the client certificate again when they are
+// rotated. The connections already established keep their certificates and the new handshakes use the
+// reloaded ones.
+func (s *Service) reloadCertificates(material *tlsdial.Material) reload.ReloadFunc {
+	return func() derrors.Error {
+		err := material.Reload()
+		if err != nil {
+			return err
+		}
+		log.Info().Str("caCertPath", s.Configuration.CACertPath).Str("clientCertPath", s.Configuration.ClientCertPath).Msg("Certificates reloaded")
+		return nil
+	}
+}
+
+// WatchCertificates adds the CA and the client certificate files to the watcher so the new connections use
+// the rotated certificates.
+func (s *Service) WatchCertificates(watcher *reload.Watcher, material *tlsdial.Material) derrors.Error {
+	for _, path := range material.Files() {
+		err := watcher.Add(path, s.reloadCertificates(material))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WatchConfigFiles creates a watcher that reloads the permissions and policy files when they change.
+func (s *Service) WatchConfigFiles(authConfig *interceptor.AuthorizationConfig, thresholds *threshold.Resolver, selectors *selector.Registry,
+	limiter *ratelimit.Limiter) (*reload.Watcher, derrors.Error) {
+	watcher, err := reload.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = watcher.Add(s.Configuration.AuthConfigPath, s.reloadAuthConfig(authConfig))
+	if err != nil {
+		return nil, err
+	}
+	if s.Configuration.ThresholdPolicyPath != "" {
+		err = watcher.Add(s.Configuration.ThresholdPolicyPath, s.reloadThresholds(thresholds))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.Configuration.SelectionPolicyPath != "" {
+		err = watcher.Add(s.Configuration.SelectionPolicyPath, s.reloadSelectors(selectors))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.Configuration.RateLimitPolicyPath != "" {
+		err = watcher.Add(s.Configuration.RateLimitPolicyPath, s.reloadRateLimits(limiter))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return watcher, nil
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/login_helper"
+	"github.com/nalej/device-controller/pkg/reload"
+	"github.com/nalej/grpc-authx-go"
+	"github.com/nalej/grpc-login-api-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// credentialsLoginServer accepts the logins with the expected password.
+type credentialsLoginServer struct {
+	password string
+}
+
+func (s *credentialsLoginServer) LoginWithBasicCredentials(_ context.Context, request *grpc_authx_go.LoginWithBasicCredentialsRequest) (*grpc_authx_go.LoginResponse, error) {
+	if request.Password != s.password {
+		return nil, derrors.NewUnauthenticatedError("invalid credentials")
+	}
+	return &grpc_authx_go.LoginResponse{Token: "login-" + request.Username, RefreshToken: "refresh"}, nil
+}
+
+func (s *credentialsLoginServer) RefreshToken(_ context.Context, request *grpc_authx_go.RefreshTokenRequest) (*grpc_authx_go.LoginResponse, error) {
+	return &grpc_authx_go.LoginResponse{Token: request.Token, RefreshToken: request.RefreshToken}, nil
+}
+
+var _ = ginkgo.Describe("Credential reload", func() {
+
+	var dir string
+	var server *grpc.Server
+	var service *Service
+	var helper *login_helper.LoginHelper
+	var access *secretAccess
+
+	writeSecret := func(name string, value string) string {
+		path := filepath.Join(dir, name)
+		gomega.Expect(ioutil.WriteFile(path, []byte(value+"\n"), 0600)).To(gomega.Succeed())
+		return path
+	}
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "credentials")
+		gomega.Expect(err).To(gomega.Succeed())
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		gomega.Expect(err).To(gomega.Succeed())
+		server = grpc.NewServer()
+		grpc_login_api_go.RegisterLoginServer(server, &credentialsLoginServer{password: "rotated"})
+		go func(server *grpc.Server, listener net.Listener) {
+			_ = server.Serve(listener)
+		}(server, listener)
+
+		conf := validConfig(dir)
+		conf.EmailFile = writeSecret("email", "device-controller@nalej.com")
+		conf.PasswordFile = writeSecret("password", "password")
+		service = NewService(conf)
+		service.Configuration.Email, service.Configuration.Password, _ = conf.ReadCredentials()
+		helper = login_helper.NewLogin("127.0.0.1", listener.Addr().(*net.TCPAddr).Port,
+			service.Configuration.Email, service.Configuration.Password, nil, login_helper.NewMemoryStore())
+		access = newSecretAccess(service.Configuration.Email, service.Configuration.Password)
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Stop()
+		gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+	})
+
+	table.DescribeTable("reloaded credential files",
+		func(email string, password string, succeeds bool) {
+			writeSecret("email", email)
+			writeSecret("password", password)
+			err := service.reloadCredentials(helper, &Clients{}, access)()
+			expectedEmail, expectedPassword := "device-controller@nalej.com", "password"
+			if succeeds {
+				gomega.Expect(err).To(gomega.Succeed())
+				gomega.Expect(helper.Ready()).To(gomega.Succeed())
+				expectedEmail, expectedPassword = email, password
+			} else {
+				gomega.Expect(err).NotTo(gomega.Succeed())
+			}
+			gomega.Expect(service.Configuration.Email).To(gomega.Equal(expectedEmail))
+			gomega.Expect(service.Configuration.Password).To(gomega.Equal(expectedPassword))
+			gomega.Expect(access.email).To(gomega.Equal(expectedEmail))
+			gomega.Expect(access.password).To(gomega.Equal(expectedPassword))
+		},
+		table.Entry("rotated password", "device-controller@nalej.com", "rotated", true),
+		table.Entry("rotated email and password", "other@nalej.com", "rotated", true),
+		table.Entry("password rejected by the login API", "device-controller@nalej.com", "wrong", false),
+		table.Entry("empty password file", "device-controller@nalej.com", "", false),
+	)
+
+	ginkgo.It("should log in again when the password file is rotated", func() {
+		watcher, err := reload.NewWatcher()
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(service.WatchCredentialFiles(watcher, helper, &Clients{}, access)).To(gomega.Succeed())
+		go watcher.Run()
+		writeSecret("password", "rotated")
+		gomega.Eventually(helper.Ready, 5*time.Second).Should(gomega.Succeed())
+		watcher.Stop()
+		gomega.Expect(service.Configuration.Password).To(gomega.Equal("rotated"))
+		gomega.Expect(access.password).To(gomega.Equal("rotated"))
+	})
+
+})
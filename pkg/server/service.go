@@ -18,15 +18,26 @@ package server
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"github.com/nalej/authx/pkg/interceptor"
-	"github.com/nalej/authx/pkg/interceptor/devinterceptor"
 	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/assignment"
+	"github.com/nalej/device-controller/pkg/audit"
+	"github.com/nalej/device-controller/pkg/health"
+	"github.com/nalej/device-controller/pkg/latency"
+	"github.com/nalej/device-controller/pkg/liveness"
 	"github.com/nalej/device-controller/pkg/login_helper"
+	"github.com/nalej/device-controller/pkg/metrics"
+	"github.com/nalej/device-controller/pkg/notifier"
+	"github.com/nalej/device-controller/pkg/queue"
+	"github.com/nalej/device-controller/pkg/ratelimit"
+	"github.com/nalej/device-controller/pkg/reload"
+	"github.com/nalej/device-controller/pkg/selector"
 	"github.com/nalej/device-controller/pkg/server/ping"
+	"github.com/nalej/device-controller/pkg/supervisor"
+	"github.com/nalej/device-controller/pkg/threshold"
+	"github.com/nalej/device-controller/pkg/tlsdial"
 	"github.com/nalej/grpc-cluster-api-go"
 	"github.com/nalej/grpc-device-controller-go"
 	"github.com/nalej/grpc-login-api-go"
@@ -34,151 +45,274 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
-	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // Service structure with the configuration and the gRPC server.
 type Service struct {
 	Configuration Config
+	// Health with the readiness checks of the service.
+	Health *health.Checker
+	// components with the servers and background tasks stopped on shutdown.
+	components components
+	// gatewayListener with the loopback connections of the HTTP gateway to its gRPC server.
+	gatewayListener net.Listener
+	// tasks with the subsystems of the service. The first one that fails stops the service.
+	tasks *supervisor.Supervisor
+	// stopping is closed when the shutdown starts.
+	stopping chan struct{}
+	// authx keeps the authorization config from being reloaded while a request is in progress.
+	authx *authxGuard
 }
 
 // Clients structure with the gRPC clients for remote services.
 func NewService(conf Config) *Service {
 	return &Service{
-		conf,
+		Configuration: conf,
+		Health:        health.NewChecker(LoginCheck, TokenRenewalCheck, ClusterAPICheck, SecretAccessCheck, GRPCCheck),
+		tasks:         supervisor.NewSupervisor(),
+		stopping:      make(chan struct{}),
+		authx:         newAuthxGuard(metrics.NewStatsHandler()),
 	}
 }
 
 type Clients struct {
 	DeviceManagerClient grpc_cluster_api_go.DeviceManagerClient
 	LoginClient         grpc_login_api_go.LoginClient
+	// DeviceManagerConn with the connection to the cluster API.
+	DeviceManagerConn *grpc.ClientConn
 }
 
-func (s *Service) GetClients() (*Clients, derrors.Error) {
+// GetTLSMaterial loads the certificates of the connections with the management cluster.
+func (s *Service) GetTLSMaterial() (*tlsdial.Material, derrors.Error) {
+	return tlsdial.NewMaterial(tlsdial.Config{
+		CACertPath:       s.Configuration.CACertPath,
+		ClientCertPath:   s.Configuration.ClientCertPath,
+		SkipCAValidation: s.Configuration.SkipServerCertValidation,
+	})
+}
+
+// getLoginMaterial returns the TLS material of the connections with the Login API, or nil if they do not use TLS.
+func (s *Service) getLoginMaterial(material *tlsdial.Material) *tlsdial.Material {
+	if !s.Configuration.UseTLSForLogin {
+		return nil
+	}
+	return material
+}
 
-	dmConn, err := s.getSecureAPIConnection(s.Configuration.ClusterAPIHostname, int(s.Configuration.ClusterAPIPort), s.Configuration.CACertPath, s.Configuration.ClientCertPath, s.Configuration.SkipServerCertValidation)
+func (s *Service) GetClients(material *tlsdial.Material) (*Clients, derrors.Error) {
+
+	dmConn, err := tlsdial.Dial(s.Configuration.ClusterAPIHostname, int(s.Configuration.ClusterAPIPort), material)
 	if err != nil {
 		return nil, derrors.AsError(err, "cannot create connection with the Cluster API manager")
 	}
 	deviceClient := grpc_cluster_api_go.NewDeviceManagerClient(dmConn)
 
-	loginConn, err := s.getSecureAPIConnection(s.Configuration.LoginHostname, int(s.Configuration.LoginPort), s.Configuration.CACertPath, s.Configuration.ClientCertPath, s.Configuration.SkipServerCertValidation)
+	loginConn, err := tlsdial.Dial(s.Configuration.LoginHostname, int(s.Configuration.LoginPort), s.getLoginMaterial(material))
 	if err != nil {
 		return nil, derrors.AsError(err, "cannot create connection with the Login API manager")
 	}
 	loginClient := grpc_login_api_go.NewLoginClient(loginConn)
 
-	return &Clients{DeviceManagerClient: deviceClient, LoginClient: loginClient}, nil
+	return &Clients{DeviceManagerClient: deviceClient, LoginClient: loginClient, DeviceManagerConn: dmConn}, nil
 }
 
-func (s *Service) getSecureAPIConnection(hostname string, port int, caCertPath string, clientCertPath string, skipCAValidation bool) (*grpc.ClientConn, derrors.Error) {
-	// Build connection with cluster API
-	rootCAs := x509.NewCertPool()
-	tlsConfig := &tls.Config{
-		ServerName: hostname,
+// Run the service, launch the service handler
+func (s *Service) Run() error {
+	vErr := s.Configuration.Validate()
+	if vErr != nil {
+		return vErr
 	}
+	s.Configuration.Print()
 
-	if caCertPath != "" {
-		log.Debug().Str("caCertPath", caCertPath).Msg("loading CA cert")
-		caCert, err := ioutil.ReadFile(caCertPath)
-		if err != nil {
-			return nil, derrors.NewInternalError("Error loading CA certificate")
-		}
-		added := rootCAs.AppendCertsFromPEM(caCert)
-		if !added {
-			return nil, derrors.NewInternalError("cannot add CA certificate to the pool")
-		}
-		tlsConfig.RootCAs = rootCAs
+	email, password, cErr := s.Configuration.ReadCredentials()
+	if cErr != nil {
+		return cErr
 	}
+	s.Configuration.Email = email
+	s.Configuration.Password = password
 
-	targetAddress := fmt.Sprintf("%s:%d", hostname, port)
-	log.Debug().Str("address", targetAddress).Msg("creating cluster API connection")
+	authConfig, authErr := s.Configuration.LoadAuthConfig()
+	if authErr != nil {
+		return authErr
+	}
 
-	if clientCertPath != "" {
-		log.Debug().Str("clientCertPath", clientCertPath).Msg("loading client certificate")
-		clientCert, err := tls.LoadX509KeyPair(fmt.Sprintf("%s/tls.crt", clientCertPath), fmt.Sprintf("%s/tls.key", clientCertPath))
-		if err != nil {
-			log.Error().Str("error", err.Error()).Msg("Error loading client certificate")
-			return nil, derrors.NewInternalError("Error loading client certificate")
-		}
+	log.Info().Bool("AllowsAll", authConfig.AllowsAll).Int("permissions", len(authConfig.Permissions)).Msg("Auth config")
 
-		tlsConfig.Certificates = []tls.Certificate{clientCert}
-		tlsConfig.BuildNameToCertificate()
+	thresholds, tErr := s.Configuration.LoadThresholds()
+	if tErr != nil {
+		return tErr
 	}
-	log.Debug().Str("address", targetAddress).Str("caCertPath", caCertPath).Bool("skipCAValidation", skipCAValidation).Msg("creating secure connection")
 
-	if skipCAValidation {
-		log.Debug().Msg("skipping server cert validation")
-		tlsConfig.InsecureSkipVerify = true
+	selectors, sErr := s.Configuration.LoadSelectors()
+	if sErr != nil {
+		return sErr
 	}
 
-	creds := credentials.NewTLS(tlsConfig)
-
-	log.Debug().Interface("creds", creds.Info()).Msg("Secure credentials")
-	sConn, dErr := grpc.Dial(targetAddress, grpc.WithTransportCredentials(creds))
-	if dErr != nil {
-		return nil, derrors.AsError(dErr, "cannot create connection with the cluster API service")
+	limiter, lErr := s.Configuration.LoadRateLimiter()
+	if lErr != nil {
+		return lErr
 	}
-	return sConn, nil
-}
 
-// Run the service, launch the service handler
-func (s *Service) Run() error {
-	vErr := s.Configuration.Validate()
-	if vErr != nil {
-		log.Fatal().Str("err", vErr.DebugReport()).Msg("invalid configuration")
+	gErr := s.listenGateway()
+	if gErr != nil {
+		return gErr
 	}
-	s.Configuration.Print()
 
-	authConfig, authErr := s.Configuration.LoadAuthConfig()
-	if authErr != nil {
-		log.Fatal().Str("err", authErr.DebugReport()).Msg("cannot load authx config")
+	watcher, wErr := s.WatchConfigFiles(authConfig, thresholds, selectors, limiter)
+	if wErr != nil {
+		return wErr
 	}
+	s.components.setWatcher(watcher)
+	s.tasks.Go("watcher", supervisor.Worker(watcher.Run))
 
-	log.Info().Bool("AllowsAll", authConfig.AllowsAll).Int("permissions", len(authConfig.Permissions)).Msg("Auth config")
+	assignments := assignment.NewMemoryStore(s.Configuration.AssignmentTTL, s.Configuration.AssignmentHistorySize)
 
-	go s.LaunchGRPC(authConfig)
-	return s.LaunchHTTP()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
 
+	s.tasks.Go("grpc-health", s.LaunchGRPCHealth)
+	s.tasks.Go("grpc", func() error {
+		return s.LaunchGRPC(authConfig, thresholds, selectors, limiter, assignments, watcher)
+	})
+	s.tasks.Go("http", s.LaunchHTTP)
+	s.tasks.Go("metrics", func() error {
+		return s.LaunchMetrics(assignments)
+	})
+
+	// The service runs until a signal is received or a subsystem fails
+	select {
+	case sig := <-signals:
+		log.Info().Str("signal", sig.String()).Msg("shutting down")
+	case <-s.tasks.Failed():
+		log.Error().Str("err", s.tasks.Err().Error()).Msg("shutting down after a failure")
+	}
+	// The shutdown timeout bounds both the shutdown of the components and the wait for their tasks
+	deadline := time.Now().Add(s.Configuration.ShutdownTimeout)
+	s.Shutdown(deadline)
+	return s.tasks.Wait(time.Until(deadline))
 }
 
-func (s *Service) LaunchGRPC(authConfig *interceptor.AuthorizationConfig) error {
+func (s *Service) LaunchGRPC(authConfig *interceptor.AuthorizationConfig, thresholds *threshold.Resolver, selectors *selector.Registry, limiter *ratelimit.Limiter,
+	assignments assignment.Store, watcher *reload.Watcher) error {
+	material, cErr := s.GetTLSMaterial()
+	if cErr != nil {
+		return cErr
+	}
+	cErr = s.WatchCertificates(watcher, material)
+	if cErr != nil {
+		return cErr
+	}
 	// create clients
-	clients, cErr := s.GetClients()
+	clients, cErr := s.GetClients(material)
 	if cErr != nil {
-		log.Fatal().Str("err", cErr.DebugReport()).Msg("cannot generate clients")
 		return cErr
 	}
 
-	clusterAPILoginHelper := login_helper.NewLogin(s.Configuration.LoginHostname, int(s.Configuration.LoginPort), s.Configuration.UseTLSForLogin,
-		s.Configuration.Email, s.Configuration.Password, "", "", true)
-
-	cErr = clusterAPILoginHelper.Login()
+	credentialStore, cErr := s.Configuration.GetCredentialStore()
 	if cErr != nil {
-		log.Fatal().Str("err", cErr.DebugReport()).Msg("there was an error requesting cluster-api login")
+		return cErr
+	}
+	clusterAPILoginHelper := login_helper.NewLogin(s.Configuration.LoginHostname, int(s.Configuration.LoginPort),
+		s.Configuration.Email, s.Configuration.Password, s.getLoginMaterial(material), credentialStore)
+
+	s.Health.Set(ClusterAPICheck, connectionCheck(clients.DeviceManagerConn))
+
+	// The connection with the management cluster is established in the background, so the devices are served
+	// while it is not available
+	access := newSecretAccess(s.Configuration.Email, s.Configuration.Password)
+
+	s.Health.Set(LoginCheck, clusterAPILoginHelper.Ready)
+	wErr := s.WatchCredentialFiles(watcher, clusterAPILoginHelper, clients, access)
+	if wErr != nil {
+		return wErr
 	}
 
+	s.Health.Set(SecretAccessCheck, access.Ready)
+	clusterAPILoginHelper.Restore()
+
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Configuration.Port))
 	if err != nil {
-		log.Fatal().Int("port", s.Configuration.Port).Str("err", err.Error()).Msg("failed to listen")
+		return derrors.AsError(err, fmt.Sprintf("failed to listen on port %d", s.Configuration.Port))
 	}
 
+	// Latency samples are stored on disk until the cluster API receives them. They are delivered once the
+	// connection with the management cluster is established
+	forwarder := ping.NewForwarder(clusterAPILoginHelper, clients.DeviceManagerClient)
+	latencyQueue, qErr := queue.NewQueue(s.Configuration.GetQueueConfig(), forwarder)
+	if qErr != nil {
+		return qErr
+	}
+	s.tasks.Go("upstream", func() error {
+		return s.connectUpstream(clusterAPILoginHelper, clients, access, latencyQueue)
+	})
+
 	// Create handlers and managers
-	pingManager := ping.NewManager(s.Configuration.Threshold, clusterAPILoginHelper, clients.DeviceManagerClient)
-	pingHandler := ping.NewHandler(pingManager)
+	evaluator := latency.NewEvaluator(s.Configuration.GetLatencyRule())
+	tracker := liveness.NewTracker(s.Configuration.GetLivenessConfig())
+	var webhooks *notifier.Notifier
+	if len(s.Configuration.WebhookURLs) > 0 {
+		notifierConfig, nErr := s.Configuration.GetNotifierConfig()
+		if nErr == nil {
+			webhooks, nErr = notifier.NewNotifier(*notifierConfig)
+		}
+		if nErr != nil {
+			return nErr
+		}
+		if !s.components.setNotifier(webhooks) {
+			return nil
+		}
+		webhooks.Run()
+		tracker.Subscribe(webhooks.DeviceStateChanged)
+	}
+	if !s.components.setTracker(tracker) {
+		return nil
+	}
+	s.tasks.Go("liveness", supervisor.Worker(tracker.Run))
+	pingManager := ping.NewManager(thresholds, evaluator, latencyQueue, selectors, assignments, s.Configuration.GetAssignmentPolicy(), tracker, webhooks,
+		clusterAPILoginHelper.Ready, ping.NotReadyPolicy(s.Configuration.LatencyNotReadyPolicy))
+	// The latency samples and cluster selections are rate limited per device, as each one is sent to the cluster API
+	auditLog, aErr := audit.NewLog(s.Configuration.AuditLogPath)
+	if aErr != nil {
+		return aErr
+	}
+	if !s.components.setAudit(auditLog) {
+		auditLog.Close()
+		return nil
+	}
+	pingHandler := ping.NewIntercepted(ping.NewHandler(pingManager, auditLog), s.authx.UnaryServerInterceptor(),
+		limiter.UnaryServerInterceptor(ping.RegisterLatencyMethod, ping.SelectClusterMethod))
 
 	// Interceptor
-	accessManager, aErr := devinterceptor.NewClusterApiSecretAccessWithClients(clients.LoginClient, clients.DeviceManagerClient,
-		s.Configuration.Email, s.Configuration.Password, devinterceptor.DefaultCacheEntries)
-	if err != nil {
-		log.Fatal().Str("trace", aErr.DebugReport()).Msg("cannot create management secret access")
+	authxConfig := interceptor.NewConfig(authConfig, "", s.Configuration.AuthHeader)
+	options := []grpc.ServerOption{interceptor.WithDeviceAuthxInterceptor(access, authxConfig), grpc.StatsHandler(s.authx)}
+
+	// The HTTP gateway uses its own server without transport security, reachable only through the loopback
+	// interface
+	gatewayServer := grpc.NewServer(options...)
+	grpc_device_controller_go.RegisterConnectionServer(gatewayServer, pingHandler)
+	if !s.components.setGatewayServer(gatewayServer) {
+		return nil
 	}
+	s.tasks.Go("grpc-gateway", func() error {
+		return gatewayServer.Serve(s.gatewayListener)
+	})
 
-	authxConfig := interceptor.NewConfig(authConfig, "", s.Configuration.AuthHeader)
-	grpcServer := grpc.NewServer(interceptor.WithDeviceAuthxInterceptor(accessManager, authxConfig))
+	tlsConfig, tErr := s.Configuration.GetServerTLSConfig()
+	if tErr != nil {
+		return tErr
+	}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	grpcServer := grpc.NewServer(options...)
 
 	//grpcServer := grpc.NewServer()
 	grpc_device_controller_go.RegisterConnectionServer(grpcServer, pingHandler)
@@ -186,11 +320,13 @@ func (s *Service) LaunchGRPC(authConfig *interceptor.AuthorizationConfig) error
 	// register
 
 	reflection.Register(grpcServer)
-	log.Info().Int("port", s.Configuration.Port).Msg("Launching gRPC server")
-	if err := grpcServer.Serve(lis); err != nil {
-		log.Fatal().Errs("failed to serve: %v", []error{err})
+	if !s.components.setGRPCServer(grpcServer) {
+		_ = lis.Close()
+		return nil
 	}
-	return nil
+	s.Health.Set(GRPCCheck, func() derrors.Error { return nil })
+	log.Info().Int("port", s.Configuration.Port).Bool("tls", tlsConfig != nil).Msg("Launching gRPC server")
+	return grpcServer.Serve(lis)
 }
 
 func (s *Service) allowCORS(h http.Handler) http.Handler {
@@ -213,23 +349,65 @@ func preflightHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ","))
 }
 
+// LaunchMetrics serves the metrics and, if enabled, the debug endpoints on a dedicated port.
+func (s *Service) LaunchMetrics(assignments assignment.Store) error {
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle(metrics.Path, metrics.Handler())
+	if s.Configuration.EnableDebugEndpoints {
+		metricsMux.Handle(assignment.DebugPath, assignment.NewDebugHandler(assignments))
+	}
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", s.Configuration.MetricsPort),
+		Handler: metricsMux,
+	}
+	if !s.components.setMetricsServer(server) {
+		return nil
+	}
+	log.Info().Str("address", server.Addr).Msg("Metrics Listening")
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
 func (s *Service) LaunchHTTP() error {
 
 	addr := fmt.Sprintf(":%d", s.Configuration.HTTPPort)
-	clientAddr := fmt.Sprintf(":%d", s.Configuration.Port)
-	opts := []grpc.DialOption{grpc.WithInsecure()}
 	mux := runtime.NewServeMux()
 
-	if err := grpc_device_controller_go.RegisterConnectionHandlerFromEndpoint(context.Background(), mux, clientAddr, opts); err != nil {
-		log.Fatal().Err(err).Msg("failed to start device controller handler")
+	if err := grpc_device_controller_go.RegisterConnectionHandlerFromEndpoint(context.Background(), mux, s.gatewayListener.Addr().String(), gatewayDialOptions()); err != nil {
+		return derrors.AsError(err, "failed to start device controller handler")
 	}
 
+	httpMux := http.NewServeMux()
+	httpMux.Handle("/", s.allowCORS(mux))
+	httpMux.Handle(health.LivenessPath, s.Health.LivenessHandler())
+	httpMux.Handle(health.ReadinessPath, s.Health.ReadinessHandler())
+
+	tlsConfig, tErr := s.Configuration.GetServerTLSConfig()
+	if tErr != nil {
+		return tErr
+	}
 	server := &http.Server{
-		Addr:    addr,
-		Handler: s.allowCORS(mux),
+		Addr:      addr,
+		Handler:   httpMux,
+		TLSConfig: tlsConfig,
+	}
+	if !s.components.setHTTPServer(server) {
+		return nil
 	}
 
-	log.Info().Str("address", addr).Msg("HTTP Listening")
-	return server.ListenAndServe()
+	log.Info().Str("address", addr).Bool("tls", tlsConfig != nil).Msg("HTTP Listening")
+	var err error
+	if tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 
 }
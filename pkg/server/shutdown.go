@@ -0,0 +1,218 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/audit"
+	"github.com/nalej/device-controller/pkg/liveness"
+	"github.com/nalej/device-controller/pkg/login_helper"
+	"github.com/nalej/device-controller/pkg/notifier"
+	"github.com/nalej/device-controller/pkg/queue"
+	"github.com/nalej/device-controller/pkg/reload"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// running with the servers and the background tasks started by the service.
+type running struct {
+	grpcServer    *grpc.Server
+	gatewayServer *grpc.Server
+	healthServer  *grpc.Server
+	httpServer    *http.Server
+	latencyQueue  *queue.Queue
+	notifier      *notifier.Notifier
+	tracker       *liveness.Tracker
+	renewer       *login_helper.Renewer
+	watcher       *reload.Watcher
+	metricsServer *http.Server
+	audit         *audit.Log
+}
+
+// components with the running servers and background tasks. They are registered before they are launched, so
+// a shutdown during the startup only stops the ones that are running.
+type components struct {
+	mu sync.Mutex
+	running
+	// stopped is set when the shutdown starts. Components are not registered afterwards.
+	stopped bool
+}
+
+// stop marks the service as shutting down and returns the components to stop.
+func (c *components) stop() running {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	return c.running
+}
+
+// register adds a component unless the service is shutting down. It returns false in that case, and the
+// component must not be launched.
+func (c *components) register(add func(r *running)) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return false
+	}
+	add(&c.running)
+	return true
+}
+
+func (c *components) setGRPCServer(server *grpc.Server) bool {
+	return c.register(func(r *running) {
+		r.grpcServer = server
+	})
+}
+
+func (c *components) setGatewayServer(server *grpc.Server) bool {
+	return c.register(func(r *running) {
+		r.gatewayServer = server
+	})
+}
+
+func (c *components) setHealthServer(server *grpc.Server) bool {
+	return c.register(func(r *running) {
+		r.healthServer = server
+	})
+}
+
+func (c *components) setHTTPServer(server *http.Server) bool {
+	return c.register(func(r *running) {
+		r.httpServer = server
+	})
+}
+
+func (c *components) setQueue(latencyQueue *queue.Queue) bool {
+	return c.register(func(r *running) {
+		r.latencyQueue = latencyQueue
+	})
+}
+
+func (c *components) setNotifier(webhooks *notifier.Notifier) bool {
+	return c.register(func(r *running) {
+		r.notifier = webhooks
+	})
+}
+
+func (c *components) setTracker(tracker *liveness.Tracker) bool {
+	return c.register(func(r *running) {
+		r.tracker = tracker
+	})
+}
+
+func (c *components) setRenewer(renewer *login_helper.Renewer) bool {
+	return c.register(func(r *running) {
+		r.renewer = renewer
+	})
+}
+
+func (c *components) setMetricsServer(server *http.Server) bool {
+	return c.register(func(r *running) {
+		r.metricsServer = server
+	})
+}
+
+func (c *components) setAudit(auditLog *audit.Log) bool {
+	return c.register(func(r *running) {
+		r.audit = auditLog
+	})
+}
+
+func (c *components) setWatcher(watcher *reload.Watcher) bool {
+	return c.register(func(r *running) {
+		r.watcher = watcher
+	})
+}
+
+// stopGRPC stops a gRPC server gracefully, closing the pending connections when the deadline expires.
+func stopGRPC(server *grpc.Server, deadline time.Time) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-stopped:
+	case <-timer.C:
+		log.Warn().Msg("gRPC requests still in progress after the shutdown timeout, closing connections")
+		server.Stop()
+	}
+}
+
+// Shutdown stops the service before the deadline. The service is reported as not ready, the HTTP gateway and
+// the gRPC server stop accepting requests and finish the ones in progress, and the latency queue delivers the
+// pending samples. The samples that are still pending at the deadline remain on disk.
+func (s *Service) Shutdown(deadline time.Time) {
+	close(s.stopping)
+	s.Health.Set(GRPCCheck, func() derrors.Error {
+		return derrors.NewUnavailableError("shutting down")
+	})
+
+	c := s.components.stop()
+
+	for _, server := range []*http.Server{c.httpServer, c.metricsServer} {
+		if server == nil {
+			continue
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		err := server.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			log.Warn().Str("err", err.Error()).Str("address", server.Addr).Msg("HTTP requests still in progress after the shutdown timeout")
+		}
+	}
+	if c.grpcServer != nil {
+		stopGRPC(c.grpcServer, deadline)
+	}
+	if c.gatewayServer != nil {
+		stopGRPC(c.gatewayServer, deadline)
+	}
+	if c.latencyQueue != nil {
+		pending := c.latencyQueue.Drain(time.Until(deadline))
+		if pending > 0 {
+			log.Warn().Int("pending", pending).Str("path", s.Configuration.QueuePath).Msg("latency samples not delivered before the shutdown timeout, they will be replayed on restart")
+		} else {
+			log.Info().Msg("latency queue drained")
+		}
+	}
+	if c.notifier != nil {
+		c.notifier.Stop()
+	}
+	if c.tracker != nil {
+		c.tracker.Stop()
+	}
+	if c.renewer != nil {
+		c.renewer.Stop()
+	}
+	if c.watcher != nil {
+		c.watcher.Stop()
+	}
+	s.Health.Stop()
+	if c.healthServer != nil {
+		c.healthServer.Stop()
+	}
+	if c.audit != nil {
+		c.audit.Close()
+	}
+	log.Info().Msg("shutdown completed")
+}
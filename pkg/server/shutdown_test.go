@@ -0,0 +1,41 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"net/http"
+)
+
+var _ = ginkgo.Describe("Components", func() {
+
+	ginkgo.It("should return the components registered before the shutdown", func() {
+		c := &components{}
+		server := &http.Server{}
+		gomega.Expect(c.setHTTPServer(server)).To(gomega.BeTrue())
+		gomega.Expect(c.stop().httpServer).To(gomega.BeIdenticalTo(server))
+	})
+
+	ginkgo.It("should not register the components launched during the shutdown", func() {
+		c := &components{}
+		gomega.Expect(c.stop().metricsServer).To(gomega.BeNil())
+		gomega.Expect(c.setMetricsServer(&http.Server{})).To(gomega.BeFalse())
+		gomega.Expect(c.stop().metricsServer).To(gomega.BeNil())
+	})
+
+})
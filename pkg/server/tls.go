@@ -0,0 +1,74 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/tlsdial"
+	"google.golang.org/grpc"
+	"net"
+)
+
+// gatewayAddress where the gRPC server of the HTTP gateway listens. It is only reachable from the loopback
+// interface, and the port is chosen by the system.
+const gatewayAddress = "127.0.0.1:0"
+
+// GetServerTLSConfig returns the TLS configuration of the gRPC and HTTP listeners, or nil if they serve
+// plaintext.
+func (conf *Config) GetServerTLSConfig() (*tls.Config, derrors.Error) {
+	if conf.ServerCertPath == "" {
+		return nil, nil
+	}
+	certificate, err := tlsdial.LoadCertificate(conf.ServerCertPath)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{*certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if conf.DeviceCACertPath != "" {
+		pool, err := tlsdial.LoadCAPool(conf.DeviceCACertPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if conf.RequireDeviceCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsConfig, nil
+}
+
+// listenGateway opens the loopback listener that connects the HTTP gateway with its gRPC server.
+func (s *Service) listenGateway() derrors.Error {
+	lis, err := net.Listen("tcp", gatewayAddress)
+	if err != nil {
+		return derrors.AsError(err, "failed to listen for the HTTP gateway")
+	}
+	s.gatewayListener = lis
+	return nil
+}
+
+// gatewayDialOptions returns the options that connect the HTTP gateway with its gRPC server. The TLS of the
+// HTTP listener already protects the requests, and the loopback hop does not leave the host, so it does not
+// use it.
+func gatewayDialOptions() []grpc.DialOption {
+	return []grpc.DialOption{grpc.WithInsecure()}
+}
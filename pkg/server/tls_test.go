@@ -0,0 +1,155 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/nalej/device-controller/internal/testcert"
+	"github.com/nalej/device-controller/pkg/tlsdial"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	grpc_health "google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// serveHealth launches a gRPC health server on the listener.
+func serveHealth(listener net.Listener, options ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(options...)
+	grpc_health_v1.RegisterHealthServer(server, grpc_health.NewServer())
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	return server
+}
+
+// checkHealth sends a health request through the connection.
+func checkHealth(conn *grpc.ClientConn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	return err
+}
+
+var _ = ginkgo.Describe("Server TLS", func() {
+
+	var dir string
+	var serverCertPath, deviceCACertPath, deviceCertPath, otherDeviceCertPath string
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "tls")
+		gomega.Expect(err).To(gomega.Succeed())
+		serverCertPath = filepath.Join(dir, "server")
+		deviceCACertPath = filepath.Join(dir, "device-ca.crt")
+		deviceCertPath = filepath.Join(dir, "device")
+		otherDeviceCertPath = filepath.Join(dir, "other-device")
+
+		ca := testcert.New("ca", nil)
+		deviceCA := testcert.New("device-ca", nil)
+		testcert.New("localhost", ca).WriteDir(serverCertPath, tlsdial.CertFileName, tlsdial.KeyFileName)
+		deviceCA.WriteCA(deviceCACertPath)
+		testcert.New("device", deviceCA).WriteDir(deviceCertPath, tlsdial.CertFileName, tlsdial.KeyFileName)
+		testcert.New("device", ca).WriteDir(otherDeviceCertPath, tlsdial.CertFileName, tlsdial.KeyFileName)
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+	})
+
+	table.DescribeTable("listener configuration",
+		func(update func(conf *Config), clientAuth tls.ClientAuthType) {
+			conf := Config{ServerCertPath: serverCertPath}
+			update(&conf)
+			tlsConfig, err := conf.GetServerTLSConfig()
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(tlsConfig.Certificates).To(gomega.HaveLen(1))
+			gomega.Expect(tlsConfig.MinVersion).To(gomega.Equal(uint16(tls.VersionTLS12)))
+			gomega.Expect(tlsConfig.ClientAuth).To(gomega.Equal(clientAuth))
+		},
+		table.Entry("server certificate", func(conf *Config) {}, tls.NoClientCert),
+		table.Entry("optional device certificates", func(conf *Config) {
+			conf.DeviceCACertPath = deviceCACertPath
+		}, tls.VerifyClientCertIfGiven),
+		table.Entry("required device certificates", func(conf *Config) {
+			conf.DeviceCACertPath = deviceCACertPath
+			conf.RequireDeviceCert = true
+		}, tls.RequireAndVerifyClientCert),
+	)
+
+	ginkgo.It("should serve plaintext without a server certificate", func() {
+		tlsConfig, err := (&Config{}).GetServerTLSConfig()
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(tlsConfig).To(gomega.BeNil())
+	})
+
+	ginkgo.It("should report invalid certificates", func() {
+		_, err := (&Config{ServerCertPath: filepath.Join(dir, "missing")}).GetServerTLSConfig()
+		gomega.Expect(err).NotTo(gomega.BeNil())
+		_, err = (&Config{ServerCertPath: serverCertPath, DeviceCACertPath: filepath.Join(dir, "missing.crt")}).GetServerTLSConfig()
+		gomega.Expect(err).NotTo(gomega.BeNil())
+	})
+
+	table.DescribeTable("device connections",
+		func(requireDeviceCert bool, clientCertPath func() string, succeeds bool) {
+			conf := Config{ServerCertPath: serverCertPath, DeviceCACertPath: deviceCACertPath, RequireDeviceCert: requireDeviceCert}
+			tlsConfig, err := conf.GetServerTLSConfig()
+			gomega.Expect(err).To(gomega.BeNil())
+			listener, lErr := net.Listen("tcp", "127.0.0.1:0")
+			gomega.Expect(lErr).To(gomega.Succeed())
+			server := serveHealth(listener, grpc.Creds(credentials.NewTLS(tlsConfig)))
+			defer server.Stop()
+
+			material, err := tlsdial.NewMaterial(tlsdial.Config{ClientCertPath: clientCertPath(), SkipCAValidation: true})
+			gomega.Expect(err).To(gomega.BeNil())
+			conn, err := tlsdial.Dial("localhost", listener.Addr().(*net.TCPAddr).Port, material)
+			gomega.Expect(err).To(gomega.BeNil())
+			defer conn.Close()
+			if succeeds {
+				gomega.Expect(checkHealth(conn)).To(gomega.Succeed())
+			} else {
+				gomega.Expect(checkHealth(conn)).NotTo(gomega.Succeed())
+			}
+		},
+		table.Entry("optional certificate not presented", false, func() string { return "" }, true),
+		table.Entry("optional certificate presented", false, func() string { return deviceCertPath }, true),
+		table.Entry("optional certificate signed by another CA", false, func() string { return otherDeviceCertPath }, false),
+		table.Entry("required certificate presented", true, func() string { return deviceCertPath }, true),
+		table.Entry("required certificate not presented", true, func() string { return "" }, false),
+	)
+
+	ginkgo.It("should connect the HTTP gateway with its gRPC server through the loopback interface", func() {
+		service := NewService(Config{})
+		gomega.Expect(service.listenGateway()).To(gomega.Succeed())
+		gomega.Expect(service.gatewayListener.Addr().(*net.TCPAddr).IP.IsLoopback()).To(gomega.BeTrue())
+		server := serveHealth(service.gatewayListener)
+		defer server.Stop()
+		conn, err := grpc.Dial(service.gatewayListener.Addr().String(), gatewayDialOptions()...)
+		gomega.Expect(err).To(gomega.Succeed())
+		defer conn.Close()
+		gomega.Expect(checkHealth(conn)).To(gomega.Succeed())
+	})
+
+})
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/nalej/authx/pkg/interceptor/devinterceptor"
+	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/login_helper"
+	"github.com/nalej/device-controller/pkg/metrics"
+	"github.com/nalej/device-controller/pkg/queue"
+	"github.com/nalej/device-controller/pkg/supervisor"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// secretAccess gives the authx interceptor access to the device secrets once the connection with the cluster
+// API is established. Until then, the devices cannot be authenticated and their requests fail as unavailable.
+type secretAccess struct {
+	mu     sync.RWMutex
+	access *devinterceptor.ClusterApiSecretAccess
+	// connecting serializes the creation of the access with the changes of the credentials, so an access
+	// created with rotated credentials is never replaced by one created with the previous ones.
+	connecting sync.Mutex
+	email      string
+	password   string
+}
+
+func newSecretAccess(email string, password string) *secretAccess {
+	return &secretAccess{email: email, password: password}
+}
+
+func (a *secretAccess) set(access *devinterceptor.ClusterApiSecretAccess) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.access = access
+}
+
+func (a *secretAccess) get() *devinterceptor.ClusterApiSecretAccess {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.access
+}
+
+// connect establishes the access to the device secrets with the current credentials.
+func (a *secretAccess) connect(clients *Clients) derrors.Error {
+	a.connecting.Lock()
+	defer a.connecting.Unlock()
+	return a.create(clients)
+}
+
+// updateCredentials changes the credentials of the access. If the access is already established, it is
+// created again so the device secrets are retrieved with the new credentials.
+func (a *secretAccess) updateCredentials(clients *Clients, email string, password string) derrors.Error {
+	a.connecting.Lock()
+	defer a.connecting.Unlock()
+	a.email = email
+	a.password = password
+	if a.get() == nil {
+		return nil
+	}
+	return a.create(clients)
+}
+
+func (a *secretAccess) create(clients *Clients) derrors.Error {
+	access, err := devinterceptor.NewClusterApiSecretAccessWithClients(clients.LoginClient, clients.DeviceManagerClient,
+		a.email, a.password, devinterceptor.DefaultCacheEntries)
+	if err != nil {
+		return err
+	}
+	a.set(access)
+	return nil
+}
+
+// Ready returns an error until the access to the device secrets is established.
+func (a *secretAccess) Ready() derrors.Error {
+	if a.get() == nil {
+		return derrors.NewUnavailableError("device secrets are not available yet")
+	}
+	return nil
+}
+
+// Connect the access to the device secrets. Before the access is established in the background there is
+// nothing to connect.
+func (a *secretAccess) Connect() derrors.Error {
+	access := a.get()
+	if access == nil {
+		return nil
+	}
+	return access.Connect()
+}
+
+// RetrieveSecret returns the secret used to verify the tokens of a device group.
+func (a *secretAccess) RetrieveSecret(id string) (string, derrors.Error) {
+	access := a.get()
+	if access == nil {
+		return "", derrors.NewUnavailableError("device secrets are not available yet, try again later")
+	}
+	return access.RetrieveSecret(id)
+}
+
+// connectUpstream logs in the management cluster and establishes the access to the device secrets. Failed
+// attempts are retried with backoff until both succeed or the service shuts down. Once connected, the token
+// renewal and the delivery of the queued latency samples are launched.
+func (s *Service) connectUpstream(helper *login_helper.LoginHelper, clients *Clients, access *secretAccess, latencyQueue *queue.Queue) error {
+	for retry := 0; ; retry++ {
+		err := s.tryConnectUpstream(helper, clients, access)
+		if err == nil {
+			log.Info().Int("retries", retry).Msg("Connected to the management cluster")
+			s.startRenewer(helper)
+			if s.components.setQueue(latencyQueue) {
+				s.tasks.Go("latency-queue", supervisor.Worker(latencyQueue.Run))
+			}
+			return nil
+		}
+		wait := login_helper.AuthBackoff(retry)
+		log.Warn().Str("err", err.DebugReport()).Str("retryIn", wait.String()).Msg("cannot connect to the management cluster")
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.stopping:
+			timer.Stop()
+			return nil
+		}
+	}
+}
+
+// tryConnectUpstream completes the steps of the connection with the management cluster that are still pending.
+func (s *Service) tryConnectUpstream(helper *login_helper.LoginHelper, clients *Clients, access *secretAccess) derrors.Error {
+	if helper.Ready() != nil {
+		err := helper.Login()
+		if err != nil {
+			return err
+		}
+	}
+	if access.get() == nil {
+		return access.connect(clients)
+	}
+	return nil
+}
+
+// startRenewer launches the renewal of the cluster API token.
+func (s *Service) startRenewer(helper *login_helper.LoginHelper) {
+	renewer := login_helper.NewRenewer(helper, s.Configuration.TokenRenewalMargin)
+	if !s.components.setRenewer(renewer) {
+		return
+	}
+	s.tasks.Go("token-renewal", supervisor.Worker(renewer.Run))
+	s.Health.Set(TokenRenewalCheck, renewer.Ready)
+	metrics.RegisterTokenLifetime(func() float64 {
+		return renewer.RemainingLifetime().Seconds()
+	})
+}
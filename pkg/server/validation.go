@@ -0,0 +1,156 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"github.com/nalej/derrors"
+	"github.com/nalej/device-controller/pkg/selector"
+	"github.com/nalej/device-controller/pkg/threshold"
+	"github.com/nalej/device-controller/pkg/tlsdial"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// validation collects all the problems found in the configuration so they are reported at once.
+type validation struct {
+	problems []string
+}
+
+func (v *validation) add(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *validation) check(err derrors.Error) {
+	if err != nil {
+		v.problems = append(v.problems, err.Error())
+	}
+}
+
+// error returns an InvalidArgument error with all the problems, or nil if there are none.
+func (v *validation) error() derrors.Error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return derrors.NewInvalidArgumentError(fmt.Sprintf("invalid configuration: %s", strings.Join(v.problems, "; ")))
+}
+
+func (conf *Config) validatePorts(problems *validation) {
+	listening := map[string]int{
+		"port":        conf.Port,
+		"httpPort":    conf.HTTPPort,
+		"healthPort":  conf.HealthPort,
+		"metricsPort": conf.MetricsPort,
+	}
+	used := make(map[int]string, 0)
+	for _, name := range []string{"port", "httpPort", "healthPort", "metricsPort"} {
+		port := listening[name]
+		if port <= 0 || port > 65535 {
+			problems.add("%s must be between 1 and 65535", name)
+			continue
+		}
+		if other, exists := used[port]; exists {
+			problems.add("%s and %s must be different", other, name)
+			continue
+		}
+		used[port] = name
+	}
+	if conf.ClusterAPIPort <= 0 || conf.ClusterAPIPort > 65535 {
+		problems.add("clusterAPIPort must be between 1 and 65535")
+	}
+	if conf.LoginPort <= 0 || conf.LoginPort > 65535 {
+		problems.add("loginPort must be between 1 and 65535")
+	}
+}
+
+func (conf *Config) validateCredentials(problems *validation) {
+	if conf.Email == "" && conf.EmailFile == "" {
+		problems.add("email or emailFile must be set")
+	}
+	if conf.Password == "" && conf.PasswordFile == "" {
+		problems.add("password or passwordFile must be set")
+	}
+	for _, path := range []string{conf.EmailFile, conf.PasswordFile} {
+		if path != "" {
+			_, err := readSecretFile(path)
+			problems.check(err)
+		}
+	}
+}
+
+func (conf *Config) validateCertificates(problems *validation) {
+	if conf.CACertPath != "" {
+		_, err := tlsdial.LoadCAPool(conf.CACertPath)
+		if err != nil {
+			problems.add("invalid CA certificate %s: %s", conf.CACertPath, err.Error())
+		}
+	}
+	if conf.ClientCertPath != "" {
+		_, err := tlsdial.LoadCertificate(conf.ClientCertPath)
+		if err != nil {
+			problems.add("invalid client certificate %s: %s", conf.ClientCertPath, err.Error())
+		}
+	}
+	if conf.ServerCertPath != "" {
+		_, err := tlsdial.LoadCertificate(conf.ServerCertPath)
+		if err != nil {
+			problems.add("invalid server certificate %s: %s", conf.ServerCertPath, err.Error())
+		}
+	} else if conf.DeviceCACertPath != "" || conf.RequireDeviceCert {
+		problems.add("serverCertPath must be set to verify the device certificates")
+	}
+	if conf.DeviceCACertPath != "" {
+		_, err := tlsdial.LoadCAPool(conf.DeviceCACertPath)
+		if err != nil {
+			problems.add("invalid device CA certificate %s: %s", conf.DeviceCACertPath, err.Error())
+		}
+	} else if conf.RequireDeviceCert {
+		problems.add("deviceCACertPath must be set to require device certificates")
+	}
+}
+
+func (conf *Config) validateFiles(problems *validation) {
+	if conf.AuthConfigPath == "" {
+		problems.add("authConfigPath must be set")
+	} else {
+		authConfig, err := conf.LoadAuthConfig()
+		if err != nil {
+			problems.add("cannot load authx config %s: %s", conf.AuthConfigPath, err.Error())
+		} else if !authConfig.AllowsAll && len(authConfig.Permissions) == 0 {
+			problems.add("authx config %s does not define any permission", conf.AuthConfigPath)
+		}
+	}
+	if conf.AuditLogPath != "" {
+		info, err := os.Stat(filepath.Dir(conf.AuditLogPath))
+		if err != nil || !info.IsDir() {
+			problems.add("directory of the audit log %s does not exist", conf.AuditLogPath)
+		}
+	}
+	if conf.ThresholdPolicyPath != "" {
+		_, err := threshold.LoadPolicyFile(conf.ThresholdPolicyPath)
+		problems.check(err)
+	}
+	if conf.SelectionPolicyPath != "" {
+		_, err := selector.LoadPolicyFile(conf.SelectionPolicyPath)
+		problems.check(err)
+	}
+	if conf.RateLimitPolicyPath != "" {
+		_, err := conf.LoadRateLimiter()
+		problems.check(err)
+	}
+}
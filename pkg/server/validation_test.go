@@ -0,0 +1,151 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// validConfig returns a configuration with the defaults of the run command.
+func validConfig(dir string) Config {
+	authConfigPath := filepath.Join(dir, "authx.json")
+	writeAuthConfig(authConfigPath, "DEVICE")
+	return Config{
+		Port:                      6020,
+		HTTPPort:                  6021,
+		HealthPort:                6022,
+		MetricsPort:               6023,
+		ClusterAPIHostname:        "cluster.nalej",
+		ClusterAPIPort:            8000,
+		LoginHostname:             "login.nalej",
+		LoginPort:                 31683,
+		Email:                     "device-controller@nalej.com",
+		Password:                  "password",
+		Threshold:                 100,
+		LatencyStatistic:          "p95",
+		LatencyWindowSize:         5,
+		LatencyConsecutiveWindows: 2,
+		LatencyEWMAAlpha:          0.3,
+		SelectionStrategy:         "min_latency",
+		SelectionTolerance:        10,
+		SelectionMargin:           20,
+		RateLimit:                 1,
+		RateLimitBurst:            10,
+		AssignmentTTL:             24 * time.Hour,
+		AssignmentCooldown:        5 * time.Minute,
+		AssignmentMaxMovesPerHour: 4,
+		AssignmentHistorySize:     20,
+		LivenessStaleTimeout:      2 * time.Minute,
+		LivenessOfflineTimeout:    10 * time.Minute,
+		LivenessCheckInterval:     30 * time.Second,
+		LivenessForgetTimeout:     24 * time.Hour,
+		WebhookMaxAttempts:        5,
+		WebhookInitialBackoff:     time.Second,
+		WebhookMaxBackoff:         time.Minute,
+		WebhookTimeout:            10 * time.Second,
+		WebhookQueueSize:          1000,
+		CredentialStore:           "memory",
+		TokenRenewalMargin:        5 * time.Minute,
+		ShutdownTimeout:           30 * time.Second,
+		AuthConfigPath:            authConfigPath,
+		QueuePath:                 filepath.Join(dir, "queue"),
+		QueueMaxSize:              10000,
+		QueueMaxAttempts:          10,
+		QueueInitialBackoff:       time.Second,
+		QueueMaxBackoff:           5 * time.Minute,
+		BatchFlushInterval:        time.Second,
+		BatchMaxSize:              100,
+		ForwardWorkers:            4,
+		LatencyNotReadyPolicy:     "queue",
+	}
+}
+
+var _ = ginkgo.Describe("Config validation", func() {
+
+	var dir string
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config")
+		gomega.Expect(err).To(gomega.Succeed())
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should accept the default configuration", func() {
+		config := validConfig(dir)
+		gomega.Expect(config.Validate()).To(gomega.Succeed())
+	})
+
+	table.DescribeTable("invalid configurations",
+		func(update func(config *Config, dir string), problem string) {
+			config := validConfig(dir)
+			update(&config, dir)
+			err := config.Validate()
+			gomega.Expect(err).NotTo(gomega.Succeed())
+			gomega.Expect(err.Type()).To(gomega.Equal(derrors.InvalidArgument))
+			gomega.Expect(err.Error()).To(gomega.ContainSubstring(problem))
+		},
+		table.Entry("port out of range", func(config *Config, _ string) { config.Port = 70000 }, "port must be between 1 and 65535"),
+		table.Entry("negative HTTP port", func(config *Config, _ string) { config.HTTPPort = -1 }, "httpPort must be between 1 and 65535"),
+		table.Entry("no metrics port", func(config *Config, _ string) { config.MetricsPort = 0 }, "metricsPort must be between 1 and 65535"),
+		table.Entry("repeated port", func(config *Config, _ string) { config.MetricsPort = 6020 }, "port and metricsPort must be different"),
+		table.Entry("no cluster API port", func(config *Config, _ string) { config.ClusterAPIPort = 0 }, "clusterAPIPort must be between 1 and 65535"),
+		table.Entry("login port out of range", func(config *Config, _ string) { config.LoginPort = 70000 }, "loginPort must be between 1 and 65535"),
+		table.Entry("no threshold", func(config *Config, _ string) { config.Threshold = 0 }, "threshold must be greater than zero"),
+		table.Entry("no cluster API hostname", func(config *Config, _ string) { config.ClusterAPIHostname = "" }, "clusterAPIHostname must be set"),
+		table.Entry("no password", func(config *Config, _ string) { config.Password = "" }, "password or passwordFile must be set"),
+		table.Entry("missing email file", func(config *Config, dir string) { config.EmailFile = filepath.Join(dir, "email") }, "cannot read secret file"),
+		table.Entry("missing CA certificate", func(config *Config, dir string) { config.CACertPath = filepath.Join(dir, "ca.crt") }, "invalid CA certificate"),
+		table.Entry("device certificates without server certificate", func(config *Config, _ string) { config.RequireDeviceCert = true }, "serverCertPath must be set"),
+		table.Entry("no authx config", func(config *Config, _ string) { config.AuthConfigPath = "" }, "authConfigPath must be set"),
+		table.Entry("missing audit log directory", func(config *Config, dir string) {
+			config.AuditLogPath = filepath.Join(dir, "missing", "audit.log")
+		}, "directory of the audit log"),
+		table.Entry("invalid selection strategy", func(config *Config, _ string) { config.SelectionStrategy = "closest" }, "closest"),
+		table.Entry("unknown strategy in the selection policies", func(config *Config, dir string) {
+			config.SelectionPolicyPath = filepath.Join(dir, "selection.json")
+			content := `{"organizations": [{"organization_id": "org", "strategy": "round_robin"}]}`
+			gomega.Expect(ioutil.WriteFile(config.SelectionPolicyPath, []byte(content), 0600)).To(gomega.Succeed())
+		}, "unknown selection strategy round_robin"),
+		table.Entry("invalid assignment history", func(config *Config, _ string) { config.AssignmentHistorySize = 0 }, "assignment parameters must be valid"),
+		table.Entry("unknown credential store", func(config *Config, _ string) { config.CredentialStore = "vault" }, "unknown credential store vault"),
+		table.Entry("no shutdown timeout", func(config *Config, _ string) { config.ShutdownTimeout = 0 }, "shutdown timeout must be valid"),
+	)
+
+	ginkgo.It("should report all the problems at once", func() {
+		config := validConfig(dir)
+		config.Threshold = 0
+		config.LoginHostname = ""
+		config.TokenRenewalMargin = 0
+		err := config.Validate()
+		gomega.Expect(err).NotTo(gomega.Succeed())
+		gomega.Expect(err.Error()).To(gomega.ContainSubstring("threshold must be greater than zero"))
+		gomega.Expect(err.Error()).To(gomega.ContainSubstring("loginHostname must be set"))
+		gomega.Expect(err.Error()).To(gomega.ContainSubstring("token renewal margin must be valid"))
+	})
+
+})
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package supervisor
+
+import (
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Task run by the supervisor. It returns when its subsystem stops, and a non-nil error means the subsystem
+// failed and the service cannot continue.
+type Task func() error
+
+// Worker returns the task that runs a background worker that cannot fail.
+func Worker(run func()) Task {
+	return func() error {
+		run()
+		return nil
+	}
+}
+
+// Supervisor runs the subsystems of the service and records the first one that fails, so the rest can be
+// shut down.
+type Supervisor struct {
+	mu      sync.Mutex
+	err     error
+	running map[string]int
+	failed  chan struct{}
+	tasks   sync.WaitGroup
+}
+
+func NewSupervisor() *Supervisor {
+	return &Supervisor{
+		running: make(map[string]int, 0),
+		failed:  make(chan struct{}),
+	}
+}
+
+// Go runs a task in its own goroutine.
+func (s *Supervisor) Go(name string, task Task) {
+	s.mu.Lock()
+	s.running[name]++
+	s.mu.Unlock()
+	s.tasks.Add(1)
+	go func() {
+		defer s.tasks.Done()
+		err := task()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.running[name]--
+		if s.running[name] == 0 {
+			delete(s.running, name)
+		}
+		if err == nil {
+			log.Debug().Str("task", name).Msg("task finished")
+			return
+		}
+		log.Error().Str("task", name).Str("err", err.Error()).Msg("task failed")
+		if s.err == nil {
+			s.err = err
+			close(s.failed)
+		}
+	}()
+}
+
+// Failed returns a channel that is closed when the first task fails.
+func (s *Supervisor) Failed() <-chan struct{} {
+	return s.failed
+}
+
+// Err returns the error of the first task that failed, if any.
+func (s *Supervisor) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Running returns the names of the tasks that have not finished yet.
+func (s *Supervisor) Running() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.running))
+	for name := range s.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Wait waits until all the tasks finish or the timeout expires, and returns the error of the first task that
+// failed. The tasks still running after the timeout are only logged, as a slow drain is not a failure of
+// the service.
+func (s *Supervisor) Wait(timeout time.Duration) error {
+	finished := make(chan struct{})
+	go func() {
+		s.tasks.Wait()
+		close(finished)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-finished:
+	case <-timer.C:
+		log.Warn().Str("timeout", timeout.String()).Str("tasks", strings.Join(s.Running(), ", ")).Msg("tasks still running after the shutdown timeout")
+	}
+	return s.Err()
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package supervisor
+
+import (
+	"errors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"time"
+)
+
+var errTest = errors.New("port in use")
+
+var _ = ginkgo.Describe("Supervisor", func() {
+
+	var supervisor *Supervisor
+	var release chan struct{}
+
+	// blocked returns a task that runs until the channel is closed.
+	blocked := func(release chan struct{}) Task {
+		return func() error {
+			<-release
+			return nil
+		}
+	}
+
+	ginkgo.BeforeEach(func() {
+		supervisor = NewSupervisor()
+		release = make(chan struct{})
+	})
+
+	ginkgo.AfterEach(func() {
+		close(release)
+		gomega.Eventually(supervisor.Running).Should(gomega.BeEmpty())
+	})
+
+	table.DescribeTable("first failure",
+		func(results []error, expected error) {
+			for _, result := range results {
+				err := result
+				supervisor.Go("task", func() error {
+					return err
+				})
+			}
+			if expected == nil {
+				gomega.Expect(supervisor.Wait(time.Second)).To(gomega.Succeed())
+				gomega.Expect(supervisor.Err()).To(gomega.Succeed())
+				gomega.Expect(supervisor.Failed()).NotTo(gomega.BeClosed())
+			} else {
+				gomega.Expect(supervisor.Wait(time.Second)).To(gomega.Equal(expected))
+				gomega.Expect(supervisor.Err()).To(gomega.Equal(expected))
+				gomega.Expect(supervisor.Failed()).To(gomega.BeClosed())
+			}
+		},
+		table.Entry("no tasks", []error{}, nil),
+		table.Entry("tasks that finish", []error{nil, nil}, nil),
+		table.Entry("task that fails", []error{nil, errTest}, errTest),
+	)
+
+	ginkgo.It("should keep the error of the first task that fails", func() {
+		supervisor.Go("grpc", func() error {
+			return errTest
+		})
+		gomega.Eventually(supervisor.Failed()).Should(gomega.BeClosed())
+		supervisor.Go("http", func() error {
+			return errors.New("second failure")
+		})
+		gomega.Expect(supervisor.Wait(time.Second)).To(gomega.Equal(errTest))
+	})
+
+	ginkgo.It("should run the workers until they return", func() {
+		stop := make(chan struct{})
+		supervisor.Go("worker", Worker(func() {
+			<-stop
+		}))
+		gomega.Consistently(supervisor.Running, 50*time.Millisecond).Should(gomega.Equal([]string{"worker"}))
+		close(stop)
+		gomega.Expect(supervisor.Wait(time.Second)).To(gomega.Succeed())
+		gomega.Expect(supervisor.Running()).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should track the tasks launched with the same name until all of them finish", func() {
+		first, second := make(chan struct{}), make(chan struct{})
+		supervisor.Go("upstream", blocked(first))
+		supervisor.Go("upstream", blocked(second))
+		supervisor.Go("http", blocked(release))
+		gomega.Expect(supervisor.Running()).To(gomega.Equal([]string{"http", "upstream"}))
+		close(first)
+		gomega.Consistently(supervisor.Running, 50*time.Millisecond).Should(gomega.Equal([]string{"http", "upstream"}))
+		close(second)
+		gomega.Eventually(supervisor.Running).Should(gomega.Equal([]string{"http"}))
+	})
+
+	ginkgo.It("should track a task launched again after it finished", func() {
+		supervisor.Go("metrics", func() error {
+			return nil
+		})
+		gomega.Eventually(supervisor.Running).Should(gomega.BeEmpty())
+		supervisor.Go("metrics", blocked(release))
+		gomega.Expect(supervisor.Running()).To(gomega.Equal([]string{"metrics"}))
+		gomega.Expect(supervisor.Err()).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should not fail when the tasks are still running after the timeout", func() {
+		supervisor.Go("queue", blocked(release))
+		start := time.Now()
+		gomega.Expect(supervisor.Wait(50 * time.Millisecond)).To(gomega.Succeed())
+		gomega.Expect(time.Since(start)).To(gomega.BeNumerically("<", time.Second))
+		gomega.Expect(supervisor.Running()).To(gomega.Equal([]string{"queue"}))
+	})
+
+	ginkgo.It("should return the failure of a task after the timeout", func() {
+		supervisor.Go("queue", blocked(release))
+		supervisor.Go("grpc", func() error {
+			return errTest
+		})
+		gomega.Eventually(supervisor.Failed()).Should(gomega.BeClosed())
+		gomega.Expect(supervisor.Wait(50 * time.Millisecond)).To(gomega.Equal(errTest))
+	})
+
+})
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package threshold
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nalej/derrors"
+	"io/ioutil"
+	"sort"
+	"sync/atomic"
+)
+
+// DefaultKey with the key used in a Change to report a modification of the default threshold.
+const DefaultKey = "default"
+
+// Policy with the latency threshold in milliseconds applied to an organization, a device group or a device.
+type Policy struct {
+	// OrganizationId of the policy. Mandatory.
+	OrganizationId string `json:"organization_id"`
+	// DeviceGroupId of the policy. If empty, the policy applies to the whole organization.
+	DeviceGroupId string `json:"device_group_id,omitempty"`
+	// DeviceId of the policy. If empty, the policy applies to the whole device group.
+	DeviceId string `json:"device_id,omitempty"`
+	// Threshold in milliseconds.
+	Threshold int `json:"threshold"`
+}
+
+// Key returns the identifier of the scope of the policy.
+func (p *Policy) Key() string {
+	return policyKey(p.OrganizationId, p.DeviceGroupId, p.DeviceId)
+}
+
+func policyKey(organizationID string, deviceGroupID string, deviceID string) string {
+	return fmt.Sprintf("%s/%s/%s", organizationID, deviceGroupID, deviceID)
+}
+
+func (p *Policy) Validate() derrors.Error {
+	if p.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError("organization_id cannot be empty")
+	}
+	if p.DeviceId != "" && p.DeviceGroupId == "" {
+		return derrors.NewInvalidArgumentError("device_group_id must be set for a device policy")
+	}
+	if p.Threshold <= 0 {
+		return derrors.NewInvalidArgumentError(fmt.Sprintf("threshold of %s must be valid", p.Key()))
+	}
+	return nil
+}
+
+// PolicyFile with the content of a file of threshold policies.
+type PolicyFile struct {
+	// DefaultThreshold overrides the global threshold if set.
+	DefaultThreshold int `json:"default_threshold,omitempty"`
+	// Policies with the thresholds of specific organizations, device groups and devices.
+	Policies []Policy `json:"policies"`
+}
+
+func (pf *PolicyFile) Validate() derrors.Error {
+	if pf.DefaultThreshold < 0 {
+		return derrors.NewInvalidArgumentError("default_threshold must be valid")
+	}
+	keys := make(map[string]bool, len(pf.Policies))
+	for _, policy := range pf.Policies {
+		vErr := policy.Validate()
+		if vErr != nil {
+			return vErr
+		}
+		if keys[policy.Key()] {
+			return derrors.NewInvalidArgumentError(fmt.Sprintf("duplicated policy for %s", policy.Key()))
+		}
+		keys[policy.Key()] = true
+	}
+	return nil
+}
+
+// LoadPolicyFile reads and validates a file of threshold policies.
+func LoadPolicyFile(path string) (*PolicyFile, derrors.Error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot read threshold policy file")
+	}
+	policyFile := &PolicyFile{}
+	err = json.Unmarshal(raw, policyFile)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot parse threshold policy file")
+	}
+	vErr := policyFile.Validate()
+	if vErr != nil {
+		return nil, vErr
+	}
+	return policyFile, nil
+}
+
+// policySet is an immutable view of the thresholds in use.
+type policySet struct {
+	defaultThreshold int
+	thresholds       map[string]int
+}
+
+// Change with the modification of the threshold of a scope. A zero Previous value means the policy has been
+// added, and a zero Current value means the policy has been removed.
+type Change struct {
+	Key      string
+	Previous int
+	Current  int
+}
+
+// diff returns the changes between two policy sets sorted by key.
+func diff(previous *policySet, current *policySet) []Change {
+	changes := make([]Change, 0)
+	if previous.defaultThreshold != current.defaultThreshold {
+		changes = append(changes, Change{DefaultKey, previous.defaultThreshold, current.defaultThreshold})
+	}
+	for key, threshold := range current.thresholds {
+		if previous.thresholds[key] != threshold {
+			changes = append(changes, Change{key, previous.thresholds[key], threshold})
+		}
+	}
+	for key, threshold := range previous.thresholds {
+		if _, exists := current.thresholds[key]; !exists {
+			changes = append(changes, Change{key, threshold, 0})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
+
+// Resolver returns the threshold that applies to a device. Device policies take precedence over device group
+// policies, device group policies over organization policies, and those over the default threshold.
+type Resolver struct {
+	globalThreshold int
+	current         atomic.Value
+}
+
+// NewResolver creates a resolver with the global threshold and no policies.
+func NewResolver(globalThreshold int) *Resolver {
+	resolver := &Resolver{globalThreshold: globalThreshold}
+	resolver.current.Store(&policySet{defaultThreshold: globalThreshold, thresholds: make(map[string]int)})
+	return resolver
+}
+
+// Update replaces the policies in use and returns the changes with respect to the previous ones.
+func (r *Resolver) Update(policyFile *PolicyFile) []Change {
+	set := &policySet{
+		defaultThreshold: r.globalThreshold,
+		thresholds:       make(map[string]int, len(policyFile.Policies)),
+	}
+	if policyFile.DefaultThreshold > 0 {
+		set.defaultThreshold = policyFile.DefaultThreshold
+	}
+	for _, policy := range policyFile.Policies {
+		set.thresholds[policy.Key()] = policy.Threshold
+	}
+	previous := r.current.Load().(*policySet)
+	r.current.Store(set)
+	return diff(previous, set)
+}
+
+// GetThreshold returns the threshold in milliseconds for a given device.
+func (r *Resolver) GetThreshold(organizationID string, deviceGroupID string, deviceID string) int {
+	set := r.current.Load().(*policySet)
+	candidates := []string{
+		policyKey(organizationID, deviceGroupID, deviceID),
+		policyKey(organizationID, deviceGroupID, ""),
+		policyKey(organizationID, "", ""),
+	}
+	for _, key := range candidates {
+		if threshold, exists := set.thresholds[key]; exists {
+			return threshold
+		}
+	}
+	return set.defaultThreshold
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package threshold
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = ginkgo.Describe("Resolver", func() {
+
+	var resolver *Resolver
+
+	ginkgo.BeforeEach(func() {
+		resolver = NewResolver(100)
+	})
+
+	ginkgo.It("should use the global threshold without policies", func() {
+		gomega.Expect(resolver.GetThreshold("org", "group", "device")).To(gomega.Equal(100))
+	})
+
+	table.DescribeTable("precedence",
+		func(organizationID string, deviceGroupID string, deviceID string, expected int) {
+			changes := resolver.Update(&PolicyFile{Policies: []Policy{
+				{OrganizationId: "org", Threshold: 200},
+				{OrganizationId: "org", DeviceGroupId: "group", Threshold: 300},
+				{OrganizationId: "org", DeviceGroupId: "group", DeviceId: "device", Threshold: 400},
+			}})
+			gomega.Expect(changes).To(gomega.HaveLen(3))
+			gomega.Expect(resolver.GetThreshold(organizationID, deviceGroupID, deviceID)).To(gomega.Equal(expected))
+		},
+		table.Entry("device policy", "org", "group", "device", 400),
+		table.Entry("device group policy", "org", "group", "other-device", 300),
+		table.Entry("organization policy", "org", "other-group", "other-device", 200),
+		table.Entry("device of another group with the same id", "org", "other-group", "device", 200),
+		table.Entry("another organization", "other-org", "group", "device", 100),
+	)
+
+	table.DescribeTable("default threshold",
+		func(defaultThreshold int, expected int) {
+			resolver.Update(&PolicyFile{DefaultThreshold: defaultThreshold})
+			gomega.Expect(resolver.GetThreshold("org", "group", "device")).To(gomega.Equal(expected))
+		},
+		table.Entry("set in the file", 150, 150),
+		table.Entry("not set in the file", 0, 100),
+	)
+
+	ginkgo.It("should report the changes of a reload sorted by key", func() {
+		changes := resolver.Update(&PolicyFile{Policies: []Policy{
+			{OrganizationId: "org", Threshold: 200},
+			{OrganizationId: "org", DeviceGroupId: "group", Threshold: 300},
+		}})
+		gomega.Expect(changes).To(gomega.Equal([]Change{
+			{Key: "org//", Previous: 0, Current: 200},
+			{Key: "org/group/", Previous: 0, Current: 300},
+		}))
+
+		changes = resolver.Update(&PolicyFile{DefaultThreshold: 150, Policies: []Policy{
+			{OrganizationId: "org", Threshold: 250},
+			{OrganizationId: "org", DeviceGroupId: "group", DeviceId: "device", Threshold: 400},
+		}})
+		gomega.Expect(changes).To(gomega.Equal([]Change{
+			{Key: DefaultKey, Previous: 100, Current: 150},
+			{Key: "org//", Previous: 200, Current: 250},
+			{Key: "org/group/", Previous: 300, Current: 0},
+			{Key: "org/group/device", Previous: 0, Current: 400},
+		}))
+		gomega.Expect(resolver.GetThreshold("org", "group", "other")).To(gomega.Equal(250))
+
+		changes = resolver.Update(&PolicyFile{DefaultThreshold: 150, Policies: []Policy{
+			{OrganizationId: "org", Threshold: 250},
+			{OrganizationId: "org", DeviceGroupId: "group", DeviceId: "device", Threshold: 400},
+		}})
+		gomega.Expect(changes).To(gomega.BeEmpty())
+
+		changes = resolver.Update(&PolicyFile{})
+		gomega.Expect(changes).To(gomega.Equal([]Change{
+			{Key: DefaultKey, Previous: 150, Current: 100},
+			{Key: "org//", Previous: 250, Current: 0},
+			{Key: "org/group/device", Previous: 400, Current: 0},
+		}))
+	})
+})
+
+var _ = ginkgo.Describe("Policy files", func() {
+
+	var dir string
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "threshold")
+		gomega.Expect(err).To(gomega.Succeed())
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+	})
+
+	load := func(content string) (*PolicyFile, error) {
+		path := filepath.Join(dir, "thresholds.json")
+		gomega.Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(gomega.Succeed())
+		policyFile, err := LoadPolicyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return policyFile, nil
+	}
+
+	ginkgo.It("should load a valid file", func() {
+		policyFile, err := load(`{"default_threshold": 150, "policies": [
+			{"organization_id": "org", "threshold": 200},
+			{"organization_id": "org", "device_group_id": "group", "device_id": "device", "threshold": 400}]}`)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(policyFile).To(gomega.Equal(&PolicyFile{DefaultThreshold: 150, Policies: []Policy{
+			{OrganizationId: "org", Threshold: 200},
+			{OrganizationId: "org", DeviceGroupId: "group", DeviceId: "device", Threshold: 400},
+		}}))
+	})
+
+	table.DescribeTable("invalid files",
+		func(content string) {
+			_, err := load(content)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		},
+		table.Entry("invalid JSON", `{"policies": [`),
+		table.Entry("negative default threshold", `{"default_threshold": -1, "policies": []}`),
+		table.Entry("missing organization", `{"policies": [{"threshold": 200}]}`),
+		table.Entry("device without group", `{"policies": [{"organization_id": "org", "device_id": "device", "threshold": 200}]}`),
+		table.Entry("zero threshold", `{"policies": [{"organization_id": "org"}]}`),
+		table.Entry("negative threshold", `{"policies": [{"organization_id": "org", "threshold": -5}]}`),
+		table.Entry("duplicated policy", `{"policies": [
+			{"organization_id": "org", "device_group_id": "group", "threshold": 200},
+			{"organization_id": "org", "device_group_id": "group", "threshold": 300}]}`),
+	)
+
+	ginkgo.It("should fail if the file does not exist", func() {
+		_, err := LoadPolicyFile(filepath.Join(dir, "missing.json"))
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+})
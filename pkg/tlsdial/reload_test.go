@@ -0,0 +1,110 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tlsdial
+
+import (
+	"github.com/nalej/device-controller/internal/testcert"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = ginkgo.Describe("Certificate reload", func() {
+
+	var dir string
+	var ca, otherCA *testcert.Certificate
+	var caPath, clientPath string
+	var port int
+	var stop func()
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "reload")
+		gomega.Expect(err).To(gomega.Succeed())
+		ca = testcert.New("ca", nil)
+		otherCA = testcert.New("other-ca", nil)
+		caPath = filepath.Join(dir, "ca.crt")
+		clientPath = filepath.Join(dir, "client")
+		ca.WriteCA(caPath)
+		testcert.New("device-controller", ca).WriteDir(clientPath, CertFileName, KeyFileName)
+		port, stop = serve(testcert.New("localhost", ca), ca)
+	})
+
+	ginkgo.AfterEach(func() {
+		stop()
+		gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should present the reloaded client certificate", func() {
+		otherClientPath := filepath.Join(dir, "other-client")
+		testcert.New("device-controller", otherCA).WriteDir(otherClientPath, CertFileName, KeyFileName)
+		material, err := NewMaterial(Config{CACertPath: caPath, ClientCertPath: otherClientPath})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(check(port, material)).NotTo(gomega.Succeed())
+
+		testcert.New("device-controller", ca).WriteDir(otherClientPath, CertFileName, KeyFileName)
+		gomega.Expect(material.Reload()).To(gomega.BeNil())
+		gomega.Expect(check(port, material)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should verify the server with the reloaded CA", func() {
+		rotatedPath := filepath.Join(dir, "rotated-ca.crt")
+		otherCA.WriteCA(rotatedPath)
+		material, err := NewMaterial(Config{CACertPath: rotatedPath, ClientCertPath: clientPath})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(check(port, material)).NotTo(gomega.Succeed())
+
+		ca.WriteCA(rotatedPath)
+		gomega.Expect(material.Reload()).To(gomega.BeNil())
+		gomega.Expect(check(port, material)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should keep the current certificates if the new ones cannot be loaded", func() {
+		material, err := NewMaterial(Config{CACertPath: caPath, ClientCertPath: clientPath})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(ioutil.WriteFile(caPath, []byte("not a certificate"), 0600)).To(gomega.Succeed())
+		gomega.Expect(material.Reload()).NotTo(gomega.BeNil())
+		gomega.Expect(check(port, material)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should keep the established connections when the certificates are reloaded", func() {
+		material, err := NewMaterial(Config{CACertPath: caPath, ClientCertPath: clientPath})
+		gomega.Expect(err).To(gomega.BeNil())
+		conn, err := Dial("localhost", port, material)
+		gomega.Expect(err).To(gomega.BeNil())
+		defer conn.Close()
+		gomega.Expect(checkConn(conn)).To(gomega.Succeed())
+
+		testcert.New("device-controller", otherCA).WriteDir(clientPath, CertFileName, KeyFileName)
+		gomega.Expect(material.Reload()).To(gomega.BeNil())
+		gomega.Expect(checkConn(conn)).To(gomega.Succeed())
+		gomega.Expect(check(port, material)).NotTo(gomega.Succeed())
+	})
+
+	ginkgo.It("should watch the files of the certificates", func() {
+		material, err := NewMaterial(Config{CACertPath: caPath, ClientCertPath: clientPath})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(material.Files()).To(gomega.Equal([]string{
+			caPath, filepath.Join(clientPath, CertFileName), filepath.Join(clientPath, KeyFileName)}))
+		material, err = NewMaterial(Config{})
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(material.Files()).To(gomega.BeEmpty())
+	})
+
+})
@@ -0,0 +1,203 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tlsdial
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// CertFileName with the name of the certificate file in a certificate directory.
+	CertFileName = "tls.crt"
+	// KeyFileName with the name of the key file in a certificate directory.
+	KeyFileName = "tls.key"
+)
+
+// Config with the certificates used by the outbound gRPC connections.
+type Config struct {
+	// CACertPath contains the path of the CA bundle used to verify the server. If empty, the system roots are used.
+	CACertPath string
+	// ClientCertPath contains the path of the directory with the tls.crt and tls.key of the client certificate
+	// presented to the server. If empty, no client certificate is presented.
+	ClientCertPath string
+	// SkipCAValidation disables the verification of the server certificate.
+	SkipCAValidation bool
+}
+
+// LoadCAPool reads a PEM bundle of CA certificates.
+func LoadCAPool(caCertPath string) (*x509.CertPool, derrors.Error) {
+	caCert, err := ioutil.ReadFile(caCertPath)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot read CA certificate")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, derrors.NewInvalidArgumentError(fmt.Sprintf("CA certificate %s does not contain any PEM certificate", caCertPath))
+	}
+	return pool, nil
+}
+
+// LoadCertificate reads the tls.crt and tls.key of a certificate directory, as mounted from a Kubernetes TLS secret.
+func LoadCertificate(certPath string) (*tls.Certificate, derrors.Error) {
+	certificate, err := tls.LoadX509KeyPair(filepath.Join(certPath, CertFileName), filepath.Join(certPath, KeyFileName))
+	if err != nil {
+		return nil, derrors.AsError(err, fmt.Sprintf("cannot load certificate from %s", certPath))
+	}
+	return &certificate, nil
+}
+
+// Material with the CA pool and the client certificate currently in use. The TLS configurations it creates
+// read them on each handshake, so a Reload affects the new connections without closing the existing ones.
+type Material struct {
+	config      Config
+	mu          sync.RWMutex
+	roots       *x509.CertPool
+	certificate *tls.Certificate
+}
+
+// NewMaterial loads the certificates of a configuration.
+func NewMaterial(config Config) (*Material, derrors.Error) {
+	material := &Material{config: config}
+	err := material.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return material, nil
+}
+
+// Files returns the paths of the files the material is loaded from.
+func (m *Material) Files() []string {
+	files := make([]string, 0)
+	if m.config.CACertPath != "" {
+		files = append(files, m.config.CACertPath)
+	}
+	if m.config.ClientCertPath != "" {
+		files = append(files, filepath.Join(m.config.ClientCertPath, CertFileName), filepath.Join(m.config.ClientCertPath, KeyFileName))
+	}
+	return files
+}
+
+// Reload reads the certificates again. If any of them cannot be loaded, the current ones are kept.
+func (m *Material) Reload() derrors.Error {
+	var roots *x509.CertPool
+	var certificate *tls.Certificate
+	var err derrors.Error
+	if m.config.CACertPath != "" {
+		log.Debug().Str("caCertPath", m.config.CACertPath).Msg("loading CA cert")
+		roots, err = LoadCAPool(m.config.CACertPath)
+		if err != nil {
+			return err
+		}
+	}
+	if m.config.ClientCertPath != "" {
+		log.Debug().Str("clientCertPath", m.config.ClientCertPath).Msg("loading client certificate")
+		certificate, err = LoadCertificate(m.config.ClientCertPath)
+		if err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roots = roots
+	m.certificate = certificate
+	return nil
+}
+
+// getClientCertificate returns the current client certificate, or an empty one if there is none.
+func (m *Material) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.certificate == nil {
+		return &tls.Certificate{}, nil
+	}
+	return m.certificate, nil
+}
+
+// verifyPeerCertificate returns the function that verifies the server certificate chain against the current
+// CA pool.
+func (m *Material) verifyPeerCertificate(serverName string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("server did not present a certificate")
+		}
+		certificates := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			certificate, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("cannot parse server certificate: %s", err.Error())
+			}
+			certificates = append(certificates, certificate)
+		}
+		m.mu.RLock()
+		roots := m.roots
+		m.mu.RUnlock()
+		options := x509.VerifyOptions{
+			Roots:         roots,
+			DNSName:       serverName,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, intermediate := range certificates[1:] {
+			options.Intermediates.AddCert(intermediate)
+		}
+		_, err := certificates[0].Verify(options)
+		return err
+	}
+}
+
+// TLSConfig returns the TLS configuration to connect to the given server.
+func (m *Material) TLSConfig(serverName string) *tls.Config {
+	tlsConfig := &tls.Config{
+		ServerName:           serverName,
+		GetClientCertificate: m.getClientCertificate,
+		// The chain is verified by verifyPeerCertificate with the current CA pool.
+		InsecureSkipVerify: true,
+	}
+	if m.config.SkipCAValidation {
+		log.Debug().Str("serverName", serverName).Msg("skipping server cert validation")
+	} else {
+		tlsConfig.VerifyPeerCertificate = m.verifyPeerCertificate(serverName)
+	}
+	return tlsConfig
+}
+
+// Dial creates a connection with a gRPC server. If the material is nil, the connection is established in
+// plaintext.
+func Dial(hostname string, port int, material *Material) (*grpc.ClientConn, derrors.Error) {
+	targetAddress := fmt.Sprintf("%s:%d", hostname, port)
+	option := grpc.WithInsecure()
+	if material != nil {
+		option = grpc.WithTransportCredentials(credentials.NewTLS(material.TLSConfig(hostname)))
+		log.Debug().Str("address", targetAddress).Str("caCertPath", material.config.CACertPath).
+			Str("clientCertPath", material.config.ClientCertPath).Bool("skipCAValidation", material.config.SkipCAValidation).Msg("creating secure connection")
+	} else {
+		log.Debug().Str("address", targetAddress).Msg("creating insecure connection")
+	}
+	conn, err := grpc.Dial(targetAddress, option)
+	if err != nil {
+		return nil, derrors.AsError(err, fmt.Sprintf("cannot create connection with %s", targetAddress))
+	}
+	return conn, nil
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tlsdial
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/nalej/device-controller/internal/testcert"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// serve launches a gRPC health server with the given certificate that requires a client certificate signed by
+// the CA. It returns the port of the server and the function that stops it.
+func serve(server *testcert.Certificate, ca *testcert.Certificate) (int, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	gomega.Expect(err).To(gomega.Succeed())
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Certificate)
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{server.TLSCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	grpc_health_v1.RegisterHealthServer(grpcServer, health.NewServer())
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, grpcServer.Stop
+}
+
+// check sends a health request to the server using the given material.
+func check(port int, material *Material) error {
+	conn, err := Dial("localhost", port, material)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return checkConn(conn)
+}
+
+// checkConn sends a health request through an established connection.
+func checkConn(conn *grpc.ClientConn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	return err
+}
+
+var _ = ginkgo.Describe("TLS dial", func() {
+
+	var dir string
+	var ca, otherCA *testcert.Certificate
+	var caPath, otherCAPath, clientPath string
+	var port int
+	var stop func()
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "tlsdial")
+		gomega.Expect(err).To(gomega.Succeed())
+		ca = testcert.New("ca", nil)
+		otherCA = testcert.New("other-ca", nil)
+		caPath = filepath.Join(dir, "ca.crt")
+		otherCAPath = filepath.Join(dir, "other-ca.crt")
+		clientPath = filepath.Join(dir, "client")
+		ca.WriteCA(caPath)
+		otherCA.WriteCA(otherCAPath)
+		testcert.New("device-controller", ca).WriteDir(clientPath, CertFileName, KeyFileName)
+		port, stop = serve(testcert.New("localhost", ca), ca)
+	})
+
+	ginkgo.AfterEach(func() {
+		stop()
+		gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+	})
+
+	table.DescribeTable("server verification and client certificates",
+		func(config func() Config, succeeds bool) {
+			material, err := NewMaterial(config())
+			gomega.Expect(err).To(gomega.BeNil())
+			if succeeds {
+				gomega.Expect(check(port, material)).To(gomega.Succeed())
+			} else {
+				gomega.Expect(check(port, material)).NotTo(gomega.Succeed())
+			}
+		},
+		table.Entry("server signed by the CA", func() Config {
+			return Config{CACertPath: caPath, ClientCertPath: clientPath}
+		}, true),
+		table.Entry("server signed by another CA", func() Config {
+			return Config{CACertPath: otherCAPath, ClientCertPath: clientPath}
+		}, false),
+		table.Entry("CA validation skipped", func() Config {
+			return Config{CACertPath: otherCAPath, ClientCertPath: clientPath, SkipCAValidation: true}
+		}, true),
+		table.Entry("no client certificate", func() Config {
+			return Config{CACertPath: caPath}
+		}, false),
+	)
+
+	ginkgo.It("should reject invalid certificates when creating the material", func() {
+		_, err := NewMaterial(Config{CACertPath: filepath.Join(dir, "missing.crt")})
+		gomega.Expect(err).NotTo(gomega.BeNil())
+		_, err = NewMaterial(Config{ClientCertPath: filepath.Join(dir, "missing")})
+		gomega.Expect(err).NotTo(gomega.BeNil())
+	})
+
+})